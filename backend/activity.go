@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Proxies whose X-Forwarded-For we believe. Defaults cover the loopback and
+// private ranges used by the docker-compose network in front of nginx.
+var trustedProxies []*net.IPNet
+
+func init() {
+	cidrs := os.Getenv("TRUSTED_PROXIES")
+	if cidrs == "" {
+		cidrs = "127.0.0.0/8,::1/128,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7"
+	}
+	for _, cidr := range strings.Split(cidrs, ",") {
+		if _, network, err := net.ParseCIDR(strings.TrimSpace(cidr)); err == nil {
+			trustedProxies = append(trustedProxies, network)
+		}
+	}
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the client address, walking X-Forwarded-For from the right past any
+// trusted proxies. Untrusted peers cannot spoof their address this way.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// Activity is one audit trail entry. Zero IDs are stored as NULL.
+type Activity struct {
+	ActorID  int
+	TargetID int
+	Action   string
+	Details  map[string]interface{}
+}
+
+type ActivityRecord struct {
+	ID        int64           `json:"id"`
+	ActorID   *int            `json:"actor_id"`
+	TargetID  *int            `json:"target_id"`
+	Action    string          `json:"action"`
+	IPAddress string          `json:"ip_address"`
+	Details   json.RawMessage `json:"details"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func nullableID(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// Record an activity. Failures are logged rather than failing the request.
+func logActivity(r *http.Request, a Activity) {
+	logActivityFrom(clientIP(r), a)
+}
+
+// Record an activity that did not arrive over HTTP, such as a RADIUS request
+func logActivityFrom(ip string, a Activity) {
+	var details interface{}
+	if a.Details != nil {
+		if b, err := json.Marshal(a.Details); err == nil {
+			details = string(b)
+		}
+	}
+
+	_, err := db.Exec(
+		"INSERT INTO activity_logs (actor_id, target_id, action, ip_address, details) VALUES (?, ?, ?, ?, ?)",
+		nullableID(a.ActorID), nullableID(a.TargetID), a.Action, ip, details,
+	)
+	if err != nil {
+		log.Println("Activity log error:", err)
+	}
+}
+
+// Record an activity performed by the authenticated principal
+func logPrincipalActivity(r *http.Request, action string, targetID int, details map[string]interface{}) {
+	logActivity(r, Activity{
+		ActorID:  currentPrincipal(r).UserID,
+		TargetID: targetID,
+		Action:   action,
+		Details:  details,
+	})
+}
+
+// Parse a date filter given as RFC 3339 or YYYY-MM-DD
+func parseActivityTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// Admin: Search the activity log, newest first. Pass next_cursor back as
+// cursor to fetch the following page.
+func AdminGetActivity(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	where := []string{"1 = 1"}
+	var args []interface{}
+
+	for _, f := range []struct{ param, clause string }{
+		{"actor_id", "actor_id = ?"},
+		{"target_id", "target_id = ?"},
+		{"cursor", "id < ?"},
+	} {
+		value := q.Get(f.param)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid "+f.param, http.StatusBadRequest)
+			return
+		}
+		where = append(where, f.clause)
+		args = append(args, id)
+	}
+
+	if action := q.Get("action"); action != "" {
+		// A trailing * matches a prefix such as login.*
+		if strings.HasSuffix(action, "*") {
+			where = append(where, "action LIKE ?")
+			args = append(args, strings.TrimSuffix(action, "*")+"%")
+		} else {
+			where = append(where, "action = ?")
+			args = append(args, action)
+		}
+	}
+
+	for _, f := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		value := q.Get(f.param)
+		if value == "" {
+			continue
+		}
+		t, err := parseActivityTime(value)
+		if err != nil {
+			http.Error(w, "Invalid "+f.param+" date", http.StatusBadRequest)
+			return
+		}
+		where = append(where, "created_at "+f.op+" ?")
+		args = append(args, t)
+	}
+
+	limit := 50
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 500 {
+			http.Error(w, "Limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	rows, err := db.Query(
+		"SELECT id, actor_id, target_id, action, COALESCE(ip_address, ''), details, created_at FROM activity_logs WHERE "+
+			strings.Join(where, " AND ")+" ORDER BY id DESC LIMIT ?",
+		append(args, limit+1)...,
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	records := []ActivityRecord{}
+	for rows.Next() {
+		var rec ActivityRecord
+		var actorID, targetID sql.NullInt64
+		var details sql.NullString
+		if err := rows.Scan(&rec.ID, &actorID, &targetID, &rec.Action, &rec.IPAddress, &details, &rec.CreatedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			rec.ActorID = &id
+		}
+		if targetID.Valid {
+			id := int(targetID.Int64)
+			rec.TargetID = &id
+		}
+		if details.Valid {
+			rec.Details = json.RawMessage(details.String)
+		}
+		records = append(records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"items": records, "next_cursor": nil}
+	if len(records) > limit {
+		records = records[:limit]
+		resp["items"] = records
+		resp["next_cursor"] = records[limit-1].ID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
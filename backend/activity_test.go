@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestClientIP tests that X-Forwarded-For is only honored from trusted proxies
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"direct client", "203.0.113.5:4000", "", "203.0.113.5"},
+		{"spoofed header from untrusted peer", "203.0.113.5:4000", "198.51.100.1", "203.0.113.5"},
+		{"behind trusted proxy", "172.18.0.2:4000", "198.51.100.1", "198.51.100.1"},
+		{"client prepends fake hop", "172.18.0.2:4000", "10.0.0.1, 198.51.100.1", "198.51.100.1"},
+		{"chain of trusted proxies", "127.0.0.1:4000", "198.51.100.1, 10.0.0.8", "198.51.100.1"},
+		{"trusted proxy without header", "127.0.0.1:4000", "", "127.0.0.1"},
+		{"garbage header", "127.0.0.1:4000", "not-an-ip", "127.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := clientIP(req); got != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+// TestParseActivityTime tests the accepted date filter formats
+func TestParseActivityTime(t *testing.T) {
+	for _, value := range []string{"2024-03-01", "2024-03-01T12:00:00Z"} {
+		if _, err := parseActivityTime(value); err != nil {
+			t.Errorf("Expected %q to parse, got %v", value, err)
+		}
+	}
+	if _, err := parseActivityTime("yesterday"); err == nil {
+		t.Error("Expected invalid date to be rejected")
+	}
+}
+
+// TestAdminGetActivityRejectsBadFilters tests filter validation before querying
+func TestAdminGetActivityRejectsBadFilters(t *testing.T) {
+	for _, query := range []string{"actor_id=abc", "cursor=x", "from=soon", "limit=0", "limit=1000"} {
+		req := httptest.NewRequest("GET", "/api/admin/activity?"+query, nil)
+		w := httptest.NewRecorder()
+		AdminGetActivity(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
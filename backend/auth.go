@@ -1,10 +1,10 @@
 package main
 
 import (
-	"crypto/rand"
+	"database/sql"
 	"encoding/json"
-	"fmt"
-	"math/big"
+	"errors"
+	"log"
 	"net/http"
 	"os"
 	"strings"
@@ -30,7 +30,7 @@ type User struct {
 	Password   string    `json:"-"`
 	Role       string    `json:"role"` // admin, reseller, user
 	Email      string    `json:"email"`
-	Status     string    `json:"status"` // active, suspended
+	Status     string    `json:"status"` // active, expired, suspended, archived
 	ExpiryDays int       `json:"expiry_days"`
 	CreatedAt  time.Time `json:"created_at"`
 	ExpiresAt  time.Time `json:"expires_at"`
@@ -47,30 +47,43 @@ type RegisterRequest struct {
 	Email      string `json:"email"`
 	Role       string `json:"role"` // admin, reseller
 	ExpiryDays int    `json:"expiry_days"`
+	UserQuota  *int   `json:"user_quota"` // resellers only
 }
 
 type AuthResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
-	Error string `json:"error,omitempty"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	RenewalOnly  bool   `json:"renewal_only,omitempty"`
+	User         User   `json:"user"`
+	Error        string `json:"error,omitempty"`
+
+	// Set instead of tokens when the login needs a second step
+	TwoFactorRequired      bool     `json:"two_factor_required,omitempty"`
+	TwoFactorSetupRequired bool     `json:"two_factor_setup_required,omitempty"`
+	ChallengeToken         string   `json:"challenge_token,omitempty"`
+	RecoveryCodes          []string `json:"recovery_codes,omitempty"`
 }
 
-// Generate random 6-digit number
-func generateRandomDigits(length int) string {
-	result := ""
-	for i := 0; i < length; i++ {
-		num, _ := rand.Int(rand.Reader, big.NewInt(10))
-		result += fmt.Sprintf("%d", num.Int64())
+var (
+	errAccountSuspended = errors.New("User account is suspended")
+	errAccountExpired   = errors.New("User account has expired")
+	errAccountArchived  = errors.New("User account has been archived")
+)
+
+// Generate a short-lived JWT access token bound to a session
+func generateToken(userID int, role string, sessionID string) (string, error) {
+	jti, err := generateSecureToken(16)
+	if err != nil {
+		return "", err
 	}
-	return result
-}
 
-// Generate JWT token
-func generateToken(userID int, role string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"user_id": userID,
 		"role":    role,
-		"exp":     time.Now().Add(time.Hour * 24).Unix(),
+		"sid":     sessionID,
+		"jti":     jti,
+		"exp":     time.Now().Add(accessTokenTTL).Unix(),
 	})
 
 	tokenString, err := token.SignedString(jwtSecret)
@@ -84,7 +97,7 @@ func generateToken(userID int, role string) (string, error) {
 func verifyToken(tokenString string) (map[string]interface{}, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
 		return jwtSecret, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
 
 	if err != nil || !token.Valid {
 		return nil, err
@@ -102,46 +115,155 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	checks := loginChecks(r, req.Username)
+	if throttle(w, r, checks...) {
+		return
+	}
+
 	var user User
 	err := db.QueryRow(
-		"SELECT id, username, role, email, status, created_at, expires_at FROM users WHERE username = ? AND password = ?",
-		req.Username, hashPassword(req.Password),
-	).Scan(&user.ID, &user.Username, &user.Role, &user.Email, &user.Status, &user.CreatedAt, &user.ExpiresAt)
+		"SELECT id, username, password, role, email, status, created_at, expires_at FROM users WHERE username = ?",
+		req.Username,
+	).Scan(&user.ID, &user.Username, &user.Password, &user.Role, &user.Email, &user.Status, &user.CreatedAt, &user.ExpiresAt)
 
 	if err != nil {
+		rejectPassword(req.Password)
+		recordLoginFailure(r, checks)
+		logActivity(r, Activity{Action: "login.failure", Details: map[string]interface{}{
+			"username": req.Username, "reason": "unknown_user",
+		}})
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(AuthResponse{Error: "Invalid credentials"})
 		return
 	}
 
-	// Check if user is suspended
-	if user.Status == "suspended" {
+	ok, needsRehash := verifyPassword(user.Password, req.Password)
+	if !ok {
+		recordLoginFailure(r, checks)
+		logActivity(r, Activity{TargetID: user.ID, Action: "login.failure", Details: map[string]interface{}{
+			"username": req.Username, "reason": "bad_password",
+		}})
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(AuthResponse{Error: "User account is suspended"})
+		json.NewEncoder(w).Encode(AuthResponse{Error: "Invalid credentials"})
 		return
 	}
 
-	// Check if user is expired
-	if user.ExpiresAt.Before(time.Now()) && user.Role == "user" {
+	// Transparently upgrade plaintext or outdated hashes
+	if needsRehash {
+		if hash, err := hashPassword(req.Password); err == nil {
+			if _, err := db.Exec("UPDATE users SET password = ? WHERE id = ?", hash, user.ID); err != nil {
+				log.Println("Password rehash error:", err)
+			}
+		}
+	}
+
+	// Check if user is suspended or archived. Expired users may still log
+	// in, but only to renew.
+	statusErr := accountStatusError(user.Role, user.Status, user.ExpiresAt)
+	if statusErr != nil && statusErr != errAccountExpired {
+		logActivity(r, Activity{TargetID: user.ID, Action: "login.failure", Details: map[string]interface{}{
+			"username": req.Username, "reason": user.Status,
+		}})
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(AuthResponse{Error: "User account has expired"})
+		json.NewEncoder(w).Encode(AuthResponse{Error: statusErr.Error()})
 		return
 	}
 
-	token, err := generateToken(user.ID, user.Role)
+	// Staff with two-factor enabled, or required by policy, finish at
+	// /api/auth/2fa. The account's failures are only cleared after that.
+	step, err := secondFactorStep(user)
+	if err != nil {
+		log.Println("Two-factor lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if step != "" {
+		challenge, err := issueTwoFactorChallenge(user.ID)
+		if err != nil {
+			http.Error(w, "Token generation error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{
+			TwoFactorRequired:      step == "verify",
+			TwoFactorSetupRequired: step == "setup",
+			ChallengeToken:         challenge,
+		})
+		return
+	}
+
+	completeLogin(w, r, user, checks[1], "password", nil)
+}
+
+// Load the fields a login responds with
+func loadLoginUser(userID int) (User, error) {
+	var user User
+	err := db.QueryRow(
+		"SELECT id, username, role, email, status, created_at, expires_at FROM users WHERE id = ?",
+		userID,
+	).Scan(&user.ID, &user.Username, &user.Role, &user.Email, &user.Status, &user.CreatedAt, &user.ExpiresAt)
+	return user, err
+}
+
+// Open a session for an authenticated user and write the login response.
+// The status is checked again since a two-step login may span a change.
+func completeLogin(w http.ResponseWriter, r *http.Request, user User, account rateLimitCheck, method string, recoveryCodes []string) {
+	statusErr := accountStatusError(user.Role, user.Status, user.ExpiresAt)
+	if statusErr != nil && statusErr != errAccountExpired {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{Error: statusErr.Error()})
+		return
+	}
+
+	// Clear the account's failures. The client IP keeps its count so one
+	// valid login cannot reset an attack spread across many usernames.
+	if err := rateLimiter.Success(r.Context(), account); err != nil {
+		log.Println("Rate limit error:", err)
+	}
+
+	tokens, err := createSession(user.ID, user.Role)
 	if err != nil {
 		http.Error(w, "Token generation error", http.StatusInternalServerError)
 		return
 	}
 
+	logActivity(r, Activity{ActorID: user.ID, TargetID: user.ID, Action: "login.success", Details: map[string]interface{}{
+		"renewal_only": statusErr == errAccountExpired, "method": method,
+	}})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(AuthResponse{
-		Token: token,
-		User:  user,
+		Token:         tokens.AccessToken,
+		RefreshToken:  tokens.RefreshToken,
+		ExpiresIn:     tokens.ExpiresIn,
+		RenewalOnly:   statusErr == errAccountExpired,
+		User:          user,
+		RecoveryCodes: recoveryCodes,
 	})
 }
 
-// Register handler (for admin and reseller creation)
+// Check whether an account may authenticate. An account whose expiry has
+// passed counts as expired even before the lifecycle job updates its status.
+func accountStatusError(role, status string, expiresAt time.Time) error {
+	switch status {
+	case "suspended":
+		return errAccountSuspended
+	case "archived":
+		return errAccountArchived
+	case "expired":
+		return errAccountExpired
+	case "pending_verification":
+		if !emailVerification.AllowUnverifiedLogin {
+			return errAccountUnverified
+		}
+	}
+	if expiresAt.Before(time.Now()) && role == "user" {
+		return errAccountExpired
+	}
+	return nil
+}
+
+// Register handler (for admin and reseller creation, admin only)
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -155,39 +277,96 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Only admin can create other accounts via this endpoint
-	// In production, add proper authorization checks
-
-	username := generateRandomDigits(6)
-	password := generateRandomDigits(6)
-
-	var expiresAt time.Time
-	if req.Role == "user" {
-		expiresAt = time.Now().AddDate(0, req.ExpiryDays/30, req.ExpiryDays%30)
-	} else {
-		expiresAt = time.Date(2099, 12, 31, 0, 0, 0, 0, time.UTC) // No expiry for admin/reseller
+	quota := defaultResellerQuota
+	if req.UserQuota != nil {
+		quota = *req.UserQuota
+	}
+	if quota < 0 {
+		http.Error(w, "User quota must not be negative", http.StatusBadRequest)
+		return
 	}
 
-	result, err := db.Exec(
-		"INSERT INTO users (username, password, role, email, status, expires_at) VALUES (?, ?, ?, ?, 'active', ?)",
-		username, hashPassword(password), req.Role, req.Email, expiresAt,
-	)
-
+	createdBy := currentPrincipal(r).UserID
+	account, err := createStaffAccount(req.Role, req.Email, quota, &createdBy)
 	if err != nil {
-		http.Error(w, "Registration error: "+err.Error(), http.StatusInternalServerError)
+		log.Println("Registration error:", err)
+		http.Error(w, "Registration error", http.StatusInternalServerError)
 		return
 	}
 
-	userID, _ := result.LastInsertId()
+	logPrincipalActivity(r, "account.register", int(account.UserID), map[string]interface{}{
+		"role": req.Role, "user_quota": quota,
+	})
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"username": username,
-		"password": password,
-		"user_id":  userID,
+	resp := map[string]interface{}{
+		"username": account.Username,
+		"password": account.Password,
+		"user_id":  account.UserID,
 		"role":     req.Role,
 		"message":  "Account created successfully",
+	}
+	if req.Role == "reseller" {
+		resp["user_quota"] = quota
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+const defaultResellerQuota = 100
+
+type StaffAccount struct {
+	UserID   int64
+	Username string
+	Password string
+}
+
+// Create an admin or reseller account with generated credentials. Resellers
+// get their resellers row in the same transaction. createdBy is nil only
+// when bootstrapping the first admin.
+func createStaffAccount(role, email string, quota int, createdBy *int) (StaffAccount, error) {
+	password, err := generatePassword(role)
+	if err != nil {
+		return StaffAccount{}, err
+	}
+	account := StaffAccount{Password: password}
+
+	hash, err := hashPassword(account.Password)
+	if err != nil {
+		return StaffAccount{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return StaffAccount{}, err
+	}
+	defer tx.Rollback()
+
+	expiresAt := time.Date(2099, 12, 31, 0, 0, 0, 0, time.UTC) // No expiry for admin/reseller
+	var result sql.Result
+	account.Username, err = withGeneratedUsername(role, func(username string) error {
+		result, err = tx.Exec(
+			"INSERT INTO users (username, password, role, email, status, expires_at, created_by) VALUES (?, ?, ?, ?, 'active', ?, ?)",
+			username, hash, role, email, expiresAt, createdBy,
+		)
+		return err
 	})
+	if err != nil {
+		return StaffAccount{}, err
+	}
+
+	account.UserID, _ = result.LastInsertId()
+
+	if role == "reseller" {
+		if _, err := tx.Exec("INSERT INTO resellers (user_id, user_quota) VALUES (?, ?)", account.UserID, quota); err != nil {
+			return StaffAccount{}, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return StaffAccount{}, err
+	}
+	return account, nil
 }
 
 // Public user registration for VPN package purchase
@@ -204,6 +383,10 @@ func PublicRegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if throttle(w, r, rateLimitCheck{signupIPRule, clientIP(r)}) {
+		return
+	}
+
 	// Validate required fields
 	if req.Email == "" || req.Password == "" || req.PackageID == 0 {
 		w.Header().Set("Content-Type", "application/json")
@@ -211,6 +394,12 @@ func PublicRegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := passwordPolicy.Validate(req.Password, req.Email); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(AuthResponse{Error: err.Error()})
+		return
+	}
+
 	// Check if email already exists
 	var existingID int
 	err := db.QueryRow("SELECT id FROM users WHERE email = ?", req.Email).Scan(&existingID)
@@ -221,80 +410,100 @@ func PublicRegisterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Get package details to calculate expiry
-	var pkg struct {
-		ID    int     `json:"id"`
-		Name  string  `json:"name"`
-		Days  int     `json:"days"`
-		Price float64 `json:"price"`
-	}
-
-	err = db.QueryRow("SELECT id, name, days, price FROM packages WHERE id = ?", req.PackageID).Scan(
-		&pkg.ID, &pkg.Name, &pkg.Days, &pkg.Price,
-	)
+	pkg, err := loadPurchasablePackage(db, req.PackageID, false)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(AuthResponse{Error: "Invalid package selected"})
 		return
 	}
 
-	// Generate username (6-digit number)
-	username := generateRandomDigits(6)
-
 	// Calculate expiry date based on package
 	expiresAt := time.Now().AddDate(0, 0, pkg.Days)
 
-	// Create user account
-	result, err := db.Exec(
-		"INSERT INTO users (username, password, role, email, status, expires_at, full_name, package_id) VALUES (?, ?, 'user', ?, 'active', ?, ?, ?)",
-		username, hashPassword(req.Password), req.Email, expiresAt, req.FullName, pkg.ID,
-	)
-
+	hash, err := hashPassword(req.Password)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(AuthResponse{Error: "Registration failed: " + err.Error()})
+		json.NewEncoder(w).Encode(AuthResponse{Error: "Registration failed"})
 		return
 	}
 
-	userID, _ := result.LastInsertId()
-
-	// Generate token for immediate login
-	token, err := generateToken(int(userID), "user")
+	// Create user account under a generated username. It stays pending
+	// until the email address is verified.
+	var result sql.Result
+	username, err := withGeneratedUsername("user", func(username string) error {
+		result, err = db.Exec(
+			"INSERT INTO users (username, password, role, email, status, expires_at, full_name, package_id) VALUES (?, ?, 'user', ?, 'pending_verification', ?, ?, ?)",
+			username, hash, req.Email, expiresAt, req.FullName, pkg.ID,
+		)
+		return err
+	})
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(AuthResponse{Error: "Token generation failed"})
+		json.NewEncoder(w).Encode(AuthResponse{Error: "Registration failed: " + err.Error()})
 		return
 	}
 
+	userID, _ := result.LastInsertId()
+
+	logActivity(r, Activity{ActorID: int(userID), TargetID: int(userID), Action: "account.signup", Details: map[string]interface{}{
+		"email": req.Email, "package_id": pkg.ID,
+	}})
+
+	sendVerificationMail(int(userID), username, req.Email)
+
 	// Create user object for response
 	user := User{
 		ID:        int(userID),
 		Username:  username,
 		Role:      "user",
 		Email:     req.Email,
-		Status:    "active",
+		Status:    "pending_verification",
 		CreatedAt: time.Now(),
 		ExpiresAt: expiresAt,
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"token":    token,
-		"user":     user,
-		"username": username,
-		"package":  pkg,
-		"message":  "Account created successfully! Your VPN username is: " + username,
-		"success":  true,
-	})
-}
+	resp := map[string]interface{}{
+		"user":                  user,
+		"username":              username,
+		"package":               pkg,
+		"verification_required": true,
+		"message":               "Account created! Your VPN username is: " + username + ". Check your email to verify your address.",
+		"success":               true,
+	}
 
-// Simple password hashing (use bcrypt in production)
-func hashPassword(password string) string {
-	return password // Placeholder - use bcrypt or similar in production
+	// Log straight in only when unverified accounts may do so
+	if emailVerification.AllowUnverifiedLogin {
+		tokens, err := createSession(int(userID), "user")
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(AuthResponse{Error: "Token generation failed"})
+			return
+		}
+		resp["token"] = tokens.AccessToken
+		resp["refresh_token"] = tokens.RefreshToken
+		resp["expires_in"] = tokens.ExpiresIn
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 // Auth middleware
 func AuthMiddleware(next http.Handler) http.Handler {
+	return authenticate(next, false)
+}
+
+// Auth middleware that also admits expired accounts, for renewal routes
+func RenewalAuthMiddleware(next http.Handler) http.Handler {
+	return authenticate(next, true)
+}
+
+func authenticate(next http.Handler, allowExpired bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range identityHeaders {
+			r.Header.Del(h)
+		}
+
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
 			http.Error(w, "Missing authorization header", http.StatusUnauthorized)
@@ -308,18 +517,31 @@ func AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		// Store claims in context for later use
-		r.Header.Set("user_id", fmt.Sprintf("%.0f", claims["user_id"]))
-		r.Header.Set("user_role", claims["role"].(string))
+		userID, _ := claims["user_id"].(float64)
+		sessionID, _ := claims["sid"].(string)
+
+		// Reject revoked sessions and suspended, expired or deleted accounts
+		principal, err := validateSession(sessionID, int(userID))
+		if err == errAccountExpired && !allowExpired {
+			http.Error(w, "Account expired; renewal required", http.StatusPaymentRequired)
+			return
+		}
+		if err != nil && err != errAccountExpired {
+			if err != errSessionNotFound && err != errAccountSuspended && err != errAccountArchived && err != errAccountUnverified {
+				log.Println("Session validation error:", err)
+			}
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), principal)))
 	})
 }
 
 // Admin only middleware
 func AdminOnly(next http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Header.Get("user_role") != "admin" {
+		if currentPrincipal(r).Role != "admin" {
 			http.Error(w, "Admin access required", http.StatusForbidden)
 			return
 		}
@@ -330,7 +552,7 @@ func AdminOnly(next http.HandlerFunc) http.Handler {
 // Reseller only middleware
 func ResellerOnly(next http.HandlerFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		role := r.Header.Get("user_role")
+		role := currentPrincipal(r).Role
 		if role != "reseller" && role != "admin" {
 			http.Error(w, "Reseller access required", http.StatusForbidden)
 			return
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errAdminExists = errors.New("an admin account already exists")
+
+// Create the very first admin on an empty database. Refuses to run once
+// any admin exists so it cannot be used to mint extra admins.
+func bootstrapAdmin(email string) (StaffAccount, error) {
+	var admins int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin'").Scan(&admins); err != nil {
+		return StaffAccount{}, err
+	}
+	if admins > 0 {
+		return StaffAccount{}, errAdminExists
+	}
+
+	return createStaffAccount("admin", email, 0, nil)
+}
+
+func printBootstrapAccount(account StaffAccount) {
+	fmt.Println("Admin account created")
+	fmt.Println("  Username:", account.Username)
+	fmt.Println("  Password:", account.Password)
+	fmt.Println("Store these credentials now; the password cannot be recovered.")
+}
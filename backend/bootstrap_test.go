@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRegisterRejectsNonAdmins tests that only admins can create staff accounts
+func TestRegisterRejectsNonAdmins(t *testing.T) {
+	handler := AdminOnly(RegisterHandler)
+
+	for _, p := range []*Principal{nil, {UserID: 2, Role: "reseller"}, {UserID: 3, Role: "user"}} {
+		req := httptest.NewRequest("POST", "/api/auth/register", strings.NewReader(`{"role": "admin"}`))
+		if p != nil {
+			req = req.WithContext(withPrincipal(req.Context(), *p))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%+v: expected status 403, got %d", p, w.Code)
+		}
+	}
+}
+
+// TestRegisterRouteRejectsResellerToken tests the full middleware chain with
+// a real reseller session
+func TestRegisterRouteRejectsResellerToken(t *testing.T) {
+	testDB := openTestDB(t)
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, 'x', 'reseller', 'active', '2099-12-31')",
+		"rg"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("Reseller insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+
+	tokens, err := createSession(int(id), "reseller")
+	if err != nil {
+		t.Fatalf("Session error: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/auth/register", strings.NewReader(`{"role": "admin"}`))
+	req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+	w := httptest.NewRecorder()
+	AuthMiddleware(AdminOnly(RegisterHandler)).ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestBootstrapAdminRefusesOnceAdminExists tests that the bootstrap cannot
+// mint extra admins
+func TestBootstrapAdminRefusesOnceAdminExists(t *testing.T) {
+	testDB := openTestDB(t)
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, 'x', 'admin', 'active', '2099-12-31')",
+		"ba"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("Admin insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+
+	var before, after int
+	testDB.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin'").Scan(&before)
+
+	if _, err := bootstrapAdmin(""); err != errAdminExists {
+		t.Errorf("Expected errAdminExists, got %v", err)
+	}
+
+	testDB.QueryRow("SELECT COUNT(*) FROM users WHERE role = 'admin'").Scan(&after)
+	if after != before {
+		t.Errorf("Expected %d admins, got %d", before, after)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest batch a single bulk request may create
+const maxBulkUsers = 500
+
+// BulkUser is one account created by a bulk request
+type BulkUser struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+}
+
+// bulkRequest is a parsed bulk provisioning request. Emails, when given,
+// are assigned to the accounts in order.
+type bulkRequest struct {
+	Count      int
+	ExpiryDays int
+	Emails     []string
+}
+
+// Read emails from the first column of a CSV. A leading "email" header
+// row and blank rows are skipped.
+func parseEmailCSV(r io.Reader) ([]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var emails []string
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New("Invalid CSV")
+		}
+		email := strings.TrimSpace(record[0])
+		if email == "" || (line == 1 && strings.EqualFold(email, "email")) {
+			continue
+		}
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			return nil, fmt.Errorf("Invalid email on line %d", line)
+		}
+		if len(emails) == maxBulkUsers {
+			return nil, fmt.Errorf("At most %d users per batch", maxBulkUsers)
+		}
+		emails = append(emails, email)
+	}
+	return emails, nil
+}
+
+// Parse a bulk request. JSON bodies carry count, expiry_days and an
+// optional emails_csv; a text/csv body is the email list itself with
+// count and expiry_days in the query string.
+func parseBulkRequest(r *http.Request) (bulkRequest, error) {
+	var req bulkRequest
+	var emailsCSV string
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			return req, errors.New("Invalid request")
+		}
+		emailsCSV = string(body)
+		for param, dst := range map[string]*int{"count": &req.Count, "expiry_days": &req.ExpiryDays} {
+			if value := r.URL.Query().Get(param); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return req, errors.New("Invalid " + param)
+				}
+				*dst = n
+			}
+		}
+	} else {
+		var body struct {
+			Count      int    `json:"count"`
+			ExpiryDays int    `json:"expiry_days"`
+			EmailsCSV  string `json:"emails_csv"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return req, errors.New("Invalid request")
+		}
+		req.Count, req.ExpiryDays, emailsCSV = body.Count, body.ExpiryDays, body.EmailsCSV
+	}
+
+	if strings.TrimSpace(emailsCSV) != "" {
+		emails, err := parseEmailCSV(strings.NewReader(emailsCSV))
+		if err != nil {
+			return req, err
+		}
+		if req.Count == 0 {
+			req.Count = len(emails)
+		}
+		if req.Count != len(emails) {
+			return req, errors.New("Count does not match the number of emails")
+		}
+		req.Emails = emails
+	}
+
+	if req.Count < 1 || req.Count > maxBulkUsers {
+		return req, fmt.Errorf("Count must be between 1 and %d", maxBulkUsers)
+	}
+	if req.ExpiryDays < 1 {
+		return req, errors.New("Invalid expiry_days")
+	}
+	return req, nil
+}
+
+// Hash passwords on all CPUs; a batch of 500 takes minutes one at a time
+func hashPasswords(passwords []string) ([]string, error) {
+	hashes := make([]string, len(passwords))
+	errs := make([]error, len(passwords))
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range next {
+				hashes[j], errs[j] = hashPassword(passwords[j])
+			}
+		}()
+	}
+	for i := range passwords {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// Whether the client asked for the batch as a CSV download
+func wantsCSV(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "csv"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/csv")
+}
+
+// Reseller: Create a batch of users in one transaction. Either every
+// account fits within the quota and is created, or none are.
+func ResellerBulkCreateUsers(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+	resellerID := principal.UserID
+
+	req, err := parseBulkRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Fail fast before hashing; the locked check below is authoritative
+	if principal.Role == "reseller" {
+		quota, used, err := resellerQuotaUsage(db, resellerID)
+		switch {
+		case err == errNoResellerQuota:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		case used+req.Count > quota:
+			http.Error(w, errQuotaExceeded.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	users := make([]BulkUser, req.Count)
+	passwords := make([]string, req.Count)
+	for i := range users {
+		if passwords[i], err = generatePassword("user"); err != nil {
+			http.Error(w, "Credential generation error", http.StatusInternalServerError)
+			return
+		}
+		users[i].Password = passwords[i]
+		if req.Emails != nil {
+			users[i].Email = req.Emails[i]
+		}
+	}
+	hashes, err := hashPasswords(passwords)
+	if err != nil {
+		http.Error(w, "Password hashing error", http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Now().AddDate(0, req.ExpiryDays/30, req.ExpiryDays%30)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if principal.Role == "reseller" {
+		switch err := reserveResellerQuota(tx, resellerID, req.Count); err {
+		case nil:
+		case errNoResellerQuota, errQuotaExceeded:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ids := make([]int, len(users))
+	for i := range users {
+		var id int64
+		users[i].Username, err = withGeneratedUsername("user", func(username string) error {
+			result, err := tx.Exec(
+				"INSERT INTO users (username, password, role, email, status, expires_at, reseller_id) VALUES (?, ?, 'user', ?, 'active', ?, ?)",
+				username, hashes[i], users[i].Email, expiresAt, resellerID,
+			)
+			if err != nil {
+				return err
+			}
+			id, err = result.LastInsertId()
+			return err
+		})
+		if err != nil {
+			log.Println("Bulk creation error:", err)
+			http.Error(w, "Creation error", http.StatusInternalServerError)
+			return
+		}
+		users[i].UserID = int(id)
+		ids[i] = int(id)
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Creation error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "reseller.bulk_create_users", 0, map[string]interface{}{
+		"count": len(users), "user_ids": ids, "expires_at": expiresAt,
+	})
+
+	// The response carries plaintext passwords
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsCSV(r) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="users-%s.csv"`, time.Now().UTC().Format("20060102-150405")))
+		out := csv.NewWriter(w)
+		out.Write([]string{"user_id", "username", "password", "email", "expires_at"})
+		for _, u := range users {
+			out.Write([]string{strconv.Itoa(u.UserID), u.Username, u.Password, u.Email, expiresAt.UTC().Format(time.RFC3339)})
+		}
+		out.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"users":      users,
+		"count":      len(users),
+		"expires_at": expiresAt,
+		"message":    "Users created successfully",
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestParseEmailCSV tests header skipping, blank rows and validation
+func TestParseEmailCSV(t *testing.T) {
+	emails, err := parseEmailCSV(strings.NewReader("email,name\na@example.com,Ann\n\n b@example.com \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 2 || emails[0] != "a@example.com" || emails[1] != "b@example.com" {
+		t.Errorf("Unexpected emails %v", emails)
+	}
+
+	for _, input := range []string{"not-an-email\n", "Ann <a@example.com>\n", "\"unterminated\n"} {
+		if _, err := parseEmailCSV(strings.NewReader(input)); err == nil {
+			t.Errorf("Expected %q to be rejected", input)
+		}
+	}
+
+	if _, err := parseEmailCSV(strings.NewReader(strings.Repeat("x@example.com\n", maxBulkUsers+1))); err == nil {
+		t.Error("Expected an oversized batch to be rejected")
+	}
+}
+
+// TestParseBulkRequest tests JSON and CSV request bodies
+func TestParseBulkRequest(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/reseller/users/bulk", strings.NewReader(`{"expiry_days": 30, "emails_csv": "a@example.com\nb@example.com"}`))
+	bulk, err := parseBulkRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bulk.Count != 2 || bulk.ExpiryDays != 30 || len(bulk.Emails) != 2 {
+		t.Errorf("Unexpected request %+v", bulk)
+	}
+
+	req = httptest.NewRequest("POST", "/api/reseller/users/bulk?expiry_days=90", strings.NewReader("a@example.com\n"))
+	req.Header.Set("Content-Type", "text/csv; charset=utf-8")
+	bulk, err = parseBulkRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bulk.Count != 1 || bulk.ExpiryDays != 90 {
+		t.Errorf("Unexpected request %+v", bulk)
+	}
+}
+
+// TestResellerBulkCreateUsersRejectsBadRequests tests validation before querying
+func TestResellerBulkCreateUsersRejectsBadRequests(t *testing.T) {
+	for _, body := range []string{
+		`{"count": 0, "expiry_days": 30}`,
+		`{"count": 501, "expiry_days": 30}`,
+		`{"count": 5}`,
+		`{"count": 3, "expiry_days": 30, "emails_csv": "a@example.com"}`,
+		`not json`,
+	} {
+		req := httptest.NewRequest("POST", "/api/reseller/users/bulk", strings.NewReader(body))
+		req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 1, Role: "reseller"}))
+		w := httptest.NewRecorder()
+		ResellerBulkCreateUsers(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+}
+
+// TestResellerBulkCreateUsersQuota tests that a batch is created whole or not at all
+func TestResellerBulkCreateUsersQuota(t *testing.T) {
+	testDB := openTestDB(t)
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, email, status, expires_at) VALUES (?, 'x', 'reseller', 'bulk@test.local', 'active', '2099-12-31')",
+		"bk"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("Reseller insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	resellerID := int(id)
+	t.Cleanup(func() {
+		testDB.Exec("DELETE FROM users WHERE reseller_id = ?", resellerID)
+		testDB.Exec("DELETE FROM users WHERE id = ?", resellerID)
+	})
+	if _, err := testDB.Exec("INSERT INTO resellers (user_id, user_quota) VALUES (?, 5)", resellerID); err != nil {
+		t.Fatalf("Quota insert failed: %v", err)
+	}
+
+	create := func(body, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/reseller/users/bulk"+query, bytes.NewBufferString(body))
+		req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: resellerID, Role: "reseller"}))
+		w := httptest.NewRecorder()
+		ResellerBulkCreateUsers(w, req)
+		return w
+	}
+
+	w := create(`{"count": 3, "expiry_days": 30}`, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Users []BulkUser `json:"users"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Users) != 3 || resp.Users[0].Username == "" || resp.Users[0].Password == "" {
+		t.Fatalf("Unexpected users %+v", resp.Users)
+	}
+
+	// Users created without an email can still sign in
+	checkLoginAndRefresh(t, resp.Users[0].Username, resp.Users[0].Password)
+
+	// Three more would exceed the quota of five, so none are created
+	if w := create(`{"count": 3, "expiry_days": 30}`, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", w.Code)
+	}
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM users WHERE reseller_id = ?", resellerID).Scan(&count)
+	if count != 3 {
+		t.Errorf("Expected 3 users after the rejected batch, got %d", count)
+	}
+
+	w = create(`{"expiry_days": 30, "emails_csv": "a@example.com\nb@example.com"}`, "?format=csv")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil || len(records) != 3 || records[2][3] != "b@example.com" {
+		t.Errorf("Unexpected CSV %v (%v)", records, err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Named alphabets for generated credentials. "unambiguous" leaves out
+// characters that are easily confused when read aloud or copied by hand.
+var credentialAlphabets = map[string]string{
+	"digits":      "0123456789",
+	"lower":       "abcdefghijklmnopqrstuvwxyz0123456789",
+	"alnum":       "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789",
+	"unambiguous": "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789",
+}
+
+// CredentialPolicy controls the usernames and passwords generated for a role
+type CredentialPolicy struct {
+	UsernameAlphabet string
+	UsernameLength   int
+	PasswordAlphabet string
+	PasswordLength   int
+}
+
+var credentialPolicies = map[string]CredentialPolicy{
+	"admin":    {credentialAlphabets["digits"], 8, credentialAlphabets["unambiguous"], 20},
+	"reseller": {credentialAlphabets["digits"], 8, credentialAlphabets["unambiguous"], 16},
+	"user":     {credentialAlphabets["digits"], 8, credentialAlphabets["unambiguous"], 12},
+}
+
+// Read e.g. USER_USERNAME_LENGTH or RESELLER_PASSWORD_ALPHABET. Alphabets
+// may be a name from credentialAlphabets or a literal set of characters.
+func init() {
+	for role, policy := range credentialPolicies {
+		prefix := strings.ToUpper(role) + "_"
+		if err := policy.configure(os.Getenv, prefix); err != nil {
+			log.Printf("Ignoring %s credential settings: %v", role, err)
+			continue
+		}
+		credentialPolicies[role] = policy
+	}
+}
+
+func (p *CredentialPolicy) configure(getenv func(string) string, prefix string) error {
+	for _, f := range []struct {
+		name     string
+		alphabet *string
+		length   *int
+	}{
+		{"USERNAME", &p.UsernameAlphabet, &p.UsernameLength},
+		{"PASSWORD", &p.PasswordAlphabet, &p.PasswordLength},
+	} {
+		if value := getenv(prefix + f.name + "_ALPHABET"); value != "" {
+			if named, ok := credentialAlphabets[value]; ok {
+				value = named
+			}
+			if len(value) < 2 {
+				return fmt.Errorf("%s alphabet needs at least two characters", strings.ToLower(f.name))
+			}
+			*f.alphabet = value
+		}
+		if value := getenv(prefix + f.name + "_LENGTH"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 6 || n > 50 {
+				return fmt.Errorf("%s length must be between 6 and 50", strings.ToLower(f.name))
+			}
+			*f.length = n
+		}
+	}
+	return nil
+}
+
+// Pick length characters uniformly from alphabet
+func randomString(alphabet string, length int) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+func generateUsername(role string) (string, error) {
+	p := credentialPolicies[role]
+	return randomString(p.UsernameAlphabet, p.UsernameLength)
+}
+
+func generatePassword(role string) (string, error) {
+	p := credentialPolicies[role]
+	return randomString(p.PasswordAlphabet, p.PasswordLength)
+}
+
+const usernameAttempts = 5
+
+var errUsernameExhausted = errors.New("Could not allocate a unique username")
+
+// Report whether err is a duplicate key error on users.username
+func isDuplicateUsername(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == 1062 && strings.Contains(myErr.Message, "username")
+}
+
+// Generate usernames for role and call insert until one is not taken.
+// A failed INSERT leaves a MySQL transaction usable, so insert may run
+// inside one.
+func withGeneratedUsername(role string, insert func(username string) error) (string, error) {
+	for attempt := 0; attempt < usernameAttempts; attempt++ {
+		username, err := generateUsername(role)
+		if err != nil {
+			return "", err
+		}
+		if err := insert(username); !isDuplicateUsername(err) {
+			return username, err
+		}
+	}
+	return "", errUsernameExhausted
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// TestCredentialPolicyConfigure tests environment overrides and their validation
+func TestCredentialPolicyConfigure(t *testing.T) {
+	env := map[string]string{
+		"USER_USERNAME_ALPHABET": "lower",
+		"USER_USERNAME_LENGTH":   "10",
+		"USER_PASSWORD_ALPHABET": "xyz",
+	}
+	p := credentialPolicies["user"]
+	if err := p.configure(func(k string) string { return env[k] }, "USER_"); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	if p.UsernameAlphabet != credentialAlphabets["lower"] || p.UsernameLength != 10 || p.PasswordAlphabet != "xyz" {
+		t.Errorf("Unexpected policy %+v", p)
+	}
+
+	for _, bad := range []map[string]string{
+		{"USER_PASSWORD_LENGTH": "4"},
+		{"USER_PASSWORD_LENGTH": "many"},
+		{"USER_USERNAME_ALPHABET": "a"},
+	} {
+		p := credentialPolicies["user"]
+		if err := p.configure(func(k string) string { return bad[k] }, "USER_"); err == nil {
+			t.Errorf("Expected %v to be rejected", bad)
+		}
+	}
+}
+
+// TestGeneratedCredentials tests that credentials follow the role's policy
+func TestGeneratedCredentials(t *testing.T) {
+	p := credentialPolicies["reseller"]
+	password, err := generatePassword("reseller")
+	if err != nil {
+		t.Fatalf("Generation failed: %v", err)
+	}
+	if len(password) != p.PasswordLength || strings.Trim(password, p.PasswordAlphabet) != "" {
+		t.Errorf("Password %q does not follow the policy", password)
+	}
+}
+
+// TestWithGeneratedUsernameRetries tests retrying on username collisions only
+func TestWithGeneratedUsernameRetries(t *testing.T) {
+	duplicate := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '1' for key 'users.username'"}
+
+	calls := 0
+	username, err := withGeneratedUsername("user", func(username string) error {
+		calls++
+		if calls < 3 {
+			return duplicate
+		}
+		return nil
+	})
+	if err != nil || username == "" || calls != 3 {
+		t.Errorf("Expected success on the third attempt, got %q, %v after %d calls", username, err, calls)
+	}
+
+	calls = 0
+	_, err = withGeneratedUsername("user", func(string) error {
+		calls++
+		return duplicate
+	})
+	if err != errUsernameExhausted || calls != usernameAttempts {
+		t.Errorf("Expected errUsernameExhausted after %d calls, got %v after %d", usernameAttempts, err, calls)
+	}
+
+	other := errors.New("connection lost")
+	calls = 0
+	_, err = withGeneratedUsername("user", func(string) error {
+		calls++
+		return other
+	})
+	if err != other || calls != 1 {
+		t.Errorf("Expected other errors to be returned immediately, got %v after %d calls", err, calls)
+	}
+}
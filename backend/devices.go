@@ -0,0 +1,215 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Largest per-user override an admin may set
+const maxDeviceOverride = 100
+
+var (
+	errDeviceLimitReached = errors.New("Device limit reached for this account")
+	errDeviceNameTooLong  = errors.New("Device name is too long")
+)
+
+// Trim a requested device name, falling back to a default when empty
+func deviceName(raw string) (string, error) {
+	name := strings.TrimSpace(raw)
+	if name == "" {
+		name = "My device"
+	}
+	if len(name) > 64 {
+		return "", errDeviceNameTooLong
+	}
+	return name, nil
+}
+
+// How many devices a user may register and how many they have. An admin
+// override on the user wins over the package's max_devices.
+func deviceLimit(q queryRower, userID int) (limit, used int, err error) {
+	err = q.QueryRow(
+		`SELECT COALESCE(u.max_devices, p.max_devices, 1), (SELECT COUNT(*) FROM devices d WHERE d.user_id = u.id)
+		FROM users u LEFT JOIN packages p ON p.id = u.package_id WHERE u.id = ?`,
+		userID,
+	).Scan(&limit, &used)
+	if err == sql.ErrNoRows {
+		return 0, 0, errUserNotFound
+	}
+	return limit, used, err
+}
+
+// User: List the caller's devices with the account's device limit
+func GetDevices(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	limit, _, err := deviceLimit(db, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT id, user_id, name, public_key, COALESCE(ipv4, ''), COALESCE(ipv6, ''), node_id, created_at FROM devices WHERE user_id = ? ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		var d Device
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Name, &d.PublicKey, &d.IPv4, &d.IPv6, &d.NodeID, &d.CreatedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"devices":     devices,
+		"max_devices": limit,
+	})
+}
+
+// User: Rename one of the caller's devices
+func RenameDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	name, err := deviceName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID := currentPrincipal(r).UserID
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM devices WHERE id = ? AND user_id = ?)", deviceID, userID).Scan(&exists); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, errDeviceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if _, err := db.Exec("UPDATE devices SET name = ? WHERE id = ? AND user_id = ?", name, deviceID, userID); err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "device.rename", userID, map[string]interface{}{"device_id": deviceID, "name": name})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Device renamed successfully"})
+}
+
+// User: Revoke one of the caller's devices. Its key stops being served to
+// the VPN server and its tunnel addresses return to the pool.
+func RevokeDevice(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	userID := currentPrincipal(r).UserID
+	var name, publicKey string
+	err = db.QueryRow("SELECT name, public_key FROM devices WHERE id = ? AND user_id = ?", deviceID, userID).Scan(&name, &publicKey)
+	if err == sql.ErrNoRows {
+		http.Error(w, errDeviceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM devices WHERE id = ? AND user_id = ?", deviceID, userID); err != nil {
+		http.Error(w, "Delete error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "device.revoke", userID, map[string]interface{}{
+		"device_id": deviceID, "name": name, "public_key": publicKey,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Device revoked successfully"})
+}
+
+// Admin: Override how many devices a user may register. A null
+// max_devices clears the override so the package's limit applies again.
+func AdminSetUserDeviceLimit(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req map[string]*int
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	override, ok := req["max_devices"]
+	if !ok {
+		http.Error(w, "max_devices is required", http.StatusBadRequest)
+		return
+	}
+	if override != nil && (*override < 0 || *override > maxDeviceOverride) {
+		http.Error(w, "max_devices must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("UPDATE users SET max_devices = ? WHERE id = ?", override, userID)
+	if err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var exists bool
+		db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists)
+		if !exists {
+			http.Error(w, errUserNotFound.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	limit, used, err := deviceLimit(db, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "user.set_device_limit", userID, map[string]interface{}{"max_devices": override})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":     userID,
+		"override":    override,
+		"max_devices": limit,
+		"devices":     used,
+	})
+}
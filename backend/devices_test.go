@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestDeviceName tests trimming, the default name and the length limit
+func TestDeviceName(t *testing.T) {
+	if name, err := deviceName("  laptop "); err != nil || name != "laptop" {
+		t.Errorf("Expected trimmed name, got %q (%v)", name, err)
+	}
+	if name, _ := deviceName(" "); name != "My device" {
+		t.Errorf("Expected the default name, got %q", name)
+	}
+	if _, err := deviceName(strings.Repeat("x", 65)); err != errDeviceNameTooLong {
+		t.Errorf("Expected a long name to be rejected, got %v", err)
+	}
+}
+
+// TestDeviceLimit tests that registration stops at the limit, that an
+// admin override applies and that revoking a device frees its slot
+func TestDeviceLimit(t *testing.T) {
+	testDB := openTestDB(t)
+
+	var packageID int
+	if err := testDB.QueryRow("SELECT id FROM packages WHERE max_devices = 1 LIMIT 1").Scan(&packageID); err != nil {
+		t.Skip("No single-device package available")
+	}
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at, package_id) VALUES (?, 'x', 'user', 'active', '2099-12-31', ?)",
+		"dl"+testSuffix(t), packageID,
+	)
+	if err != nil {
+		t.Fatalf("User insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	user := Principal{UserID: int(id), Role: "user"}
+	t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", user.UserID) })
+
+	create := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/user/devices", strings.NewReader(`{"name":"phone"}`))
+		req = req.WithContext(withPrincipal(req.Context(), user))
+		w := httptest.NewRecorder()
+		CreateDevice(w, req)
+		return w
+	}
+
+	w := create()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var device Device
+	json.Unmarshal(w.Body.Bytes(), &device)
+
+	if w := create(); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the package limit to refuse a second device, got %d", w.Code)
+	}
+
+	// An admin override raises the limit
+	body, _ := json.Marshal(map[string]int{"max_devices": 2})
+	req := httptest.NewRequest("PUT", "/api/admin/users/"+strconv.Itoa(user.UserID)+"/max-devices", bytes.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(user.UserID)})
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: user.UserID, Role: "admin"}))
+	w = httptest.NewRecorder()
+	AdminSetUserDeviceLimit(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := create(); w.Code != http.StatusOK {
+		t.Fatalf("Expected the override to allow a second device, got %d", w.Code)
+	}
+	if w := create(); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a third device to be refused, got %d", w.Code)
+	}
+
+	// Revoking frees the slot
+	req = httptest.NewRequest("DELETE", "/api/user/devices/"+strconv.Itoa(device.ID), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(device.ID)})
+	req = req.WithContext(withPrincipal(req.Context(), user))
+	w = httptest.NewRecorder()
+	RevokeDevice(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if limit, used, err := deviceLimit(testDB, user.UserID); err != nil || limit != 2 || used != 1 {
+		t.Errorf("Expected 1 of 2 devices, got %d of %d (%v)", used, limit, err)
+	}
+	if w := create(); w.Code != http.StatusOK {
+		t.Errorf("Expected the freed slot to be reusable, got %d", w.Code)
+	}
+}
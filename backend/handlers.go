@@ -1,36 +1,36 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
-	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-type Package struct {
-	ID          int     `json:"id"`
-	Name        string  `json:"name"`
-	Days        int     `json:"days"`
-	Price       float64 `json:"price"`
-	Description string  `json:"description"`
-}
-
 type UserResponse struct {
 	ID         int       `json:"id"`
 	Username   string    `json:"username"`
 	Email      string    `json:"email"`
 	Role       string    `json:"role"`
-	Status     string    `json:"status"`
+	Status     string    `json:"status"` // active, expired, suspended, archived
 	CreatedAt  time.Time `json:"created_at"`
 	ExpiresAt  time.Time `json:"expires_at"`
 	ResellerID *int      `json:"reseller_id,omitempty"`
 }
 
+// Parse the {id} path variable
+func pathID(r *http.Request) (int, error) {
+	return strconv.Atoi(mux.Vars(r)["id"])
+}
+
 // Get user profile
 func GetUserProfile(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("user_id")
+	userID := currentPrincipal(r).UserID
 
 	var user UserResponse
 	err := db.QueryRow(
@@ -49,7 +49,7 @@ func GetUserProfile(w http.ResponseWriter, r *http.Request) {
 
 // Update user profile
 func UpdateUserProfile(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("user_id")
+	userID := currentPrincipal(r).UserID
 
 	var update map[string]interface{}
 	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
@@ -63,52 +63,148 @@ func UpdateUserProfile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := db.Exec("UPDATE users SET email = ? WHERE id = ?", email, userID)
+	var current string
+	if err := db.QueryRow("SELECT COALESCE(email, '') FROM users WHERE id = ?", userID).Scan(&current); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// A new address has to be verified again
+	_, err := db.Exec(
+		"UPDATE users SET email_verified_at = IF(email <=> ?, email_verified_at, NULL), email = ? WHERE id = ?",
+		email, email, userID,
+	)
 	if err != nil {
 		http.Error(w, "Update error", http.StatusInternalServerError)
 		return
 	}
 
+	logPrincipalActivity(r, "profile.update", userID, map[string]interface{}{"email": email})
+
+	if email != "" && !strings.EqualFold(email, current) {
+		sendEmailChangeMail(userID, email)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Profile updated successfully"})
 }
 
-// Delete user account
-func DeleteUserAccount(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("user_id")
+// Change own password. All sessions are revoked and the caller receives
+// a fresh token pair.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
 
-	_, err := db.Exec("DELETE FROM users WHERE id = ? AND role = 'user'", userID)
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var username, stored, email string
+	err := db.QueryRow("SELECT username, password, COALESCE(email, '') FROM users WHERE id = ?", principal.UserID).Scan(&username, &stored, &email)
 	if err != nil {
-		http.Error(w, "Delete error", http.StatusInternalServerError)
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	// Guessing the current password is throttled like a login
+	checks := loginChecks(r, username)
+	if throttle(w, r, checks...) {
+		return
+	}
+	if ok, _ := verifyPassword(stored, req.CurrentPassword); !ok {
+		recordLoginFailure(r, checks)
+		http.Error(w, "Current password is incorrect", http.StatusForbidden)
+		return
+	}
+
+	if err := passwordPolicy.Validate(req.NewPassword, username, email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := changePassword(tx, principal.UserID, req.NewPassword); err != nil {
+		log.Println("Password change error:", err)
+		http.Error(w, "Password change error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "password.change", principal.UserID, nil)
+	if email != "" {
+		sendMailAsync(passwordChangedMail(email, username))
+	}
+
+	tokens, err := createSession(principal.UserID, principal.Role)
+	if err != nil {
+		http.Error(w, "Token generation error", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Account deleted successfully"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"message":       "Password changed successfully",
+	})
 }
 
-// Admin: Get all users
-func GetAllUsers(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query(
-		"SELECT id, username, email, role, status, created_at, expires_at FROM users ORDER BY created_at DESC",
-	)
+// Delete user account
+func DeleteUserAccount(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	// Only customer accounts delete themselves
+	var exists int
+	err := db.QueryRow("SELECT 1 FROM users WHERE id = ? AND role = 'user'", userID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
 
-	var users []UserResponse
-	for rows.Next() {
-		var user UserResponse
-		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Status, &user.CreatedAt, &user.ExpiresAt); err != nil {
-			continue
-		}
-		users = append(users, user)
+	// Certificates outlive the account so they stay on the CRL
+	if err := revokeUserCertificates(userID); err != nil {
+		log.Println("Certificate revocation error:", err)
+		http.Error(w, "Certificate revocation error", http.StatusInternalServerError)
+		return
 	}
 
+	result, err := db.Exec("DELETE FROM users WHERE id = ? AND role = 'user'", userID)
+	if err != nil {
+		http.Error(w, "Delete error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	logPrincipalActivity(r, "account.delete", userID, nil)
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Account deleted successfully"})
+}
+
+// Admin: Get all users, paginated and filtered by the query string
+func GetAllUsers(w http.ResponseWriter, r *http.Request) {
+	writeUserList(w, r, 0)
 }
 
 // Admin: Get user by ID
@@ -133,29 +229,84 @@ func GetUserByID(w http.ResponseWriter, r *http.Request) {
 
 // Admin: Suspend user
 func SuspendUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID := vars["id"]
+	userID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
 
-	_, err := db.Exec("UPDATE users SET status = 'suspended' WHERE id = ?", userID)
+	var exists int
+	err = db.QueryRow("SELECT 1 FROM users WHERE id = ?", userID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	result, err := db.Exec("UPDATE users SET status = 'suspended', suspension_reason = 'admin' WHERE id = ?", userID)
 	if err != nil {
 		http.Error(w, "Update error", http.StatusInternalServerError)
 		return
 	}
 
+	if err := revokeUserSessions(userID); err != nil {
+		http.Error(w, "Session revocation error", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeUserCertificates(userID); err != nil {
+		log.Println("Certificate revocation error:", err)
+		http.Error(w, "Certificate revocation error", http.StatusInternalServerError)
+		return
+	}
+
+	// Suspending twice changes nothing and is logged once
+	if n, _ := result.RowsAffected(); n > 0 {
+		logPrincipalActivity(r, "user.suspend", userID, nil)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "User suspended successfully"})
 }
 
 // Admin: Activate user
 func ActivateUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID := vars["id"]
+	userID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
 
-	_, err := db.Exec("UPDATE users SET status = 'active' WHERE id = ?", userID)
+	var status string
+	err = db.QueryRow("SELECT status FROM users WHERE id = ?", userID).Scan(&status)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Only suspensions are lifted here; unverified accounts verify their
+	// email and expired or archived ones are renewed
+	if status != "suspended" {
+		http.Error(w, "Only suspended users can be activated", http.StatusConflict)
+		return
+	}
+	result, err := db.Exec("UPDATE users SET status = 'active', suspension_reason = NULL WHERE id = ? AND status = 'suspended'", userID)
 	if err != nil {
 		http.Error(w, "Update error", http.StatusInternalServerError)
 		return
 	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Only suspended users can be activated", http.StatusConflict)
+		return
+	}
+
+	logPrincipalActivity(r, "user.activate", userID, nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "User activated successfully"})
@@ -163,14 +314,42 @@ func ActivateUser(w http.ResponseWriter, r *http.Request) {
 
 // Admin: Delete user
 func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID := vars["id"]
+	userID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var username, role string
+	err = db.QueryRow("SELECT username, role FROM users WHERE id = ?", userID).Scan(&username, &role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Certificates outlive the account so they stay on the CRL
+	if err := revokeUserCertificates(userID); err != nil {
+		log.Println("Certificate revocation error:", err)
+		http.Error(w, "Certificate revocation error", http.StatusInternalServerError)
+		return
+	}
 
-	_, err := db.Exec("DELETE FROM users WHERE id = ?", userID)
+	// Sessions are removed by the foreign key cascade
+	result, err := db.Exec("DELETE FROM users WHERE id = ?", userID)
 	if err != nil {
 		http.Error(w, "Delete error", http.StatusInternalServerError)
 		return
 	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	logPrincipalActivity(r, "user.delete", userID, map[string]interface{}{"username": username, "role": role})
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "User deleted successfully"})
@@ -178,8 +357,8 @@ func AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
 
 // Reseller: Create user
 func ResellerCreateUser(w http.ResponseWriter, r *http.Request) {
-	resellerID := r.Header.Get("user_id")
-	role := r.Header.Get("user_role")
+	principal := currentPrincipal(r)
+	resellerID := principal.UserID
 
 	var req struct {
 		ExpiryDays int    `json:"expiry_days"` // 1, 3, 6, 12 months
@@ -191,38 +370,65 @@ func ResellerCreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Only admin can create users without reseller_id
-	if role == "reseller" {
-		// Reseller can only create limited users based on admin quota
-		// Check reseller quota first
-		var currentCount int
-		db.QueryRow("SELECT COUNT(*) FROM users WHERE reseller_id = ?", resellerID).Scan(&currentCount)
+	password, err := generatePassword("user")
+	if err != nil {
+		http.Error(w, "Credential generation error", http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Now().AddDate(0, req.ExpiryDays/30, req.ExpiryDays%30)
 
-		var quota int
-		db.QueryRow("SELECT user_quota FROM resellers WHERE user_id = ?", resellerID).Scan(&quota)
+	hash, err := hashPassword(password)
+	if err != nil {
+		http.Error(w, "Password hashing error", http.StatusInternalServerError)
+		return
+	}
 
-		if currentCount >= quota {
-			http.Error(w, "User quota exceeded", http.StatusForbidden)
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Only admin can create users without a quota. The reseller's quota row
+	// stays locked until commit so concurrent creates cannot overshoot it.
+	if principal.Role == "reseller" {
+		switch err := reserveResellerQuota(tx, resellerID, 1); err {
+		case nil:
+		case errNoResellerQuota, errQuotaExceeded:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 	}
 
-	username := generateRandomDigits(6)
-	password := generateRandomDigits(6)
-	expiresAt := time.Now().AddDate(0, req.ExpiryDays/30, req.ExpiryDays%30)
-
-	result, err := db.Exec(
-		"INSERT INTO users (username, password, role, email, status, expires_at, reseller_id) VALUES (?, ?, 'user', ?, 'active', ?, ?)",
-		username, hashPassword(password), req.Email, expiresAt, resellerID,
-	)
-
+	var result sql.Result
+	username, err := withGeneratedUsername("user", func(username string) error {
+		result, err = tx.Exec(
+			"INSERT INTO users (username, password, role, email, status, expires_at, reseller_id) VALUES (?, ?, 'user', ?, 'active', ?, ?)",
+			username, hash, req.Email, expiresAt, resellerID,
+		)
+		return err
+	})
 	if err != nil {
-		http.Error(w, "Creation error: "+err.Error(), http.StatusInternalServerError)
+		log.Println("Creation error:", err)
+		http.Error(w, "Creation error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Creation error", http.StatusInternalServerError)
 		return
 	}
 
 	userID, _ := result.LastInsertId()
 
+	logPrincipalActivity(r, "reseller.create_user", int(userID), map[string]interface{}{
+		"email": req.Email, "expires_at": expiresAt,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"user_id":    userID,
@@ -235,40 +441,24 @@ func ResellerCreateUser(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Reseller: Get own users
+// Reseller: Get own users, paginated and filtered by the query string
 func ResellerGetUsers(w http.ResponseWriter, r *http.Request) {
-	resellerID := r.Header.Get("user_id")
-
-	rows, err := db.Query(
-		"SELECT id, username, email, role, status, created_at, expires_at FROM users WHERE reseller_id = ? ORDER BY created_at DESC",
-		resellerID,
-	)
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var users []UserResponse
-	for rows.Next() {
-		var user UserResponse
-		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Status, &user.CreatedAt, &user.ExpiresAt); err != nil {
-			continue
-		}
-		users = append(users, user)
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(users)
+	writeUserList(w, r, currentPrincipal(r).UserID)
 }
 
 // Reseller: Get quota
 func ResellerGetQuota(w http.ResponseWriter, r *http.Request) {
-	resellerID := r.Header.Get("user_id")
+	resellerID := currentPrincipal(r).UserID
 
-	var quota, currentCount int
-	db.QueryRow("SELECT user_quota FROM resellers WHERE user_id = ?", resellerID).Scan(&quota)
-	db.QueryRow("SELECT COUNT(*) FROM users WHERE reseller_id = ?", resellerID).Scan(&currentCount)
+	quota, currentCount, err := resellerQuotaUsage(db, resellerID)
+	if err == errNoResellerQuota {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]int{
@@ -277,31 +467,3 @@ func ResellerGetQuota(w http.ResponseWriter, r *http.Request) {
 		"remaining":   quota - currentCount,
 	})
 }
-
-// Get VPN packages
-func GetPackages(w http.ResponseWriter, r *http.Request) {
-	packages := []Package{
-		{ID: 1, Name: "1 Month", Days: 30, Price: 2.99, Description: "1 month VPN access"},
-		{ID: 2, Name: "3 Months", Days: 90, Price: 7.99, Description: "3 months VPN access"},
-		{ID: 3, Name: "6 Months", Days: 180, Price: 14.99, Description: "6 months VPN access"},
-		{ID: 4, Name: "12 Months", Days: 365, Price: 27.99, Description: "12 months VPN access"},
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(packages)
-}
-
-// Cleanup expired users (call this periodically)
-func CleanupExpiredUsers() {
-	ticker := time.NewTicker(24 * time.Hour)
-	go func() {
-		for range ticker.C {
-			_, err := db.Exec("DELETE FROM users WHERE role = 'user' AND expires_at < NOW()")
-			if err != nil {
-				fmt.Println("Cleanup error:", err)
-			} else {
-				fmt.Println("Expired users cleaned up")
-			}
-		}
-	}()
-}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestDeleteMissingUser tests that deleting an account that does not exist
+// is a 404 and leaves no audit entry
+func TestDeleteMissingUser(t *testing.T) {
+	testDB := openTestDB(t)
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, 'x', 'reseller', 'active', '2099-12-31')",
+		"dm"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("User insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+
+	// Freeing the ID leaves it unused
+	testDB.Exec("DELETE FROM users WHERE id = ?", id)
+	missing := strconv.Itoa(int(id))
+	req := httptest.NewRequest("DELETE", "/api/admin/users/"+missing+"/delete", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": missing})
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 1, Role: "admin"}))
+	w := httptest.NewRecorder()
+	AdminDeleteUser(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Admin delete: expected status 404, got %d", w.Code)
+	}
+
+	var logged int
+	testDB.QueryRow("SELECT COUNT(*) FROM activity_logs WHERE action = 'user.delete' AND target_id = ?", id).Scan(&logged)
+	if logged != 0 {
+		t.Errorf("Expected no user.delete entry, got %d", logged)
+	}
+
+	// Staff accounts cannot use the self-service delete
+	result, err = testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, 'x', 'reseller', 'active', '2099-12-31')",
+		"ds"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("User insert failed: %v", err)
+	}
+	id, _ = result.LastInsertId()
+	t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+
+	req = httptest.NewRequest("DELETE", "/api/user/delete", nil)
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: int(id), Role: "reseller"}))
+	w = httptest.NewRecorder()
+	DeleteUserAccount(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Self delete: expected status 404, got %d", w.Code)
+	}
+
+	var remaining int
+	testDB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", id).Scan(&remaining)
+	testDB.QueryRow("SELECT COUNT(*) FROM activity_logs WHERE action = 'account.delete' AND target_id = ?", id).Scan(&logged)
+	if remaining != 1 || logged != 0 {
+		t.Errorf("Expected the staff account kept and unlogged, got %d rows and %d entries", remaining, logged)
+	}
+}
+
+// Call an admin user action on userID
+func callUserAdmin(h http.HandlerFunc, userID int) *httptest.ResponseRecorder {
+	id := strconv.Itoa(userID)
+	req := httptest.NewRequest("PUT", "/api/admin/users/"+id, nil)
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 1, Role: "admin"}))
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+// TestSuspendActivateAudit tests that suspending and activating are 404s
+// for missing accounts and only logged when they change something
+func TestSuspendActivateAudit(t *testing.T) {
+	testDB := openTestDB(t)
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, 'x', 'user', 'active', '2099-12-31')",
+		"sa"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("User insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	userID := int(id)
+	t.Cleanup(func() {
+		testDB.Exec("DELETE FROM users WHERE id = ?", userID)
+		testDB.Exec("DELETE FROM activity_logs WHERE target_id = ?", userID)
+	})
+
+	for i := 0; i < 2; i++ {
+		if w := callUserAdmin(SuspendUser, userID); w.Code != http.StatusOK {
+			t.Fatalf("Suspend failed: %d %s", w.Code, w.Body.String())
+		}
+	}
+	if w := callUserAdmin(ActivateUser, userID); w.Code != http.StatusOK {
+		t.Fatalf("Activate failed: %d %s", w.Code, w.Body.String())
+	}
+
+	if w := callUserAdmin(ActivateUser, userID); w.Code != http.StatusConflict {
+		t.Errorf("Expected activating an active user to conflict, got %d", w.Code)
+	}
+
+	var suspends, activates int
+	testDB.QueryRow("SELECT COUNT(*) FROM activity_logs WHERE action = 'user.suspend' AND target_id = ?", userID).Scan(&suspends)
+	testDB.QueryRow("SELECT COUNT(*) FROM activity_logs WHERE action = 'user.activate' AND target_id = ?", userID).Scan(&activates)
+	if suspends != 1 || activates != 1 {
+		t.Errorf("Expected one entry each, got %d suspends and %d activates", suspends, activates)
+	}
+
+	// Freeing the ID leaves it unused
+	testDB.Exec("DELETE FROM users WHERE id = ?", userID)
+	for name, h := range map[string]http.HandlerFunc{"suspend": SuspendUser, "activate": ActivateUser} {
+		if w := callUserAdmin(h, userID); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status 404, got %d", name, w.Code)
+		}
+	}
+	var total int
+	testDB.QueryRow("SELECT COUNT(*) FROM activity_logs WHERE action IN ('user.suspend', 'user.activate') AND target_id = ?", userID).Scan(&total)
+	if total != 2 {
+		t.Errorf("Expected no new entries for the missing account, got %d in total", total)
+	}
+}
+
+// TestActivateOnlyLiftsSuspensions tests that activation cannot skip email
+// verification or renewal
+func TestActivateOnlyLiftsSuspensions(t *testing.T) {
+	testDB := openTestDB(t)
+
+	for _, status := range []string{"pending_verification", "expired", "archived"} {
+		result, err := testDB.Exec(
+			"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, 'x', 'user', ?, '2000-01-01')",
+			"ac"+testSuffix(t), status,
+		)
+		if err != nil {
+			t.Fatalf("User insert failed: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+
+		if w := callUserAdmin(ActivateUser, int(id)); w.Code != http.StatusConflict {
+			t.Errorf("%s: expected status 409, got %d", status, w.Code)
+		}
+		var now string
+		testDB.QueryRow("SELECT status FROM users WHERE id = ?", id).Scan(&now)
+		if now != status {
+			t.Errorf("%s: status changed to %s", status, now)
+		}
+	}
+}
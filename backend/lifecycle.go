@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// LifecyclePolicy controls how lapsed customer accounts age:
+// active -> expired (renewal only) -> suspended after GraceDays ->
+// archived after a further ArchiveAfterDays -> purged after a further
+// PurgeAfterDays. A PurgeAfterDays of 0 keeps archived accounts forever.
+type LifecyclePolicy struct {
+	GraceDays        int
+	ArchiveAfterDays int
+	PurgeAfterDays   int
+	Schedule         string
+}
+
+var lifecyclePolicy = LifecyclePolicy{
+	GraceDays:        7,
+	ArchiveAfterDays: 30,
+	PurgeAfterDays:   0,
+	Schedule:         "@hourly",
+}
+
+func init() {
+	if days, err := strconv.Atoi(os.Getenv("GRACE_PERIOD_DAYS")); err == nil && days >= 0 {
+		lifecyclePolicy.GraceDays = days
+	}
+	if days, err := strconv.Atoi(os.Getenv("ARCHIVE_AFTER_DAYS")); err == nil && days >= 0 {
+		lifecyclePolicy.ArchiveAfterDays = days
+	}
+	if days, err := strconv.Atoi(os.Getenv("PURGE_AFTER_DAYS")); err == nil && days >= 0 {
+		lifecyclePolicy.PurgeAfterDays = days
+	}
+	if spec := os.Getenv("LIFECYCLE_SCHEDULE"); spec != "" {
+		lifecyclePolicy.Schedule = spec
+	}
+}
+
+type LifecycleResult struct {
+	Expired   int64 `json:"expired"`
+	Suspended int64 `json:"suspended"`
+	Archived  int64 `json:"archived"`
+	Revoked   int64 `json:"certificates_revoked"`
+	Purged    int64 `json:"purged"`
+}
+
+// Advance lapsed customer accounts through the lifecycle. Only accounts the
+// lifecycle itself moved are advanced, so admin suspensions are left alone.
+func runLifecycle(ctx context.Context, p LifecyclePolicy) (LifecycleResult, error) {
+	var res LifecycleResult
+
+	type step struct {
+		count *int64
+		query string
+		days  int
+	}
+	steps := []step{
+		{&res.Expired, "UPDATE users SET status = 'expired' WHERE role = 'user' AND status = 'active' AND expires_at < NOW() - INTERVAL ? DAY", 0},
+		{&res.Suspended, "UPDATE users SET status = 'suspended', suspension_reason = 'lapsed' WHERE role = 'user' AND status = 'expired' AND expires_at < NOW() - INTERVAL ? DAY", p.GraceDays},
+		{&res.Archived, "UPDATE users SET status = 'archived' WHERE role = 'user' AND status = 'suspended' AND suspension_reason = 'lapsed' AND expires_at < NOW() - INTERVAL ? DAY", p.GraceDays + p.ArchiveAfterDays},
+	}
+	for _, step := range steps {
+		result, err := db.ExecContext(ctx, step.query, step.days)
+		if err != nil {
+			return res, err
+		}
+		*step.count, _ = result.RowsAffected()
+	}
+
+	// Archived accounts lose their OpenVPN certificates, before any purge
+	// detaches them from the user
+	result, err := db.ExecContext(ctx,
+		`UPDATE client_certificates c JOIN users u ON u.id = c.user_id SET c.revoked_at = NOW()
+		WHERE c.revoked_at IS NULL AND u.role = 'user' AND u.status = 'archived'`)
+	if err != nil {
+		return res, err
+	}
+	if res.Revoked, _ = result.RowsAffected(); res.Revoked > 0 {
+		if err := publishCRL(ctx); err != nil {
+			return res, err
+		}
+	}
+
+	if p.PurgeAfterDays > 0 {
+		result, err := db.ExecContext(ctx,
+			"DELETE FROM users WHERE role = 'user' AND status = 'archived' AND expires_at < NOW() - INTERVAL ? DAY",
+			p.GraceDays+p.ArchiveAfterDays+p.PurgeAfterDays)
+		if err != nil {
+			return res, err
+		}
+		res.Purged, _ = result.RowsAffected()
+	}
+	return res, nil
+}
+
+// Scheduled job advancing the lifecycle
+func lifecycleJob(p LifecyclePolicy) Job {
+	return Job{
+		Name:    "account-lifecycle",
+		Spec:    p.Schedule,
+		Timeout: 10 * time.Minute,
+		Run: func(ctx context.Context) (string, error) {
+			res, err := runLifecycle(ctx, p)
+			return fmt.Sprintf("%d expired, %d suspended, %d archived, %d certificates revoked, %d purged",
+				res.Expired, res.Suspended, res.Archived, res.Revoked, res.Purged), err
+		},
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+// TestRunLifecycle tests that lapsed accounts advance expired -> suspended
+// ('lapsed') -> archived and that a zero purge window keeps them
+func TestRunLifecycle(t *testing.T) {
+	testDB := openTestDB(t)
+	suffix := testSuffix(t)
+
+	insert := func(name, status string, reason interface{}, lapsedDays int) int64 {
+		result, err := testDB.Exec(
+			`INSERT INTO users (username, password, role, status, suspension_reason, expires_at)
+			VALUES (?, 'x', 'user', ?, ?, NOW() - INTERVAL ? DAY)`,
+			name+suffix, status, reason, lapsedDays,
+		)
+		if err != nil {
+			t.Fatalf("User insert failed: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+		return id
+	}
+
+	expired := insert("lce", "active", nil, 3)
+	suspended := insert("lcs", "active", nil, 20)
+	archived := insert("lca", "active", nil, 50)
+	ancient := insert("lcx", "archived", nil, 5000)
+	byAdmin := insert("lcm", "suspended", "admin", 50)
+
+	result, err := testDB.Exec(
+		"INSERT INTO client_certificates (user_id, serial, cert_pem, key_enc, not_after) VALUES (?, ?, 'x', 'x', NOW() + INTERVAL 1 DAY)",
+		archived, "lc"+suffix,
+	)
+	if err != nil {
+		t.Fatalf("Certificate insert failed: %v", err)
+	}
+	certID, _ := result.LastInsertId()
+	t.Cleanup(func() { testDB.Exec("DELETE FROM client_certificates WHERE id = ?", certID) })
+
+	res, err := runLifecycle(context.Background(), LifecyclePolicy{GraceDays: 7, ArchiveAfterDays: 30})
+	if err != nil {
+		t.Fatalf("Lifecycle error: %v", err)
+	}
+	if res.Purged != 0 {
+		t.Errorf("Expected no purge, got %d", res.Purged)
+	}
+	if res.Revoked < 1 {
+		t.Errorf("Expected the archived account's certificate revoked, got %d", res.Revoked)
+	}
+
+	cases := []struct {
+		id     int64
+		status string
+		reason string
+	}{
+		{expired, "expired", ""},
+		{suspended, "suspended", "lapsed"},
+		{archived, "archived", "lapsed"},
+		{ancient, "archived", ""},
+		{byAdmin, "suspended", "admin"},
+	}
+	for _, c := range cases {
+		var status, reason string
+		err := testDB.QueryRow("SELECT status, COALESCE(suspension_reason, '') FROM users WHERE id = ?", c.id).Scan(&status, &reason)
+		if err != nil {
+			t.Errorf("User %d: %v", c.id, err)
+			continue
+		}
+		if status != c.status || reason != c.reason {
+			t.Errorf("User %d: expected %s/%q, got %s/%q", c.id, c.status, c.reason, status, reason)
+		}
+	}
+
+	var revoked bool
+	testDB.QueryRow("SELECT revoked_at IS NOT NULL FROM client_certificates WHERE id = ?", certID).Scan(&revoked)
+	if !revoked {
+		t.Error("Expected the archived account's certificate to be revoked")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Mail is a plain text message
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers mail. MAIL_DRIVER selects smtp, file or log.
+type Mailer interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+var (
+	mailer   Mailer = logMailer{}
+	mailFrom        = "VPN Management <no-reply@localhost>"
+	appURL          = "http://localhost:8080"
+)
+
+func init() {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		mailFrom = from
+	}
+	if url := os.Getenv("APP_URL"); url != "" {
+		appURL = strings.TrimRight(url, "/")
+	}
+
+	switch os.Getenv("MAIL_DRIVER") {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		mailer = smtpMailer{
+			addr:     net.JoinHostPort(os.Getenv("SMTP_HOST"), port),
+			host:     os.Getenv("SMTP_HOST"),
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+		}
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		mailer = fileMailer{dir: dir}
+	}
+}
+
+// Strip line breaks so header values cannot inject extra headers
+func headerValue(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// Render m as an RFC 5322 message
+func (m Mail) message(from string, date time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", headerValue(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerValue(m.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerValue(m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// smtpMailer sends through an SMTP relay, using STARTTLS when offered
+type smtpMailer struct {
+	addr, host         string
+	username, password string
+}
+
+func (s smtpMailer) Send(ctx context.Context, m Mail) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		auth = smtp.PlainAuth("", s.username, s.password, s.host)
+	}
+
+	// The envelope sender is the bare address inside any display name
+	from := mailFrom
+	if i := strings.LastIndex(from, "<"); i >= 0 {
+		from = strings.TrimSuffix(from[i+1:], ">")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.addr, auth, from, []string{headerValue(m.To)}, m.message(mailFrom, time.Now()))
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fileMailer writes each message to its own .eml file, for development
+// and tests
+type fileMailer struct {
+	dir string
+}
+
+func (f fileMailer) Send(ctx context.Context, m Mail) error {
+	if err := os.MkdirAll(f.dir, 0o700); err != nil {
+		return err
+	}
+	suffix, err := generateSecureToken(6)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), suffix)
+	return os.WriteFile(filepath.Join(f.dir, name), m.message(mailFrom, time.Now()), 0o600)
+}
+
+// logMailer only logs messages. It is the default so nothing is sent
+// until a driver is configured.
+type logMailer struct{}
+
+func (logMailer) Send(ctx context.Context, m Mail) error {
+	log.Printf("Mail to %s: %s\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// Send mail in the background so response times do not reveal whether
+// a message was sent
+func sendMailAsync(m Mail) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := mailer.Send(ctx, m); err != nil {
+			log.Println("Mail error:", err)
+		}
+	}()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMailMessageStripsHeaderInjection tests that header values cannot add headers
+func TestMailMessageStripsHeaderInjection(t *testing.T) {
+	m := Mail{To: "a@example.com\r\nBcc: evil@example.com", Subject: "Hi\nX-Injected: 1", Body: "line1\nline2"}
+	msg := string(m.message("from@example.com", time.Now()))
+
+	if strings.Contains(msg, "\r\nBcc:") || strings.Contains(msg, "\r\nX-Injected:") {
+		t.Errorf("Header injection not stripped:\n%s", msg)
+	}
+	if !strings.HasSuffix(msg, "\r\n\r\nline1\r\nline2") {
+		t.Errorf("Unexpected body encoding:\n%q", msg)
+	}
+}
+
+// TestFileMailer tests that messages are written to the mail directory
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := fileMailer{dir: filepath.Join(dir, "mail")}
+
+	if err := m.Send(context.Background(), Mail{To: "a@example.com", Subject: "Reset", Body: "token"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "mail", "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 message file, got %d", len(files))
+	}
+	content, _ := os.ReadFile(files[0])
+	if !strings.Contains(string(content), "Subject: Reset") {
+		t.Errorf("Unexpected message:\n%s", content)
+	}
+}
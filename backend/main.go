@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
@@ -40,8 +47,16 @@ func CORSMiddleware(next http.Handler) http.Handler {
 }
 
 func main() {
+	bootstrap := flag.Bool("bootstrap-admin", false, "create the first admin account on an empty database and exit")
+	adminEmail := flag.String("admin-email", "", "email for the bootstrapped admin account")
+	reissueOpenVPN := flag.Bool("reissue-openvpn-certs", false, "revoke OpenVPN certificates not signed by the current CA so they are reissued")
+	flag.Parse()
+
 	var err error
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s",
+	// parseTime makes the driver scan DATE, DATETIME and TIMESTAMP columns
+	// into time.Time, which every handler reading expires_at or created_at
+	// depends on
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true",
 		os.Getenv("DB_USER"),
 		os.Getenv("DB_PASS"),
 		os.Getenv("DB_HOST"),
@@ -61,29 +76,105 @@ func main() {
 
 	log.Println("Database connected successfully")
 
+	if *bootstrap {
+		account, err := bootstrapAdmin(*adminEmail)
+		if err != nil {
+			log.Fatal("Bootstrap error:", err)
+		}
+		printBootstrapAccount(account)
+		return
+	}
+
 	router := mux.NewRouter()
 
 	// Public routes
-	router.HandleFunc("/api/auth/register", RegisterHandler).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/auth/signup", PublicRegisterHandler).Methods("POST", "OPTIONS")
 	router.HandleFunc("/api/auth/login", LoginHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/refresh", RefreshHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/2fa", TwoFactorLoginHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/2fa/setup", TwoFactorLoginSetupHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/forgot", ForgotPasswordHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/reset", ResetPasswordHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/verify-email", VerifyEmailHandler).Methods("GET", "POST", "OPTIONS")
+	router.HandleFunc("/api/auth/verify-email/resend", ResendVerificationHandler).Methods("POST", "OPTIONS")
+	router.HandleFunc("/api/auth/redeem", RedeemVoucherHandler).Methods("POST", "OPTIONS")
+	router.Handle("/api/auth/logout", RenewalAuthMiddleware(http.HandlerFunc(LogoutHandler))).Methods("POST", "OPTIONS")
 
 	// Protected routes - use Handle for http.Handler
-	router.Handle("/api/user/profile", AuthMiddleware(http.HandlerFunc(GetUserProfile))).Methods("GET", "OPTIONS")
+	router.Handle("/api/user/profile", RenewalAuthMiddleware(http.HandlerFunc(GetUserProfile))).Methods("GET", "OPTIONS")
 	router.Handle("/api/user/update", AuthMiddleware(http.HandlerFunc(UpdateUserProfile))).Methods("PUT", "OPTIONS")
+	router.Handle("/api/user/password", AuthMiddleware(http.HandlerFunc(ChangePassword))).Methods("PUT", "OPTIONS")
+	router.Handle("/api/user/2fa", AuthMiddleware(ResellerOnly(GetTwoFactorStatus))).Methods("GET", "OPTIONS")
+	router.Handle("/api/user/2fa/setup", AuthMiddleware(ResellerOnly(BeginTwoFactorSetup))).Methods("POST", "OPTIONS")
+	router.Handle("/api/user/2fa/confirm", AuthMiddleware(ResellerOnly(ConfirmTwoFactorSetup))).Methods("POST", "OPTIONS")
+	router.Handle("/api/user/2fa/disable", AuthMiddleware(ResellerOnly(DisableTwoFactor))).Methods("POST", "OPTIONS")
+	router.Handle("/api/user/2fa/recovery-codes", AuthMiddleware(ResellerOnly(RegenerateRecoveryCodes))).Methods("POST", "OPTIONS")
 	router.Handle("/api/user/delete", AuthMiddleware(http.HandlerFunc(DeleteUserAccount))).Methods("DELETE", "OPTIONS")
+	router.Handle("/api/user/renew", RenewalAuthMiddleware(http.HandlerFunc(RenewAccount))).Methods("POST", "OPTIONS")
+	router.Handle("/api/user/renewals", RenewalAuthMiddleware(http.HandlerFunc(GetRenewalHistory))).Methods("GET", "OPTIONS")
+	router.Handle("/api/user/openvpn/profile", AuthMiddleware(http.HandlerFunc(GetOpenVPNProfile))).Methods("GET", "OPTIONS")
+	router.Handle("/api/user/devices", AuthMiddleware(http.HandlerFunc(GetDevices))).Methods("GET", "OPTIONS")
+	router.Handle("/api/user/devices", AuthMiddleware(http.HandlerFunc(CreateDevice))).Methods("POST", "OPTIONS")
+	router.Handle("/api/user/devices/{id}", AuthMiddleware(http.HandlerFunc(RenameDevice))).Methods("PUT", "OPTIONS")
+	router.Handle("/api/user/devices/{id}", AuthMiddleware(http.HandlerFunc(RevokeDevice))).Methods("DELETE", "OPTIONS")
+	router.Handle("/api/user/devices/{id}/config", AuthMiddleware(http.HandlerFunc(GetDeviceConfig))).Methods("GET", "OPTIONS")
+	router.Handle("/api/user/servers", AuthMiddleware(http.HandlerFunc(GetServers))).Methods("GET", "OPTIONS")
 
 	// Admin routes
+	router.Handle("/api/auth/register", AuthMiddleware(AdminOnly(RegisterHandler))).Methods("POST", "OPTIONS")
 	router.Handle("/api/admin/users", AuthMiddleware(AdminOnly(GetAllUsers))).Methods("GET", "OPTIONS")
 	router.Handle("/api/admin/users/{id}", AuthMiddleware(AdminOnly(GetUserByID))).Methods("GET", "OPTIONS")
 	router.Handle("/api/admin/users/{id}/suspend", AuthMiddleware(AdminOnly(SuspendUser))).Methods("PUT", "OPTIONS")
 	router.Handle("/api/admin/users/{id}/activate", AuthMiddleware(AdminOnly(ActivateUser))).Methods("PUT", "OPTIONS")
 	router.Handle("/api/admin/users/{id}/delete", AuthMiddleware(AdminOnly(AdminDeleteUser))).Methods("DELETE", "OPTIONS")
+	router.Handle("/api/admin/users/{id}/extend", AuthMiddleware(AdminOnly(AdminExtendUser))).Methods("POST", "OPTIONS")
+	router.Handle("/api/admin/users/{id}/renewals", AuthMiddleware(AdminOnly(AdminGetRenewalHistory))).Methods("GET", "OPTIONS")
+	router.Handle("/api/admin/users/{id}/max-devices", AuthMiddleware(AdminOnly(AdminSetUserDeviceLimit))).Methods("PUT", "OPTIONS")
+
+	// Admin reseller management
+	router.Handle("/api/admin/resellers", AuthMiddleware(AdminOnly(AdminListResellers))).Methods("GET", "OPTIONS")
+	router.Handle("/api/admin/resellers", AuthMiddleware(AdminOnly(AdminCreateReseller))).Methods("POST", "OPTIONS")
+	router.Handle("/api/admin/resellers/{id}", AuthMiddleware(AdminOnly(AdminGetReseller))).Methods("GET", "OPTIONS")
+	router.Handle("/api/admin/resellers/{id}", AuthMiddleware(AdminOnly(AdminDeleteReseller))).Methods("DELETE", "OPTIONS")
+	router.Handle("/api/admin/resellers/{id}/quota", AuthMiddleware(AdminOnly(AdminSetResellerQuota))).Methods("PUT", "OPTIONS")
+	router.Handle("/api/admin/resellers/{id}/quota/adjust", AuthMiddleware(AdminOnly(AdminAdjustResellerQuota))).Methods("POST", "OPTIONS")
+	router.Handle("/api/admin/resellers/{id}/quota/history", AuthMiddleware(AdminOnly(AdminResellerQuotaHistory))).Methods("GET", "OPTIONS")
+	router.Handle("/api/admin/resellers/{id}/transfer", AuthMiddleware(AdminOnly(AdminTransferResellerUsers))).Methods("POST", "OPTIONS")
+
+	router.Handle("/api/admin/users/{id}/2fa", AuthMiddleware(AdminOnly(AdminResetTwoFactor))).Methods("DELETE", "OPTIONS")
+	router.Handle("/api/admin/2fa-policy", AuthMiddleware(AdminOnly(AdminGetTwoFactorPolicy))).Methods("GET", "OPTIONS")
+	router.Handle("/api/admin/2fa-policy", AuthMiddleware(AdminOnly(AdminSetTwoFactorPolicy))).Methods("PUT", "OPTIONS")
+	router.Handle("/api/admin/activity", AuthMiddleware(AdminOnly(AdminGetActivity))).Methods("GET", "OPTIONS")
+	router.Handle("/api/admin/wireguard/peers", AuthMiddleware(AdminOnly(AdminGetWireGuardPeers))).Methods("GET", "OPTIONS")
+	router.Handle("/api/admin/nodes", AuthMiddleware(AdminOnly(AdminGetNodes))).Methods("GET", "OPTIONS")
+	router.Handle("/api/admin/nodes", AuthMiddleware(AdminOnly(AdminCreateNode))).Methods("POST", "OPTIONS")
+	router.Handle("/api/admin/nodes/{id}", AuthMiddleware(AdminOnly(AdminUpdateNode))).Methods("PUT", "OPTIONS")
+	router.Handle("/api/admin/nodes/{id}", AuthMiddleware(AdminOnly(AdminDeleteNode))).Methods("DELETE", "OPTIONS")
+	router.Handle("/api/admin/jobs", AuthMiddleware(AdminOnly(AdminListJobs))).Methods("GET", "OPTIONS")
+
+	// Admin package catalog
+	router.Handle("/api/admin/packages", AuthMiddleware(AdminOnly(AdminGetPackages))).Methods("GET", "OPTIONS")
+	router.Handle("/api/admin/packages", AuthMiddleware(AdminOnly(AdminCreatePackage))).Methods("POST", "OPTIONS")
+	router.Handle("/api/admin/packages/{id}", AuthMiddleware(AdminOnly(AdminUpdatePackage))).Methods("PUT", "OPTIONS")
+	router.Handle("/api/admin/packages/{id}/archive", AuthMiddleware(AdminOnly(AdminArchivePackage))).Methods("PUT", "OPTIONS")
 
 	// Reseller routes
 	router.Handle("/api/reseller/create-user", AuthMiddleware(ResellerOnly(ResellerCreateUser))).Methods("POST", "OPTIONS")
 	router.Handle("/api/reseller/users", AuthMiddleware(ResellerOnly(ResellerGetUsers))).Methods("GET", "OPTIONS")
+	router.Handle("/api/reseller/users/bulk", AuthMiddleware(ResellerOnly(ResellerBulkCreateUsers))).Methods("POST", "OPTIONS")
 	router.Handle("/api/reseller/quota", AuthMiddleware(ResellerOnly(ResellerGetQuota))).Methods("GET", "OPTIONS")
+	router.Handle("/api/reseller/users/{id}/extend", AuthMiddleware(ResellerOnly(ResellerExtendUser))).Methods("POST", "OPTIONS")
+	router.Handle("/api/reseller/users/{id}/suspend", AuthMiddleware(ResellerOnly(ResellerSuspendUser))).Methods("PUT", "OPTIONS")
+	router.Handle("/api/reseller/users/{id}/activate", AuthMiddleware(ResellerOnly(ResellerActivateUser))).Methods("PUT", "OPTIONS")
+	router.Handle("/api/reseller/users/{id}/reset-password", AuthMiddleware(ResellerOnly(ResellerResetUserPassword))).Methods("POST", "OPTIONS")
+	router.Handle("/api/reseller/users/{id}/delete", AuthMiddleware(ResellerOnly(ResellerDeleteUser))).Methods("DELETE", "OPTIONS")
+	router.Handle("/api/reseller/packages", AuthMiddleware(ResellerOnly(ResellerGetPackages))).Methods("GET", "OPTIONS")
+	router.Handle("/api/reseller/vouchers", AuthMiddleware(ResellerOnly(ResellerCreateVouchers))).Methods("POST", "OPTIONS")
+	router.Handle("/api/reseller/vouchers", AuthMiddleware(ResellerOnly(ResellerGetVoucherBatches))).Methods("GET", "OPTIONS")
+	router.Handle("/api/reseller/vouchers/{id}", AuthMiddleware(ResellerOnly(ResellerRevokeVoucherBatch))).Methods("DELETE", "OPTIONS")
+
+	// OpenVPN revocation list
+	router.HandleFunc("/api/openvpn/crl.pem", GetOpenVPNCRL).Methods("GET", "OPTIONS")
 
 	// Packages route
 	router.HandleFunc("/api/packages", GetPackages).Methods("GET", "OPTIONS")
@@ -99,6 +190,92 @@ func main() {
 		port = "8080"
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Rate limits are shared through MySQL unless RATE_LIMIT_STORE=memory
+	backgroundJobs := []Job{lifecycleJob(lifecyclePolicy), sessionCleanupJob(), passwordResetCleanupJob(), unverifiedCleanupJob()}
+	if os.Getenv("RATE_LIMIT_STORE") != "memory" {
+		rateLimiter.store = mysqlRateLimitStore{db}
+		backgroundJobs = append(backgroundJobs, rateLimitCleanupJob())
+	}
+
+	var jobs sync.WaitGroup
+
+	// The OpenVPN CA is created in OPENVPN_PKI_DIR on first start. Issued
+	// certificates must chain to it, or every stored profile is broken.
+	if openvpn.Remote != "" {
+		var err error
+		if openvpnPKI, err = loadSharedPKI(ctx, openvpn.PKIDir, openvpn.ServerName); err != nil {
+			log.Fatal("OpenVPN PKI error:", err)
+		}
+		foreign, err := foreignCertificates(ctx, openvpnPKI)
+		if err != nil {
+			log.Fatal("OpenVPN PKI error:", err)
+		}
+		if len(foreign) > 0 && !*reissueOpenVPN {
+			log.Fatalf("OpenVPN PKI error: %d issued certificates were not signed by the CA in %s. "+
+				"Restore the original PKI directory, or start once with -reissue-openvpn-certs to revoke them "+
+				"so users download new profiles.", len(foreign), openvpn.PKIDir)
+		}
+		if err := retireCertificates(foreign); err != nil {
+			log.Fatal("OpenVPN PKI error:", err)
+		}
+		if len(foreign) > 0 {
+			log.Printf("Revoked %d OpenVPN certificates from a previous CA", len(foreign))
+		}
+		if err := publishCRL(ctx); err != nil {
+			log.Println("CRL publish error:", err)
+		}
+		startCRLRefresh(ctx, &jobs)
+	}
+
+	jobScheduler = NewScheduler(mysqlJobStore{db}, mysqlJobLocker{db})
+	for _, job := range backgroundJobs {
+		if err := jobScheduler.Add(job); err != nil {
+			log.Fatal("Scheduler error:", err)
+		}
+	}
+
+	jobScheduler.Start(ctx, &jobs)
+
+	// VPN concentrators authenticate over RADIUS when RADIUS_SECRET is set
+	var radiusServers sync.WaitGroup
+	if radius.Secret != "" {
+		if len(radius.Clients) == 0 {
+			log.Fatal("RADIUS_CLIENTS must list the NAS addresses allowed to use RADIUS")
+		}
+		radiusServer := newRadiusServer(radius)
+		for _, addr := range []string{radius.AuthAddr, radius.AcctAddr} {
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				log.Fatal("RADIUS listen error:", err)
+			}
+			radiusServer.Start(ctx, conn, &radiusServers)
+		}
+		log.Printf("RADIUS listening on %s (auth) and %s (accounting)", radius.AuthAddr, radius.AcctAddr)
+	}
+
+	server := &http.Server{Addr: ":" + port, Handler: handler}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
 	log.Printf("Server running on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, handler))
+
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Shutdown error:", err)
+	}
+	jobs.Wait()
+	radiusServers.Wait()
 }
@@ -5,7 +5,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 // TestCORSMiddleware tests CORS headers
@@ -31,17 +35,23 @@ func TestCORSMiddleware(t *testing.T) {
 	}
 }
 
-// TestGenerateRandomDigits tests random generation
-func TestGenerateRandomDigits(t *testing.T) {
-	result := generateRandomDigits(6)
+// TestRandomString tests random generation
+func TestRandomString(t *testing.T) {
+	result, err := randomString("0123456789", 6)
+	if err != nil {
+		t.Fatalf("Generation failed: %v", err)
+	}
 	if len(result) != 6 {
 		t.Errorf("Expected length 6, got %d", len(result))
 	}
+	if strings.Trim(result, "0123456789") != "" {
+		t.Errorf("Expected only digits, got %s", result)
+	}
 }
 
 // TestGenerateToken tests JWT token generation
 func TestGenerateToken(t *testing.T) {
-	token, err := generateToken(1, "admin")
+	token, err := generateToken(1, "admin", "session")
 	if err != nil {
 		t.Errorf("Token generation failed: %v", err)
 	}
@@ -53,7 +63,7 @@ func TestGenerateToken(t *testing.T) {
 // TestVerifyToken tests JWT token verification
 func TestVerifyToken(t *testing.T) {
 	// Generate a token
-	token, _ := generateToken(1, "admin")
+	token, _ := generateToken(1, "admin", "session")
 
 	// Verify it
 	claims, err := verifyToken(token)
@@ -67,6 +77,47 @@ func TestVerifyToken(t *testing.T) {
 	if claims["role"] != "admin" {
 		t.Errorf("Expected role admin, got %v", claims["role"])
 	}
+	if claims["sid"] != "session" {
+		t.Errorf("Expected sid session, got %v", claims["sid"])
+	}
+	if claims["jti"] == "" || claims["jti"] == nil {
+		t.Error("Missing jti claim")
+	}
+}
+
+// TestVerifyTokenRejectsOtherAlgorithms tests that only HS256 tokens are accepted
+func TestVerifyTokenRejectsOtherAlgorithms(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS512, jwt.MapClaims{"user_id": 1, "role": "admin"})
+	tokenString, _ := token.SignedString(jwtSecret)
+
+	if _, err := verifyToken(tokenString); err == nil {
+		t.Error("Expected HS512 token to be rejected")
+	}
+}
+
+// TestAccountStatusError tests the shared login eligibility rules
+func TestAccountStatusError(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	if err := accountStatusError("user", "active", future); err != nil {
+		t.Errorf("Expected active user to pass, got %v", err)
+	}
+	if err := accountStatusError("user", "suspended", future); err != errAccountSuspended {
+		t.Errorf("Expected suspended error, got %v", err)
+	}
+	if err := accountStatusError("user", "active", past); err != errAccountExpired {
+		t.Errorf("Expected expired error, got %v", err)
+	}
+	if err := accountStatusError("admin", "active", past); err != nil {
+		t.Errorf("Expected admin expiry to be ignored, got %v", err)
+	}
+	if err := accountStatusError("user", "expired", future); err != errAccountExpired {
+		t.Errorf("Expected expired status to be reported, got %v", err)
+	}
+	if err := accountStatusError("user", "archived", future); err != errAccountArchived {
+		t.Errorf("Expected archived error, got %v", err)
+	}
 }
 
 // TestLoginRequestParsing tests if login requests are parsed correctly
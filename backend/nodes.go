@@ -0,0 +1,505 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Node is a VPN server users connect to. Devices are spread over the
+// nodes their package entitles them to; an empty PackageIDs list opens a
+// node to every package.
+type Node struct {
+	ID                 int       `json:"id"`
+	Name               string    `json:"name"`
+	Hostname           string    `json:"hostname"`
+	Region             string    `json:"region"`
+	WireGuardEndpoint  string    `json:"wireguard_endpoint"`   // host:port
+	WireGuardPublicKey string    `json:"wireguard_public_key"` // base64
+	OpenVPNRemote      string    `json:"openvpn_remote"`       // "host port"
+	Capacity           int       `json:"capacity"`             // devices the node takes
+	Health             string    `json:"health"`               // healthy, degraded or down
+	Enabled            bool      `json:"enabled"`
+	PackageIDs         []int     `json:"package_ids"`
+	Devices            int       `json:"devices"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+var (
+	errNodeNotFound    = errors.New("Server not found")
+	errNoNodeAvailable = errors.New("No VPN server is available")
+	errNodeNotEntitled = errors.New("Your package does not include this server")
+)
+
+var (
+	regionPattern    = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+	hostnamePattern  = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9.-]{0,251}[A-Za-z0-9])?$`)
+	nodeHealthStates = map[string]bool{"healthy": true, "degraded": true, "down": true}
+)
+
+const nodeSelect = `SELECT n.id, n.name, n.hostname, n.region, COALESCE(n.wireguard_endpoint, ''), COALESCE(n.wireguard_public_key, ''),
+	COALESCE(n.openvpn_remote, ''), n.capacity, n.health, n.enabled, n.created_at,
+	(SELECT COUNT(*) FROM devices d WHERE d.node_id = n.id) AS devices FROM nodes n`
+
+func scanNode(row interface{ Scan(...interface{}) error }) (Node, error) {
+	var n Node
+	err := row.Scan(&n.ID, &n.Name, &n.Hostname, &n.Region, &n.WireGuardEndpoint, &n.WireGuardPublicKey,
+		&n.OpenVPNRemote, &n.Capacity, &n.Health, &n.Enabled, &n.CreatedAt, &n.Devices)
+	return n, err
+}
+
+// Nodes a user may connect to: enabled, and open to every package or to
+// the user's. Staff accounts are entitled to every node.
+func entitledNodes(userID int) (string, []interface{}) {
+	return `n.enabled = TRUE AND (
+		NOT EXISTS (SELECT 1 FROM node_packages np WHERE np.node_id = n.id)
+		OR EXISTS (SELECT 1 FROM node_packages np JOIN users u ON u.package_id = np.package_id WHERE np.node_id = n.id AND u.id = ?)
+		OR EXISTS (SELECT 1 FROM users u WHERE u.id = ? AND u.role <> 'user'))`, []interface{}{userID, userID}
+}
+
+// Whether a node can take WireGuard peers
+func (n Node) servesWireGuard() bool {
+	return n.Enabled && n.Health != "down" && n.WireGuardEndpoint != "" && n.WireGuardPublicKey != ""
+}
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func isDuplicateNodeName(err error) bool {
+	var myErr *mysql.MySQLError
+	return errors.As(err, &myErr) && myErr.Number == 1062 && strings.Contains(myErr.Message, "name")
+}
+
+// Load the package IDs of each node in nodes
+func loadNodePackages(q queryer, nodes []Node) error {
+	if len(nodes) == 0 {
+		return nil
+	}
+	index := map[int]*Node{}
+	ids := make([]string, len(nodes))
+	for i := range nodes {
+		nodes[i].PackageIDs = []int{}
+		index[nodes[i].ID] = &nodes[i]
+		ids[i] = strconv.Itoa(nodes[i].ID)
+	}
+	rows, err := q.Query("SELECT node_id, package_id FROM node_packages WHERE node_id IN (" + strings.Join(ids, ",") + ") ORDER BY package_id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nodeID, packageID int
+		if err := rows.Scan(&nodeID, &packageID); err != nil {
+			return err
+		}
+		index[nodeID].PackageIDs = append(index[nodeID].PackageIDs, packageID)
+	}
+	return rows.Err()
+}
+
+func loadNode(q queryRower, id int) (Node, error) {
+	n, err := scanNode(q.QueryRow(nodeSelect+" WHERE n.id = ?", id))
+	if err == sql.ErrNoRows {
+		return Node{}, errNodeNotFound
+	}
+	return n, err
+}
+
+// Load a node the user is entitled to
+func loadEntitledNode(q queryRower, userID, nodeID int) (Node, error) {
+	where, args := entitledNodes(userID)
+	n, err := scanNode(q.QueryRow(nodeSelect+" WHERE n.id = ? AND "+where, append([]interface{}{nodeID}, args...)...))
+	if err == sql.ErrNoRows {
+		return Node{}, errNodeNotEntitled
+	}
+	return n, err
+}
+
+// Pick the least-loaded node the user may use for WireGuard, optionally
+// within a region. Healthy nodes go before degraded ones and full nodes
+// are skipped. The ranking reads the transaction's snapshot, which can
+// miss devices other assignments committed since, so the chosen node is
+// locked and its devices recounted with a locking read before it is
+// taken. Parallel assignments queue on the node lock and each sees the
+// devices placed before it.
+func pickNode(tx *sql.Tx, userID int, region string) (Node, error) {
+	where, args := entitledNodes(userID)
+
+	// Nodes the recount found full
+	var full []interface{}
+	for {
+		exclude := ""
+		if len(full) > 0 {
+			exclude = " AND n.id NOT IN (?" + strings.Repeat(", ?", len(full)-1) + ")"
+		}
+		queryArgs := append(append(append([]interface{}{}, args...), full...), region, region)
+
+		n, err := scanNode(tx.QueryRow(
+			nodeSelect+" WHERE "+where+exclude+` AND n.health <> 'down' AND n.wireguard_endpoint IS NOT NULL AND n.wireguard_public_key IS NOT NULL
+			AND (? = '' OR n.region = ?) AND (SELECT COUNT(*) FROM devices d WHERE d.node_id = n.id) < n.capacity
+			ORDER BY n.health = 'healthy' DESC, (SELECT COUNT(*) FROM devices d WHERE d.node_id = n.id) / n.capacity, n.id
+			LIMIT 1 FOR UPDATE`,
+			queryArgs...,
+		))
+		if err == sql.ErrNoRows {
+			return Node{}, errNoNodeAvailable
+		}
+		if err != nil {
+			return Node{}, err
+		}
+
+		if err := tx.QueryRow("SELECT COUNT(*) FROM devices WHERE node_id = ? FOR UPDATE", n.ID).Scan(&n.Devices); err != nil {
+			return Node{}, err
+		}
+		if n.Devices < n.Capacity {
+			return n, nil
+		}
+		full = append(full, n.ID)
+	}
+}
+
+// Resolve the node serving a device. The device keeps its node while it
+// stays usable and in the requested region; otherwise it moves to the
+// least-loaded one. A zero Node means no nodes are registered and the
+// WG_* server settings apply.
+func deviceNode(userID, deviceID int, region string) (Node, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Node{}, err
+	}
+	defer tx.Rollback()
+
+	var current sql.NullInt64
+	err = tx.QueryRow("SELECT node_id FROM devices WHERE id = ? AND user_id = ? FOR UPDATE", deviceID, userID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return Node{}, errDeviceNotFound
+	}
+	if err != nil {
+		return Node{}, err
+	}
+
+	if current.Valid {
+		n, err := loadEntitledNode(tx, userID, int(current.Int64))
+		if err == nil && n.servesWireGuard() && (region == "" || n.Region == region) {
+			return n, nil
+		}
+		if err != nil && err != errNodeNotEntitled {
+			return Node{}, err
+		}
+	}
+
+	var registered bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM nodes)").Scan(&registered); err != nil {
+		return Node{}, err
+	}
+	if !registered {
+		return Node{}, nil
+	}
+
+	n, err := pickNode(tx, userID, region)
+	if err != nil {
+		return Node{}, err
+	}
+	if _, err := tx.Exec("UPDATE devices SET node_id = ? WHERE id = ?", n.ID, deviceID); err != nil {
+		return Node{}, err
+	}
+	n.Devices++
+	return n, tx.Commit()
+}
+
+// ServerListing is a node as shown to users
+type ServerListing struct {
+	ID        int      `json:"id"`
+	Name      string   `json:"name"`
+	Hostname  string   `json:"hostname"`
+	Region    string   `json:"region"`
+	Health    string   `json:"health"`
+	Protocols []string `json:"protocols"`
+	Load      int      `json:"load"` // percent of capacity
+}
+
+// User: List the servers the caller's package includes
+func GetServers(w http.ResponseWriter, r *http.Request) {
+	where, args := entitledNodes(currentPrincipal(r).UserID)
+	if region := r.URL.Query().Get("region"); region != "" {
+		where, args = where+" AND n.region = ?", append(args, region)
+	}
+
+	rows, err := db.Query(nodeSelect+" WHERE "+where+" ORDER BY n.region, n.name", args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	servers := []ServerListing{}
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		s := ServerListing{ID: n.ID, Name: n.Name, Hostname: n.Hostname, Region: n.Region, Health: n.Health, Protocols: []string{}}
+		if n.WireGuardEndpoint != "" {
+			s.Protocols = append(s.Protocols, "wireguard")
+		}
+		if n.OpenVPNRemote != "" {
+			s.Protocols = append(s.Protocols, "openvpn")
+		}
+		if n.Capacity > 0 {
+			s.Load = min(100, n.Devices*100/n.Capacity)
+		}
+		servers = append(servers, s)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers)
+}
+
+func validateNode(n Node) error {
+	switch {
+	case n.Name == "":
+		return errors.New("Name is required")
+	case !hostnamePattern.MatchString(n.Hostname):
+		return errors.New("A valid hostname is required")
+	case !regionPattern.MatchString(n.Region):
+		return errors.New("Region must be 1-32 lowercase letters, digits or dashes")
+	case n.WireGuardEndpoint == "" && n.OpenVPNRemote == "":
+		return errors.New("At least one protocol endpoint is required")
+	case (n.WireGuardEndpoint == "") != (n.WireGuardPublicKey == ""):
+		return errors.New("WireGuard needs both an endpoint and a public key")
+	case n.Capacity < 1:
+		return errors.New("Capacity must be at least 1")
+	case !nodeHealthStates[n.Health]:
+		return errors.New("Health must be healthy, degraded or down")
+	}
+	if n.WireGuardEndpoint != "" {
+		if _, port, err := net.SplitHostPort(n.WireGuardEndpoint); err != nil || port == "" {
+			return errors.New("WireGuard endpoint must be host:port")
+		}
+		if key, err := base64.StdEncoding.DecodeString(n.WireGuardPublicKey); err != nil || len(key) != 32 {
+			return errors.New("WireGuard public key must be a base64 Curve25519 key")
+		}
+	}
+	if n.OpenVPNRemote != "" && len(strings.Fields(n.OpenVPNRemote)) > 3 {
+		return errors.New(`OpenVPN remote must be "host [port] [proto]"`)
+	}
+	return nil
+}
+
+// Decode a node body, applying defaults for omitted fields
+func decodeNode(r *http.Request) (Node, error) {
+	n := Node{Capacity: 250, Health: "healthy", Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		return Node{}, errors.New("Invalid request")
+	}
+	n.Name = strings.TrimSpace(n.Name)
+	n.Region = strings.ToLower(strings.TrimSpace(n.Region))
+	return n, validateNode(n)
+}
+
+// Replace a node's package entitlements
+func setNodePackages(tx *sql.Tx, nodeID int, packageIDs []int) error {
+	if _, err := tx.Exec("DELETE FROM node_packages WHERE node_id = ?", nodeID); err != nil {
+		return err
+	}
+	for _, id := range packageIDs {
+		if _, err := loadPackage(tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT IGNORE INTO node_packages (node_id, package_id) VALUES (?, ?)", nodeID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func nullIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Admin: List all nodes with their load and entitlements
+func AdminGetNodes(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(nodeSelect + " ORDER BY n.region, n.name")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	nodes := []Node{}
+	for rows.Next() {
+		n, err := scanNode(rows)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		nodes = append(nodes, n)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := loadNodePackages(db, nodes); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodes)
+}
+
+// Create or update a node and its entitlements in one transaction
+func saveNode(w http.ResponseWriter, r *http.Request, id int) {
+	n, err := decodeNode(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	args := []interface{}{n.Name, n.Hostname, n.Region, nullIfEmpty(n.WireGuardEndpoint), nullIfEmpty(n.WireGuardPublicKey),
+		nullIfEmpty(n.OpenVPNRemote), n.Capacity, n.Health, n.Enabled}
+	if id == 0 {
+		result, err := tx.Exec(
+			`INSERT INTO nodes (name, hostname, region, wireguard_endpoint, wireguard_public_key, openvpn_remote, capacity, health, enabled)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			args...,
+		)
+		if isDuplicateNodeName(err) {
+			http.Error(w, "A server with this name already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Creation error", http.StatusInternalServerError)
+			return
+		}
+		newID, _ := result.LastInsertId()
+		id = int(newID)
+	} else {
+		if _, err := loadNode(tx, id); err == errNodeNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		_, err := tx.Exec(
+			`UPDATE nodes SET name = ?, hostname = ?, region = ?, wireguard_endpoint = ?, wireguard_public_key = ?, openvpn_remote = ?,
+			capacity = ?, health = ?, enabled = ? WHERE id = ?`,
+			append(args, id)...,
+		)
+		if isDuplicateNodeName(err) {
+			http.Error(w, "A server with this name already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Update error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = setNodePackages(tx, id, n.PackageIDs)
+	if err == errPackageNotFound {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+
+	saved, err := loadNode(tx, id)
+	if err == nil {
+		nodes := []Node{saved}
+		err = loadNodePackages(tx, nodes)
+		saved = nodes[0]
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+
+	action := "node.update"
+	if r.Method == http.MethodPost {
+		action = "node.create"
+	}
+	logPrincipalActivity(r, action, 0, map[string]interface{}{
+		"node_id": saved.ID, "name": saved.Name, "region": saved.Region, "health": saved.Health, "enabled": saved.Enabled,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(saved)
+}
+
+// Admin: Register a node
+func AdminCreateNode(w http.ResponseWriter, r *http.Request) {
+	saveNode(w, r, 0)
+}
+
+// Admin: Update a node, including its health and entitlements
+func AdminUpdateNode(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+	saveNode(w, r, id)
+}
+
+// Admin: Remove a node. Its devices are moved to another node the next
+// time their config is fetched.
+func AdminDeleteNode(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid server ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM nodes WHERE id = ?", id)
+	if err != nil {
+		log.Println("Node delete error:", err)
+		http.Error(w, "Delete error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, errNodeNotFound.Error(), http.StatusNotFound)
+		return
+	}
+
+	logPrincipalActivity(r, "node.delete", 0, map[string]interface{}{"node_id": id})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Server deleted successfully"})
+}
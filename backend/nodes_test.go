@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// TestValidateNode tests the required fields and endpoint formats
+func TestValidateNode(t *testing.T) {
+	key := "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+	valid := Node{Name: "fra-1", Hostname: "fra-1.example.com", Region: "eu-central", WireGuardEndpoint: "fra-1.example.com:51820",
+		WireGuardPublicKey: key, Capacity: 100, Health: "healthy"}
+	if err := validateNode(valid); err != nil {
+		t.Errorf("Expected a valid node, got %v", err)
+	}
+	openvpnOnly := Node{Name: "nyc-1", Hostname: "nyc-1.example.com", Region: "us-east", OpenVPNRemote: "nyc-1.example.com 1194 udp",
+		Capacity: 100, Health: "degraded"}
+	if err := validateNode(openvpnOnly); err != nil {
+		t.Errorf("Expected an OpenVPN-only node to be valid, got %v", err)
+	}
+
+	for name, mutate := range map[string]func(*Node){
+		"missing name":     func(n *Node) { n.Name = "" },
+		"bad hostname":     func(n *Node) { n.Hostname = "-bad host" },
+		"bad region":       func(n *Node) { n.Region = "EU Central" },
+		"no endpoints":     func(n *Node) { n.WireGuardEndpoint, n.WireGuardPublicKey = "", "" },
+		"missing key":      func(n *Node) { n.WireGuardPublicKey = "" },
+		"short key":        func(n *Node) { n.WireGuardPublicKey = "c2hvcnQ=" },
+		"endpoint no port": func(n *Node) { n.WireGuardEndpoint = "fra-1.example.com" },
+		"zero capacity":    func(n *Node) { n.Capacity = 0 },
+		"unknown health":   func(n *Node) { n.Health = "sleepy" },
+	} {
+		n := valid
+		mutate(&n)
+		if err := validateNode(n); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
+
+// TestNodeAssignment tests package entitlements, least-loaded assignment
+// and moving devices off a node that goes down
+func TestNodeAssignment(t *testing.T) {
+	testDB := openTestDB(t)
+
+	var packageID, otherPackageID int
+	if err := testDB.QueryRow("SELECT id FROM packages ORDER BY id LIMIT 1").Scan(&packageID); err != nil {
+		t.Skip("No package available")
+	}
+	if err := testDB.QueryRow("SELECT id FROM packages WHERE id <> ? LIMIT 1", packageID).Scan(&otherPackageID); err != nil {
+		t.Skip("A second package is needed")
+	}
+
+	suffix := testSuffix(t)
+	region := "t" + suffix
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at, package_id, max_devices) VALUES (?, 'x', 'user', 'active', '2099-12-31', ?, 10)",
+		"na"+suffix, packageID,
+	)
+	if err != nil {
+		t.Fatalf("User insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	userID := int(id)
+	t.Cleanup(func() {
+		testDB.Exec("DELETE FROM users WHERE id = ?", userID)
+		testDB.Exec("DELETE FROM nodes WHERE region = ?", region)
+	})
+
+	admin := Principal{UserID: userID, Role: "admin"}
+	createNode := func(name string, packageIDs []int) Node {
+		body, _ := json.Marshal(map[string]interface{}{
+			"name": name + "-" + suffix, "hostname": name + ".example.com", "region": region,
+			"wireguard_endpoint": name + ".example.com:51820", "wireguard_public_key": "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=",
+			"capacity": 2, "package_ids": packageIDs,
+		})
+		req := httptest.NewRequest("POST", "/api/admin/nodes", bytes.NewReader(body))
+		req = req.WithContext(withPrincipal(req.Context(), admin))
+		w := httptest.NewRecorder()
+		AdminCreateNode(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var n Node
+		json.Unmarshal(w.Body.Bytes(), &n)
+		return n
+	}
+	a := createNode("a", nil)
+	createNode("b", []int{otherPackageID})
+	c := createNode("c", []int{packageID})
+
+	// Only the nodes the user's package includes are listed
+	req := httptest.NewRequest("GET", "/api/user/servers?region="+region, nil)
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: userID, Role: "user"}))
+	w := httptest.NewRecorder()
+	GetServers(w, req)
+	var servers []ServerListing
+	json.Unmarshal(w.Body.Bytes(), &servers)
+	if len(servers) != 2 || servers[0].ID != a.ID || servers[1].ID != c.ID {
+		t.Fatalf("Expected nodes a and c, got %+v", servers)
+	}
+
+	var devices []int
+	for i := 0; i < 3; i++ {
+		tx, err := testDB.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := allocateDevice(tx, userID, "device")
+		if err != nil {
+			tx.Rollback()
+			t.Fatalf("Device allocation failed: %v", err)
+		}
+		tx.Commit()
+		devices = append(devices, d.ID)
+	}
+
+	// Devices alternate between the two entitled nodes, never b
+	for i, want := range []int{a.ID, c.ID, a.ID} {
+		n, err := deviceNode(userID, devices[i], region)
+		if err != nil || n.ID != want {
+			t.Errorf("Device %d: expected node %d, got %d (%v)", i, want, n.ID, err)
+		}
+	}
+	if n, _ := deviceNode(userID, devices[0], region); n.ID != a.ID {
+		t.Errorf("Expected the assignment to stick, got node %d", n.ID)
+	}
+
+	// When a goes down its devices move to c until c is full
+	testDB.Exec("UPDATE nodes SET health = 'down' WHERE id = ?", a.ID)
+	if n, err := deviceNode(userID, devices[0], region); err != nil || n.ID != c.ID {
+		t.Errorf("Expected a move to node c, got %d (%v)", n.ID, err)
+	}
+	if _, err := deviceNode(userID, devices[2], region); err != errNoNodeAvailable {
+		t.Errorf("Expected no node with capacity left, got %v", err)
+	}
+}
+
+// TestNodeAssignmentConcurrency tests that parallel assignments never fill
+// a node past its capacity
+func TestNodeAssignmentConcurrency(t *testing.T) {
+	testDB := openTestDB(t)
+
+	suffix := testSuffix(t)
+	region := "p" + suffix
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at, max_devices) VALUES (?, 'x', 'user', 'active', '2099-12-31', 20)",
+		"nc"+suffix,
+	)
+	if err != nil {
+		t.Fatalf("User insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	userID := int(id)
+	t.Cleanup(func() {
+		testDB.Exec("DELETE FROM users WHERE id = ?", userID)
+		testDB.Exec("DELETE FROM nodes WHERE region = ?", region)
+	})
+
+	const capacity = 3
+	result, err = testDB.Exec(
+		`INSERT INTO nodes (name, hostname, region, wireguard_endpoint, wireguard_public_key, capacity)
+		VALUES (?, 'p.example.com', ?, 'p.example.com:51820', 'yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=', ?)`,
+		"p-"+suffix, region, capacity,
+	)
+	if err != nil {
+		t.Fatalf("Node insert failed: %v", err)
+	}
+	nodeID, _ := result.LastInsertId()
+
+	var devices []int
+	for i := 0; i < 10; i++ {
+		tx, err := testDB.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := allocateDevice(tx, userID, "device")
+		if err != nil {
+			tx.Rollback()
+			t.Fatalf("Device allocation failed: %v", err)
+		}
+		tx.Commit()
+		devices = append(devices, d.ID)
+	}
+
+	var wg sync.WaitGroup
+	for _, deviceID := range devices {
+		wg.Add(1)
+		go func(deviceID int) {
+			defer wg.Done()
+			if _, err := deviceNode(userID, deviceID, region); err != nil && err != errNoNodeAvailable {
+				t.Errorf("Device %d: %v", deviceID, err)
+			}
+		}(deviceID)
+	}
+	wg.Wait()
+
+	var assigned int
+	testDB.QueryRow("SELECT COUNT(*) FROM devices WHERE node_id = ?", nodeID).Scan(&assigned)
+	if assigned != capacity {
+		t.Errorf("Expected %d devices on the node, got %d", capacity, assigned)
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenVPNConfig describes the server that rendered profiles connect to.
+// OpenVPN profiles are only offered when Remote is set.
+type OpenVPNConfig struct {
+	Remote       string // "host port"
+	Proto        string
+	PKIDir       string
+	ServerName   string
+	TLSCryptKey  string // path to a tls-crypt key shared with the server
+	AuthUserPass bool
+}
+
+var openvpn = OpenVPNConfig{
+	Proto:        "udp",
+	PKIDir:       "./pki",
+	ServerName:   "server",
+	AuthUserPass: true,
+}
+
+// The loaded CA, or nil when OpenVPN is not configured
+var openvpnPKI *PKI
+
+func init() {
+	openvpn.Remote = os.Getenv("OPENVPN_REMOTE")
+	if v := os.Getenv("OPENVPN_PROTO"); v != "" {
+		openvpn.Proto = v
+	}
+	if v := os.Getenv("OPENVPN_PKI_DIR"); v != "" {
+		openvpn.PKIDir = v
+	}
+	if v := os.Getenv("OPENVPN_SERVER_NAME"); v != "" {
+		openvpn.ServerName = v
+	}
+	openvpn.TLSCryptKey = os.Getenv("OPENVPN_TLS_CRYPT_KEY")
+	openvpn.AuthUserPass = os.Getenv("OPENVPN_AUTH_USER_PASS") != "false"
+}
+
+var errOpenVPNUnavailable = errors.New("OpenVPN is not configured on this server")
+
+const (
+	caValidity         = 10 * 365 * 24 * time.Hour
+	serverCertValidity = 5 * 365 * 24 * time.Hour
+	crlValidity        = 7 * 24 * time.Hour
+
+	// Every replica re-signs crl.pem this often, well inside crlValidity
+	crlRefreshInterval = 24 * time.Hour
+
+	// Staff accounts have no expiry; their certificates are reissued yearly
+	defaultClientCertValidity = 365 * 24 * time.Hour
+)
+
+// PKI is the internal certificate authority for OpenVPN clients
+type PKI struct {
+	dir     string
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+
+	crlMu sync.Mutex
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeKeyPEM(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// Write a file through a temporary name so readers never see it partial.
+// The name is unique so replicas sharing the directory cannot interleave.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Load the PKI holding a MySQL lock, so replicas sharing OPENVPN_PKI_DIR
+// cannot each create a CA on first start
+func loadSharedPKI(ctx context.Context, dir, serverName string) (*PKI, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	const key = "vpn-management:openvpn-pki"
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", key).Scan(&acquired); err != nil {
+		return nil, err
+	}
+	if acquired.Int64 != 1 {
+		return nil, errors.New("Timed out waiting for another replica to set up the PKI")
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", key)
+
+	return loadPKI(dir, serverName)
+}
+
+// Load the CA from dir, creating it and a server certificate on first run
+func loadPKI(dir, serverName string) (*PKI, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	certPath, keyPath := filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+
+	if _, err := os.Stat(keyPath); os.IsNotExist(err) {
+		if err := createCA(certPath, keyPath); err != nil {
+			return nil, err
+		}
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, errors.New("Malformed CA files in " + dir)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("CA key must be ECDSA")
+	}
+
+	p := &PKI{dir: dir, cert: cert, key: key, certPEM: certPEM}
+
+	serverCert := filepath.Join(dir, "server.crt")
+	if _, err := os.Stat(serverCert); os.IsNotExist(err) {
+		certPEM, keyPEM, _, err := p.issue(serverName, time.Now().Add(serverCertValidity), x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "server.key"), keyPEM, 0o600); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(serverCert, certPEM, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func createCA(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "VPN Management CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+}
+
+// Issue a certificate and fresh key for commonName
+func (p *PKI) issue(commonName string, notAfter time.Time, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte, serial *big.Int, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if serial, err = randomSerial(); err != nil {
+		return nil, nil, nil, err
+	}
+	if notAfter.After(p.cert.NotAfter) {
+		notAfter = p.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if keyPEM, err = encodeKeyPEM(key); err != nil {
+		return nil, nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), keyPEM, serial, nil
+}
+
+// Sign a CRL listing the given revocations
+func (p *PKI) signCRL(entries []x509.RevocationListEntry, now time.Time) ([]byte, error) {
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(now.UnixNano()),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		RevokedCertificateEntries: entries,
+	}, p.cert, p.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
+
+// Build the CRL from every revoked certificate that has not yet expired
+func buildCRL(ctx context.Context, p *PKI) ([]byte, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT serial, revoked_at FROM client_certificates WHERE revoked_at IS NOT NULL AND not_after > NOW()")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []x509.RevocationListEntry
+	for rows.Next() {
+		var serialHex string
+		var revokedAt time.Time
+		if err := rows.Scan(&serialHex, &revokedAt); err != nil {
+			return nil, err
+		}
+		serial, ok := new(big.Int).SetString(serialHex, 16)
+		if !ok {
+			return nil, fmt.Errorf("Malformed certificate serial %q", serialHex)
+		}
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: revokedAt})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return p.signCRL(entries, time.Now())
+}
+
+// Write a fresh CRL to crl.pem for the OpenVPN server's crl-verify
+func publishCRL(ctx context.Context) error {
+	if openvpnPKI == nil {
+		return nil
+	}
+	openvpnPKI.crlMu.Lock()
+	defer openvpnPKI.crlMu.Unlock()
+
+	crl, err := buildCRL(ctx, openvpnPKI)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(openvpnPKI.dir, "crl.pem"), crl, 0o644)
+}
+
+// Revoke a user's certificates and republish the CRL. Called when an
+// account is suspended or deleted.
+func revokeUserCertificates(userID int) error {
+	if openvpnPKI == nil {
+		return nil
+	}
+	result, err := db.Exec(
+		"UPDATE client_certificates SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL", userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	return publishCRL(context.Background())
+}
+
+// Re-sign crl.pem before it goes stale. This runs on every replica rather
+// than as a leader-locked job, since each may serve its own copy.
+func startCRLRefresh(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(crlRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := publishCRL(ctx); err != nil {
+					log.Println("CRL publish error:", err)
+				}
+			}
+		}
+	}()
+}
+
+// IDs of live certificates the loaded CA did not sign. They appear when the
+// PKI directory was lost or replicas did not share it, and every profile
+// holding one fails to connect.
+func foreignCertificates(ctx context.Context, p *PKI) ([]int, error) {
+	rows, err := db.QueryContext(ctx,
+		"SELECT id, cert_pem FROM client_certificates WHERE revoked_at IS NULL AND not_after > NOW()")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		var certPEM string
+		if err := rows.Scan(&id, &certPEM); err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			ids = append(ids, id)
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || cert.CheckSignatureFrom(p.cert) != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// Revoke certificates from a previous CA so clientCertificate issues
+// replacements from the current one on the next profile download
+func retireCertificates(ids []int) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := db.Exec(
+		"UPDATE client_certificates SET revoked_at = NOW() WHERE revoked_at IS NULL AND id IN (?"+strings.Repeat(", ?", len(ids)-1)+")",
+		args...,
+	)
+	return err
+}
+
+// Return the user's current certificate and key, issuing a new pair when
+// there is none or the account's expiry has moved since it was issued
+func clientCertificate(userID int) (certPEM, keyPEM []byte, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var username string
+	var expiresAt sql.NullTime
+	if err := tx.QueryRow("SELECT username, expires_at FROM users WHERE id = ? FOR UPDATE", userID).Scan(&username, &expiresAt); err != nil {
+		return nil, nil, err
+	}
+	notAfter := time.Now().Add(defaultClientCertValidity)
+	if expiresAt.Valid {
+		notAfter = expiresAt.Time
+	}
+	if notAfter.After(openvpnPKI.cert.NotAfter) {
+		notAfter = openvpnPKI.cert.NotAfter
+	}
+
+	var current struct {
+		cert     string
+		keySeal  string
+		notAfter time.Time
+	}
+	err = tx.QueryRow(
+		"SELECT cert_pem, key_enc, not_after FROM client_certificates WHERE user_id = ? AND revoked_at IS NULL ORDER BY id DESC LIMIT 1",
+		userID,
+	).Scan(&current.cert, &current.keySeal, &current.notAfter)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, nil, err
+	// Staff certificates are kept until their last month
+	case current.notAfter.Unix() == notAfter.Unix() || (!expiresAt.Valid && current.notAfter.After(time.Now().Add(30*24*time.Hour))):
+		key, err := openDeviceKey(current.keySeal)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []byte(current.cert), []byte(key), nil
+	}
+
+	certPEM, keyPEM, serial, err := openvpnPKI.issue(username, notAfter, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealed, err := sealDeviceKey(string(keyPEM))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The superseded certificate is revoked so only one stays valid
+	superseded, err := tx.Exec("UPDATE client_certificates SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL", userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO client_certificates (user_id, serial, cert_pem, key_enc, not_after) VALUES (?, ?, ?, ?, ?)",
+		userID, hex.EncodeToString(serial.Bytes()), string(certPEM), sealed, notAfter,
+	); err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	if n, _ := superseded.RowsAffected(); n > 0 {
+		if err := publishCRL(context.Background()); err != nil {
+			log.Println("CRL publish error:", err)
+		}
+	}
+	return certPEM, keyPEM, nil
+}
+
+// Render an .ovpn profile with the CA, certificate and key inline
+func renderOpenVPNProfile(c OpenVPNConfig, caPEM, certPEM, keyPEM, tlsCrypt []byte) string {
+	var b strings.Builder
+	b.WriteString("client\ndev tun\n")
+	fmt.Fprintf(&b, "proto %s\n", c.Proto)
+	fmt.Fprintf(&b, "remote %s\n", c.Remote)
+	b.WriteString("resolv-retry infinite\nnobind\npersist-key\npersist-tun\n")
+	fmt.Fprintf(&b, "remote-cert-tls server\nverify-x509-name %s name\n", c.ServerName)
+	if c.AuthUserPass {
+		b.WriteString("auth-user-pass\n")
+	}
+	b.WriteString("verb 3\n")
+
+	inline := func(tag string, data []byte) {
+		fmt.Fprintf(&b, "<%s>\n%s", tag, data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "</%s>\n", tag)
+	}
+	inline("ca", caPEM)
+	inline("cert", certPEM)
+	inline("key", keyPEM)
+	if len(tlsCrypt) > 0 {
+		inline("tls-crypt", tlsCrypt)
+	}
+	return b.String()
+}
+
+// User: Download an OpenVPN profile. The embedded certificate expires
+// with the account and is replaced after a renewal.
+func GetOpenVPNProfile(w http.ResponseWriter, r *http.Request) {
+	if openvpnPKI == nil {
+		http.Error(w, errOpenVPNUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	userID := currentPrincipal(r).UserID
+
+	// The profile is named after the account
+	var username string
+	err := db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// node_id points the profile at one of the registered servers
+	config := openvpn
+	if v := r.URL.Query().Get("node_id"); v != "" {
+		nodeID, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid node_id", http.StatusBadRequest)
+			return
+		}
+		node, err := loadEntitledNode(db, userID, nodeID)
+		if err == errNodeNotEntitled {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if node.OpenVPNRemote == "" || node.Health == "down" {
+			http.Error(w, errNoNodeAvailable.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		config.Remote = node.OpenVPNRemote
+	}
+
+	certPEM, keyPEM, err := clientCertificate(userID)
+	if err != nil {
+		log.Println("Certificate issue error:", err)
+		http.Error(w, "Certificate error", http.StatusInternalServerError)
+		return
+	}
+
+	var tlsCrypt []byte
+	if openvpn.TLSCryptKey != "" {
+		if tlsCrypt, err = os.ReadFile(openvpn.TLSCryptKey); err != nil {
+			log.Println("tls-crypt key error:", err)
+			http.Error(w, "Server configuration error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// The profile holds the client's private key
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/x-openvpn-profile")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.ovpn"`, username))
+	w.Write([]byte(renderOpenVPNProfile(config, openvpnPKI.certPEM, certPEM, keyPEM, tlsCrypt)))
+}
+
+// The current CRL, for OpenVPN servers that fetch it over HTTP
+func GetOpenVPNCRL(w http.ResponseWriter, r *http.Request) {
+	if openvpnPKI == nil {
+		http.Error(w, errOpenVPNUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	crl, err := buildCRL(r.Context(), openvpnPKI)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	w.Write(crl)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func parsePEMCertificate(t *testing.T, data []byte) *x509.Certificate {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("No PEM block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// TestLoadPKI tests CA creation on first run and reloading it afterwards
+func TestLoadPKI(t *testing.T) {
+	dir := t.TempDir()
+	p, err := loadPKI(dir, "vpn-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.cert.IsCA {
+		t.Error("Expected a CA certificate")
+	}
+	if info, err := os.Stat(filepath.Join(dir, "ca.key")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("Expected a private CA key file, got %v (%v)", info, err)
+	}
+
+	serverPEM, err := os.ReadFile(filepath.Join(dir, "server.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := parsePEMCertificate(t, serverPEM)
+	if server.Subject.CommonName != "vpn-server" || server.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth {
+		t.Errorf("Unexpected server certificate %v", server.Subject)
+	}
+
+	again, err := loadPKI(dir, "vpn-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.cert.SerialNumber.Cmp(p.cert.SerialNumber) != 0 {
+		t.Error("Expected the existing CA to be reused")
+	}
+}
+
+// TestIssueClientCertificate tests that client certificates chain to the CA and expire on time
+func TestIssueClientCertificate(t *testing.T) {
+	p, err := loadPKI(t.TempDir(), "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	certPEM, keyPEM, serial, err := p.issue("12345678", notAfter, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parsePEMCertificate(t, certPEM)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(p.cert)
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("Client certificate does not verify: %v", err)
+	}
+	if !cert.NotAfter.Equal(notAfter) || cert.SerialNumber.Cmp(serial) != 0 || cert.Subject.CommonName != "12345678" {
+		t.Errorf("Unexpected certificate %v expiring %v", cert.Subject, cert.NotAfter)
+	}
+	if !strings.Contains(string(keyPEM), "PRIVATE KEY") {
+		t.Error("Expected a PEM private key")
+	}
+
+	// Certificates never outlive the CA
+	cert = parsePEMCertificate(t, mustIssue(t, p, p.cert.NotAfter.Add(time.Hour)))
+	if cert.NotAfter.After(p.cert.NotAfter) {
+		t.Error("Certificate outlives the CA")
+	}
+}
+
+func mustIssue(t *testing.T, p *PKI, notAfter time.Time) []byte {
+	certPEM, _, _, err := p.issue("user", notAfter, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM
+}
+
+// TestSignCRL tests that revoked serials appear in a CRL signed by the CA
+func TestSignCRL(t *testing.T) {
+	p, err := loadPKI(t.TempDir(), "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crlPEM, err := p.signCRL([]x509.RevocationListEntry{{SerialNumber: big.NewInt(42), RevocationTime: time.Now()}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(crlPEM)
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(p.cert); err != nil {
+		t.Errorf("CRL signature: %v", err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Int64() != 42 {
+		t.Errorf("Unexpected revocations %v", crl.RevokedCertificateEntries)
+	}
+}
+
+// TestRenderOpenVPNProfile tests the inline profile layout
+func TestRenderOpenVPNProfile(t *testing.T) {
+	c := OpenVPNConfig{Remote: "vpn.example.com 1194", Proto: "udp", ServerName: "server", AuthUserPass: true}
+	profile := renderOpenVPNProfile(c, []byte("CA\n"), []byte("CERT\n"), []byte("KEY"), nil)
+
+	for _, want := range []string{
+		"client\n", "remote vpn.example.com 1194\n", "proto udp\n", "auth-user-pass\n",
+		"verify-x509-name server name\n", "<ca>\nCA\n</ca>\n", "<cert>\nCERT\n</cert>\n", "<key>\nKEY\n</key>\n",
+	} {
+		if !strings.Contains(profile, want) {
+			t.Errorf("Profile is missing %q:\n%s", want, profile)
+		}
+	}
+	if strings.Contains(profile, "tls-crypt") {
+		t.Error("Unexpected tls-crypt block without a key")
+	}
+}
+
+// TestWriteFileAtomic tests that files are replaced whole and no temporary files are left
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "crl.pem")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "second" {
+		t.Errorf("Expected the last write, got %q (%v)", data, err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0o644 {
+		t.Errorf("Expected mode 0644, got %v", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only crl.pem, got %d entries", len(entries))
+	}
+}
+
+// TestForeignCertificates tests that certificates from another CA are found and retired
+func TestForeignCertificates(t *testing.T) {
+	testDB := openTestDB(t)
+
+	current, err := loadPKI(t.TempDir(), "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := loadPKI(t.TempDir(), "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[string]int{}
+	for name, p := range map[string]*PKI{"current": current, "previous": previous} {
+		certPEM, _, serial, err := p.issue("fc"+testSuffix(t), time.Now().Add(time.Hour), x509.ExtKeyUsageClientAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := testDB.Exec(
+			"INSERT INTO client_certificates (serial, cert_pem, key_enc, not_after) VALUES (?, ?, 'x', ?)",
+			hex.EncodeToString(serial.Bytes()), string(certPEM), time.Now().Add(time.Hour),
+		)
+		if err != nil {
+			t.Fatalf("Certificate insert failed: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		ids[name] = int(id)
+		t.Cleanup(func() { testDB.Exec("DELETE FROM client_certificates WHERE id = ?", id) })
+	}
+
+	foreign, err := foreignCertificates(context.Background(), current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[int]bool{}
+	for _, id := range foreign {
+		found[id] = true
+	}
+	if !found[ids["previous"]] || found[ids["current"]] {
+		t.Fatalf("Expected only the previous CA's certificate, got %v", foreign)
+	}
+
+	if err := retireCertificates([]int{ids["previous"]}); err != nil {
+		t.Fatal(err)
+	}
+	var revoked bool
+	testDB.QueryRow("SELECT revoked_at IS NOT NULL FROM client_certificates WHERE id = ?", ids["previous"]).Scan(&revoked)
+	if !revoked {
+		t.Error("Expected the foreign certificate to be revoked")
+	}
+}
+
+// TestOpenVPNProfileMissingUser tests that no profile or certificate is
+// issued for an account that no longer exists
+func TestOpenVPNProfileMissingUser(t *testing.T) {
+	testDB := openTestDB(t)
+
+	p, err := loadPKI(t.TempDir(), "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := openvpnPKI
+	openvpnPKI = p
+	t.Cleanup(func() { openvpnPKI = saved })
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, 'x', 'user', 'active', '2099-12-31')",
+		"op"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("User insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	testDB.Exec("DELETE FROM users WHERE id = ?", id)
+
+	req := httptest.NewRequest("GET", "/api/user/openvpn/profile", nil)
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: int(id), Role: "user"}))
+	w := httptest.NewRecorder()
+	GetOpenVPNProfile(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "PRIVATE KEY") {
+		t.Error("Expected no private key in the response")
+	}
+	var issued int
+	testDB.QueryRow("SELECT COUNT(*) FROM client_certificates WHERE user_id = ?", id).Scan(&issued)
+	if issued != 0 {
+		t.Errorf("Expected no certificate issued, got %d", issued)
+	}
+}
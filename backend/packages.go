@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+type Package struct {
+	ID                 int        `json:"id"`
+	Name               string     `json:"name"`
+	Days               int        `json:"days"`
+	Price              float64    `json:"price"`
+	Currency           string     `json:"currency"`
+	Description        string     `json:"description"`
+	Active             bool       `json:"active"`
+	SortOrder          int        `json:"sort_order"`
+	BandwidthLimitGB   *int       `json:"bandwidth_limit_gb"` // nil means unlimited
+	MaxDevices         int        `json:"max_devices"`
+	VisibleToResellers bool       `json:"visible_to_resellers"`
+	ArchivedAt         *time.Time `json:"archived_at,omitempty"`
+}
+
+var (
+	errPackageNotFound    = errors.New("Package not found")
+	errPackageUnavailable = errors.New("Package is not available")
+)
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+const packageSelect = `SELECT id, name, days, price, currency, COALESCE(description, ''), active, sort_order,
+	bandwidth_limit_gb, max_devices, visible_to_resellers, archived_at FROM packages`
+
+func scanPackage(row interface{ Scan(...interface{}) error }) (Package, error) {
+	var p Package
+	var bandwidth sql.NullInt64
+	var archivedAt sql.NullTime
+
+	err := row.Scan(&p.ID, &p.Name, &p.Days, &p.Price, &p.Currency, &p.Description, &p.Active, &p.SortOrder,
+		&bandwidth, &p.MaxDevices, &p.VisibleToResellers, &archivedAt)
+	if bandwidth.Valid {
+		limit := int(bandwidth.Int64)
+		p.BandwidthLimitGB = &limit
+	}
+	if archivedAt.Valid {
+		p.ArchivedAt = &archivedAt.Time
+	}
+	return p, err
+}
+
+// Load a package by ID. Archived packages still resolve so existing
+// users' package_id keeps working.
+func loadPackage(q queryRower, id int) (Package, error) {
+	p, err := scanPackage(q.QueryRow(packageSelect+" WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return Package{}, errPackageNotFound
+	}
+	return p, err
+}
+
+// Whether new accounts may be sold this package
+func (p Package) Purchasable() bool {
+	return p.Active && p.ArchivedAt == nil
+}
+
+// Load a package that can be sold, optionally through a reseller
+func loadPurchasablePackage(q queryRower, id int, viaReseller bool) (Package, error) {
+	p, err := loadPackage(q, id)
+	if err != nil {
+		return Package{}, err
+	}
+	if !p.Purchasable() || (viaReseller && !p.VisibleToResellers) {
+		return Package{}, errPackageUnavailable
+	}
+	return p, nil
+}
+
+func validatePackage(p Package) error {
+	switch {
+	case p.Name == "":
+		return errors.New("Name is required")
+	case p.Days <= 0:
+		return errors.New("Days must be positive")
+	case p.Price < 0:
+		return errors.New("Price must not be negative")
+	case !currencyPattern.MatchString(p.Currency):
+		return errors.New("Currency must be a three-letter ISO code")
+	case p.MaxDevices < 1:
+		return errors.New("Max devices must be at least 1")
+	case p.BandwidthLimitGB != nil && *p.BandwidthLimitGB <= 0:
+		return errors.New("Bandwidth limit must be positive or omitted")
+	}
+	return nil
+}
+
+func queryPackages(w http.ResponseWriter, where string, args ...interface{}) {
+	rows, err := db.Query(packageSelect+" "+where+" ORDER BY sort_order, id", args...)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	packages := []Package{}
+	for rows.Next() {
+		p, err := scanPackage(rows)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		packages = append(packages, p)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(packages)
+}
+
+// Get VPN packages available for purchase
+func GetPackages(w http.ResponseWriter, r *http.Request) {
+	queryPackages(w, "WHERE active = TRUE AND archived_at IS NULL")
+}
+
+// Reseller: Get packages resellers may sell
+func ResellerGetPackages(w http.ResponseWriter, r *http.Request) {
+	queryPackages(w, "WHERE active = TRUE AND archived_at IS NULL AND visible_to_resellers = TRUE")
+}
+
+// Admin: Get all packages including archived ones
+func AdminGetPackages(w http.ResponseWriter, r *http.Request) {
+	queryPackages(w, "")
+}
+
+// Decode a package body, applying defaults for omitted fields
+func decodePackage(r *http.Request) (Package, error) {
+	p := Package{Currency: "USD", Active: true, MaxDevices: 1, VisibleToResellers: true}
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return Package{}, errors.New("Invalid request")
+	}
+	return p, validatePackage(p)
+}
+
+// Admin: Create package
+func AdminCreatePackage(w http.ResponseWriter, r *http.Request) {
+	p, err := decodePackage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec(
+		`INSERT INTO packages (name, days, price, currency, description, active, sort_order, bandwidth_limit_gb, max_devices, visible_to_resellers)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.Name, p.Days, p.Price, p.Currency, p.Description, p.Active, p.SortOrder, p.BandwidthLimitGB, p.MaxDevices, p.VisibleToResellers,
+	)
+	if err != nil {
+		http.Error(w, "Creation error", http.StatusInternalServerError)
+		return
+	}
+
+	id, _ := result.LastInsertId()
+	p.ID = int(id)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// Admin: Update package
+func AdminUpdatePackage(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid package ID", http.StatusBadRequest)
+		return
+	}
+
+	p, err := decodePackage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec(
+		`UPDATE packages SET name = ?, days = ?, price = ?, currency = ?, description = ?, active = ?, sort_order = ?,
+		bandwidth_limit_gb = ?, max_devices = ?, visible_to_resellers = ? WHERE id = ?`,
+		p.Name, p.Days, p.Price, p.Currency, p.Description, p.Active, p.SortOrder,
+		p.BandwidthLimitGB, p.MaxDevices, p.VisibleToResellers, id,
+	)
+	if err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := loadPackage(db, id)
+	if err == errPackageNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// Admin: Archive package. The row is kept so existing users still resolve it.
+func AdminArchivePackage(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid package ID", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("UPDATE packages SET active = FALSE, archived_at = COALESCE(archived_at, NOW()) WHERE id = ?", id)
+	if err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+	// Zero rows are also reported when the package was already archived
+	if n, _ := result.RowsAffected(); n == 0 {
+		if _, err := loadPackage(db, id); err == errPackageNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Package archived successfully"})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestValidatePackage tests package field validation
+func TestValidatePackage(t *testing.T) {
+	valid := Package{Name: "1 Month", Days: 30, Price: 2.99, Currency: "USD", MaxDevices: 1}
+	if err := validatePackage(valid); err != nil {
+		t.Errorf("Expected valid package, got %v", err)
+	}
+
+	zero := 0
+	cases := map[string]Package{
+		"missing name":   {Days: 30, Currency: "USD", MaxDevices: 1},
+		"zero days":      {Name: "x", Currency: "USD", MaxDevices: 1},
+		"negative price": {Name: "x", Days: 30, Price: -1, Currency: "USD", MaxDevices: 1},
+		"bad currency":   {Name: "x", Days: 30, Currency: "usd", MaxDevices: 1},
+		"no devices":     {Name: "x", Days: 30, Currency: "USD"},
+		"zero bandwidth": {Name: "x", Days: 30, Currency: "USD", MaxDevices: 1, BandwidthLimitGB: &zero},
+	}
+	for name, p := range cases {
+		if err := validatePackage(p); err == nil {
+			t.Errorf("Expected %s to be rejected", name)
+		}
+	}
+}
+
+// TestPackagePurchasable tests that archived or inactive packages cannot be sold
+func TestPackagePurchasable(t *testing.T) {
+	now := time.Now()
+
+	if !(Package{Active: true}).Purchasable() {
+		t.Error("Expected active package to be purchasable")
+	}
+	if (Package{Active: false}).Purchasable() {
+		t.Error("Expected inactive package to be unavailable")
+	}
+	if (Package{Active: true, ArchivedAt: &now}).Purchasable() {
+		t.Error("Expected archived package to be unavailable")
+	}
+}
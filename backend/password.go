@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var passwordCost = bcrypt.DefaultCost
+
+// dummyHash is compared against when a username does not exist so that
+// unknown and known accounts take the same time to reject.
+var dummyHash []byte
+
+func init() {
+	// Allow tuning the bcrypt work factor without a rebuild
+	if cost, err := strconv.Atoi(os.Getenv("BCRYPT_COST")); err == nil &&
+		cost >= bcrypt.MinCost && cost <= bcrypt.MaxCost {
+		passwordCost = cost
+	}
+	dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), passwordCost)
+}
+
+// Hash a password with bcrypt. The result is self-describing
+// ("$2a$<cost>$...") so the algorithm and cost can be upgraded later.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify a password against a stored value. needsRehash reports that the
+// stored value is legacy plaintext or was hashed with an outdated cost.
+func verifyPassword(stored, password string) (ok bool, needsRehash bool) {
+	if !isBcryptHash(stored) {
+		// Legacy rows were stored in the clear before hashing was added
+		ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return ok, ok
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)); err != nil {
+		return false, false
+	}
+
+	cost, err := bcrypt.Cost([]byte(stored))
+	return true, err != nil || cost != passwordCost
+}
+
+// Burn the same amount of time as a real verification
+func rejectPassword(password string) {
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+func isBcryptHash(s string) bool {
+	return strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$")
+}
+
+// PasswordPolicy applies to passwords users choose themselves
+type PasswordPolicy struct {
+	MinLength  int
+	MinClasses int // of lowercase, uppercase, digits and symbols
+}
+
+var passwordPolicy = PasswordPolicy{MinLength: 10, MinClasses: 2}
+
+func init() {
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil && n >= 6 && n <= maxPasswordBytes {
+		passwordPolicy.MinLength = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_CLASSES")); err == nil && n >= 1 && n <= 4 {
+		passwordPolicy.MinClasses = n
+	}
+}
+
+// bcrypt ignores everything past 72 bytes
+const maxPasswordBytes = 72
+
+// Passwords rejected whatever the policy
+var commonPasswords = map[string]bool{
+	"password": true, "password1": true, "password123": true, "passw0rd": true,
+	"123456789": true, "1234567890": true, "12345678": true, "qwerty123": true,
+	"qwertyuiop": true, "iloveyou": true, "letmein": true, "welcome1": true,
+	"admin123": true, "abc123456": true, "1q2w3e4r5t": true, "11111111": true,
+}
+
+// Check a password against the policy. identifiers such as the username
+// or email must not appear in it.
+func (p PasswordPolicy) Validate(password string, identifiers ...string) error {
+	if len(password) < p.MinLength {
+		return fmt.Errorf("Password must be at least %d characters", p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("Password must be at most %d bytes", maxPasswordBytes)
+	}
+
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if lower+upper+digit+symbol < p.MinClasses {
+		return fmt.Errorf("Password must mix at least %d of lowercase, uppercase, digits and symbols", p.MinClasses)
+	}
+
+	folded := strings.ToLower(password)
+	if commonPasswords[folded] {
+		return errors.New("Password is too common")
+	}
+	for _, id := range identifiers {
+		// Only the local part of an email is meaningful here
+		if at := strings.Index(id, "@"); at >= 0 {
+			id = id[:at]
+		}
+		if id = strings.ToLower(id); len(id) >= 3 && strings.Contains(folded, id) {
+			return errors.New("Password must not contain your username or email")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestHashPassword tests that hashes are bcrypt encoded and salted
+func TestHashPassword(t *testing.T) {
+	hash, err := hashPassword("secret")
+	if err != nil {
+		t.Fatalf("Hashing failed: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$2a$") {
+		t.Errorf("Expected bcrypt prefix, got %s", hash)
+	}
+
+	other, _ := hashPassword("secret")
+	if hash == other {
+		t.Error("Expected distinct salts for the same password")
+	}
+}
+
+// TestVerifyPassword tests verification of hashed passwords
+func TestVerifyPassword(t *testing.T) {
+	hash, _ := hashPassword("secret")
+
+	ok, needsRehash := verifyPassword(hash, "secret")
+	if !ok || needsRehash {
+		t.Errorf("Expected ok without rehash, got ok=%v rehash=%v", ok, needsRehash)
+	}
+
+	ok, _ = verifyPassword(hash, "wrong")
+	if ok {
+		t.Error("Wrong password verified")
+	}
+}
+
+// TestVerifyLegacyPassword tests that plaintext rows verify and are flagged for rehash
+func TestVerifyLegacyPassword(t *testing.T) {
+	ok, needsRehash := verifyPassword("654321", "654321")
+	if !ok || !needsRehash {
+		t.Errorf("Expected legacy match with rehash, got ok=%v rehash=%v", ok, needsRehash)
+	}
+
+	ok, needsRehash = verifyPassword("654321", "123456")
+	if ok || needsRehash {
+		t.Error("Wrong legacy password verified")
+	}
+}
+
+// TestVerifyPasswordOutdatedCost tests that a lower cost hash is flagged for rehash
+func TestVerifyPasswordOutdatedCost(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+	ok, needsRehash := verifyPassword(string(hash), "secret")
+	if !ok || !needsRehash {
+		t.Errorf("Expected ok with rehash, got ok=%v rehash=%v", ok, needsRehash)
+	}
+}
+
+// TestPasswordPolicy tests validation of user-chosen passwords
+func TestPasswordPolicy(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 10, MinClasses: 2}
+
+	tests := []struct {
+		password string
+		valid    bool
+	}{
+		{"short1", false},
+		{"alllowercaseletters", false},
+		{"lowercase and spaces", true},
+		{"Password123", false}, // common
+		{"correct-horse-battery", true},
+		{"jane.doe-2024", false}, // contains the email
+		{strings.Repeat("a1", 40), false},
+	}
+
+	for _, tt := range tests {
+		err := policy.Validate(tt.password, "jane.doe@example.com")
+		if (err == nil) != tt.valid {
+			t.Errorf("%q: expected valid=%v, got %v", tt.password, tt.valid, err)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type principalKey struct{}
+
+// Principal is the authenticated identity attached to a request by AuthMiddleware
+type Principal struct {
+	UserID     int
+	Role       string
+	ResellerID *int // reseller that owns this account, if any
+	SessionID  string
+	// RenewalOnly is set for expired accounts, which may only reach routes
+	// wrapped in RenewalAuthMiddleware
+	RenewalOnly bool
+}
+
+// Headers that older versions used to carry identity. They are stripped
+// from incoming requests so a client or proxy cannot spoof them.
+var identityHeaders = []string{"user_id", "user_role", "session_id"}
+
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// Get the principal stored by AuthMiddleware
+func principalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// Get the principal for a request behind AuthMiddleware
+func currentPrincipal(r *http.Request) Principal {
+	p, _ := principalFromContext(r.Context())
+	return p
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RadiusConfig is the embedded RADIUS server VPN concentrators use to
+// authenticate users and report sessions. It only runs when Secret is set.
+type RadiusConfig struct {
+	AuthAddr string
+	AcctAddr string
+	Secret   string
+	Clients  []netip.Prefix // NAS addresses allowed to send requests; empty allows none
+
+	// Drop Access-Requests without a Message-Authenticator (RFC 3579).
+	// On unless RADIUS_REQUIRE_MESSAGE_AUTHENTICATOR=false.
+	RequireMessageAuthenticator bool
+}
+
+var radius = RadiusConfig{AuthAddr: ":1812", AcctAddr: ":1813"}
+
+func init() {
+	radius.Secret = os.Getenv("RADIUS_SECRET")
+	if v := os.Getenv("RADIUS_AUTH_ADDR"); v != "" {
+		radius.AuthAddr = v
+	}
+	if v := os.Getenv("RADIUS_ACCT_ADDR"); v != "" {
+		radius.AcctAddr = v
+	}
+	for _, item := range strings.Split(os.Getenv("RADIUS_CLIENTS"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		p, err := parseClientPrefix(item)
+		if err != nil {
+			log.Fatalf("Invalid RADIUS_CLIENTS entry: %q", item)
+		}
+		radius.Clients = append(radius.Clients, p)
+	}
+	radius.RequireMessageAuthenticator = os.Getenv("RADIUS_REQUIRE_MESSAGE_AUTHENTICATOR") != "false"
+}
+
+// Parse a CIDR, treating a bare address as a single host
+func parseClientPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Failed RADIUS logins lock an account like failed web logins. The burst
+// is larger since concentrators re-authenticate on every reconnect, and
+// there is no per-IP rule as every request comes from the NAS.
+var radiusUserRule = RateLimitRule{
+	Name: "radius:user", Burst: 20, Refill: 15 * time.Second,
+	LockoutThreshold: 5, LockoutBase: time.Minute, LockoutMax: time.Hour,
+}
+
+// Packet codes (RFC 2865, RFC 2866)
+const (
+	radiusAccessRequest      = 1
+	radiusAccessAccept       = 2
+	radiusAccessReject       = 3
+	radiusAccountingRequest  = 4
+	radiusAccountingResponse = 5
+)
+
+// Attribute types
+const (
+	attrUserName             = 1
+	attrUserPassword         = 2
+	attrCHAPPassword         = 3
+	attrNASIPAddress         = 4
+	attrFramedIPAddress      = 8
+	attrReplyMessage         = 18
+	attrSessionTimeout       = 27
+	attrCallingStationID     = 31
+	attrNASIdentifier        = 32
+	attrAcctStatusType       = 40
+	attrAcctDelayTime        = 41
+	attrAcctInputOctets      = 42
+	attrAcctOutputOctets     = 43
+	attrAcctSessionID        = 44
+	attrAcctSessionTime      = 46
+	attrAcctTerminateCause   = 49
+	attrAcctInputGigawords   = 52
+	attrAcctOutputGigawords  = 53
+	attrCHAPChallenge        = 60
+	attrMessageAuthenticator = 80
+)
+
+// Acct-Status-Type values
+const (
+	acctStart         = 1
+	acctStop          = 2
+	acctInterimUpdate = 3
+	acctOn            = 7
+	acctOff           = 8
+)
+
+// Acct-Terminate-Cause recorded for sessions closed by Accounting-On/Off
+const terminateNASReboot = 11
+
+const (
+	radiusMaxPacket   = 4096
+	radiusMaxInFlight = 64
+)
+
+var errMalformedRadiusPacket = errors.New("Malformed RADIUS packet")
+
+type radiusAttribute struct {
+	Type  byte
+	Value []byte
+}
+
+type radiusPacket struct {
+	Code          byte
+	Identifier    byte
+	Authenticator [16]byte
+	Attributes    []radiusAttribute
+}
+
+// Parse a packet, ignoring any padding past its Length field
+func parseRadiusPacket(b []byte) (*radiusPacket, error) {
+	if len(b) < 20 {
+		return nil, errMalformedRadiusPacket
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 20 || length > radiusMaxPacket || length > len(b) {
+		return nil, errMalformedRadiusPacket
+	}
+
+	p := &radiusPacket{Code: b[0], Identifier: b[1]}
+	copy(p.Authenticator[:], b[4:20])
+	for rest := b[20:length]; len(rest) > 0; {
+		if len(rest) < 2 || rest[1] < 2 || int(rest[1]) > len(rest) {
+			return nil, errMalformedRadiusPacket
+		}
+		p.Attributes = append(p.Attributes, radiusAttribute{Type: rest[0], Value: rest[2:rest[1]]})
+		rest = rest[rest[1]:]
+	}
+	return p, nil
+}
+
+func (p *radiusPacket) encode() ([]byte, error) {
+	b := make([]byte, 20, 128)
+	b[0], b[1] = p.Code, p.Identifier
+	copy(b[4:20], p.Authenticator[:])
+	for _, a := range p.Attributes {
+		if len(a.Value) > 253 {
+			return nil, errors.New("RADIUS attribute too long")
+		}
+		b = append(b, a.Type, byte(len(a.Value)+2))
+		b = append(b, a.Value...)
+	}
+	if len(b) > radiusMaxPacket {
+		return nil, errors.New("RADIUS packet too long")
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b, nil
+}
+
+// A response to p carrying its identifier
+func (p *radiusPacket) reply(code byte) *radiusPacket {
+	return &radiusPacket{Code: code, Identifier: p.Identifier}
+}
+
+func (p *radiusPacket) attr(t byte) ([]byte, bool) {
+	for _, a := range p.Attributes {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (p *radiusPacket) str(t byte) string {
+	v, _ := p.attr(t)
+	return string(v)
+}
+
+func (p *radiusPacket) uint32(t byte) (uint32, bool) {
+	v, ok := p.attr(t)
+	if !ok || len(v) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(v), true
+}
+
+func (p *radiusPacket) add(t byte, v []byte) {
+	p.Attributes = append(p.Attributes, radiusAttribute{Type: t, Value: v})
+}
+
+func (p *radiusPacket) addUint32(t byte, v uint32) {
+	p.add(t, binary.BigEndian.AppendUint32(nil, v))
+}
+
+// Offset of the first value of attribute t in an encoded packet, or -1
+func attributeValueOffset(raw []byte, t byte) int {
+	for i := 20; i+2 <= len(raw) && raw[i+1] >= 2; i += int(raw[i+1]) {
+		if raw[i] == t {
+			return i + 2
+		}
+	}
+	return -1
+}
+
+// HMAC-MD5 of a packet with its Message-Authenticator value zeroed
+func messageAuthenticator(raw []byte, offset int, secret []byte) []byte {
+	buf := append([]byte(nil), raw...)
+	copy(buf[offset:offset+16], make([]byte, 16))
+	mac := hmac.New(md5.New, secret)
+	mac.Write(buf)
+	return mac.Sum(nil)
+}
+
+// Check a request's Message-Authenticator. Reports whether the attribute
+// is present and, if so, whether it matches.
+func checkMessageAuthenticator(raw, secret []byte) (present, valid bool) {
+	offset := attributeValueOffset(raw, attrMessageAuthenticator)
+	if offset < 0 {
+		return false, false
+	}
+	if raw[offset-1] != 18 {
+		return true, false
+	}
+	return true, hmac.Equal(raw[offset:offset+16], messageAuthenticator(raw, offset, secret))
+}
+
+// An Accounting-Request's authenticator is the MD5 of the packet with a
+// zero authenticator followed by the secret (RFC 2866 section 3)
+func validAccountingAuthenticator(raw, secret []byte) bool {
+	buf := append([]byte(nil), raw...)
+	copy(buf[4:20], make([]byte, 16))
+	sum := md5.Sum(append(buf, secret...))
+	return hmac.Equal(sum[:], raw[4:20])
+}
+
+// Encode a response and sign it with the Response Authenticator. Access
+// responses lead with a Message-Authenticator, which clients can require
+// to rule out forged replies.
+func encodeRadiusResponse(resp *radiusPacket, requestAuthenticator [16]byte, secret []byte) ([]byte, error) {
+	resp.Authenticator = requestAuthenticator
+	signed := resp.Code == radiusAccessAccept || resp.Code == radiusAccessReject
+	if signed {
+		resp.Attributes = append([]radiusAttribute{{Type: attrMessageAuthenticator, Value: make([]byte, 16)}}, resp.Attributes...)
+	}
+
+	raw, err := resp.encode()
+	if err != nil {
+		return nil, err
+	}
+	if signed {
+		copy(raw[22:38], messageAuthenticator(raw, 22, secret))
+	}
+	sum := md5.Sum(append(append([]byte(nil), raw...), secret...))
+	copy(raw[4:20], sum[:])
+	return raw, nil
+}
+
+// Recover a PAP password hidden with the shared secret (RFC 2865 section 5.2)
+func decryptUserPassword(hidden, secret []byte, requestAuthenticator [16]byte) (string, error) {
+	if len(hidden) == 0 || len(hidden)%16 != 0 || len(hidden) > 128 {
+		return "", errMalformedRadiusPacket
+	}
+	plain := make([]byte, len(hidden))
+	prev := requestAuthenticator[:]
+	for i := 0; i < len(hidden); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			plain[i+j] = hidden[i+j] ^ b[j]
+		}
+		prev = hidden[i : i+16]
+	}
+	return string(bytes.TrimRight(plain, "\x00")), nil
+}
+
+// Check a CHAP-Password (identifier and MD5 response) against a cleartext
+// password and the challenge
+func verifyCHAP(chapPassword, challenge []byte, password string) bool {
+	if len(chapPassword) != 17 {
+		return false
+	}
+	h := md5.New()
+	h.Write(chapPassword[:1])
+	h.Write([]byte(password))
+	h.Write(challenge)
+	return hmac.Equal(h.Sum(nil), chapPassword[1:])
+}
+
+// The NAS a request came from: its NAS-IP-Address, else the sender
+func nasAddress(req *radiusPacket, from netip.Addr) netip.Addr {
+	if v, ok := req.attr(attrNASIPAddress); ok && len(v) == 4 {
+		return netip.AddrFrom4([4]byte(v))
+	}
+	return from
+}
+
+// RadiusServer answers Access-Requests from the users table and records
+// Accounting-Requests in radius_sessions
+type RadiusServer struct {
+	Secret                      []byte
+	Clients                     []netip.Prefix
+	RequireMessageAuthenticator bool
+}
+
+func newRadiusServer(c RadiusConfig) *RadiusServer {
+	return &RadiusServer{
+		Secret:                      []byte(c.Secret),
+		Clients:                     c.Clients,
+		RequireMessageAuthenticator: c.RequireMessageAuthenticator,
+	}
+}
+
+func (s *RadiusServer) allowed(addr netip.Addr) bool {
+	for _, p := range s.Clients {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start answering requests on conn until ctx is cancelled. Requests are
+// handled concurrently since password checks are slow.
+func (s *RadiusServer) Start(ctx context.Context, conn net.PacketConn, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+
+		var handlers sync.WaitGroup
+		defer handlers.Wait()
+		inFlight := make(chan struct{}, radiusMaxInFlight)
+
+		buf := make([]byte, radiusMaxPacket)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				log.Println("RADIUS read error:", err)
+				continue
+			}
+
+			udp, ok := addr.(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			from, _ := netip.AddrFromSlice(udp.IP)
+			from = from.Unmap()
+			if !s.allowed(from) {
+				log.Printf("RADIUS: ignoring request from unknown client %s", from)
+				continue
+			}
+
+			raw := append([]byte(nil), buf[:n]...)
+			inFlight <- struct{}{}
+			handlers.Add(1)
+			go func() {
+				defer handlers.Done()
+				defer func() { <-inFlight }()
+				if resp := s.handle(ctx, raw, from); resp != nil {
+					if _, err := conn.WriteTo(resp, addr); err != nil {
+						log.Println("RADIUS write error:", err)
+					}
+				}
+			}()
+		}
+	}()
+}
+
+// Answer one request. Returns nil when the request is dropped, which
+// includes anything that fails authentication with the shared secret.
+func (s *RadiusServer) handle(ctx context.Context, raw []byte, from netip.Addr) []byte {
+	req, err := parseRadiusPacket(raw)
+	if err != nil {
+		log.Printf("RADIUS: %v from %s", err, from)
+		return nil
+	}
+	raw = raw[:binary.BigEndian.Uint16(raw[2:4])]
+
+	var resp *radiusPacket
+	switch req.Code {
+	case radiusAccessRequest:
+		present, valid := checkMessageAuthenticator(raw, s.Secret)
+		if (present && !valid) || (!present && s.RequireMessageAuthenticator) {
+			log.Printf("RADIUS: dropping Access-Request from %s with a bad or missing Message-Authenticator", from)
+			return nil
+		}
+		resp = s.authenticate(ctx, req, from)
+	case radiusAccountingRequest:
+		if !validAccountingAuthenticator(raw, s.Secret) {
+			log.Printf("RADIUS: dropping Accounting-Request from %s with a bad authenticator", from)
+			return nil
+		}
+		resp = s.account(ctx, req, from)
+	}
+	if resp == nil {
+		return nil
+	}
+
+	out, err := encodeRadiusResponse(resp, req.Authenticator, s.Secret)
+	if err != nil {
+		log.Println("RADIUS encode error:", err)
+		return nil
+	}
+	return out
+}
+
+// Authenticate an Access-Request with PAP or CHAP. Accounts are held to
+// the same status rules as LoginHandler, except that expired accounts are
+// rejected outright since they may only sign in to renew. As in
+// LoginHandler, every reject before the password checks out is the same
+// generic one, since Reply-Message is readable without the secret.
+func (s *RadiusServer) authenticate(ctx context.Context, req *radiusPacket, from netip.Addr) *radiusPacket {
+	username := req.str(attrUserName)
+	nas := req.str(attrNASIdentifier)
+	if nas == "" {
+		nas = nasAddress(req, from).String()
+	}
+
+	reject := func(message string) *radiusPacket {
+		resp := req.reply(radiusAccessReject)
+		resp.add(attrReplyMessage, []byte(message))
+		return resp
+	}
+	failure := func(userID int, reason string) {
+		logActivityFrom(from.String(), Activity{TargetID: userID, Action: "login.failure", Details: map[string]interface{}{
+			"username": username, "reason": reason, "method": "radius", "nas": nas,
+		}})
+	}
+
+	check := rateLimitCheck{radiusUserRule, strings.ToLower(strings.TrimSpace(username))}
+	if wait, err := rateLimiter.Allow(ctx, check); err != nil {
+		log.Println("Rate limit error:", err)
+	} else if wait > 0 {
+		return reject("Too many attempts, please try again later")
+	}
+	recordFailure := func() {
+		if err := rateLimiter.Failure(ctx, check); err != nil {
+			log.Println("Rate limit error:", err)
+		}
+	}
+
+	hidden, isPAP := req.attr(attrUserPassword)
+	chap, isCHAP := req.attr(attrCHAPPassword)
+	var password string
+	if isPAP {
+		var err error
+		if password, err = decryptUserPassword(hidden, s.Secret, req.Authenticator); err != nil {
+			return reject("Invalid credentials")
+		}
+	} else if !isCHAP {
+		return reject("Invalid credentials")
+	}
+
+	var user User
+	err := db.QueryRowContext(ctx,
+		"SELECT id, username, password, role, COALESCE(email, ''), status, created_at, expires_at FROM users WHERE username = ?",
+		username,
+	).Scan(&user.ID, &user.Username, &user.Password, &user.Role, &user.Email, &user.Status, &user.CreatedAt, &user.ExpiresAt)
+	if err == sql.ErrNoRows {
+		rejectPassword(password)
+		recordFailure()
+		failure(0, "unknown_user")
+		return reject("Invalid credentials")
+	}
+	if err != nil {
+		// No reply lets the NAS retry or fail over to another server
+		log.Println("RADIUS database error:", err)
+		return nil
+	}
+
+	var ok, needsRehash bool
+	switch {
+	case isPAP:
+		ok, needsRehash = verifyPassword(user.Password, password)
+	case isBcryptHash(user.Password):
+		// CHAP needs the cleartext password, which only legacy rows keep.
+		// The reject matches a wrong password so it reveals nothing.
+		rejectPassword("")
+		recordFailure()
+		failure(user.ID, "chap_unsupported")
+		return reject("Invalid credentials")
+	default:
+		challenge, found := req.attr(attrCHAPChallenge)
+		if !found {
+			challenge = req.Authenticator[:]
+		}
+		ok = verifyCHAP(chap, challenge, user.Password)
+	}
+	if !ok {
+		recordFailure()
+		failure(user.ID, "bad_password")
+		return reject("Invalid credentials")
+	}
+
+	if needsRehash {
+		if hash, err := hashPassword(password); err == nil {
+			if _, err := db.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", hash, user.ID); err != nil {
+				log.Println("Password rehash error:", err)
+			}
+		}
+	}
+
+	if statusErr := accountStatusError(user.Role, user.Status, user.ExpiresAt); statusErr != nil {
+		reason := user.Status
+		if statusErr == errAccountExpired {
+			reason = "expired"
+		}
+		failure(user.ID, reason)
+		return reject(statusErr.Error())
+	}
+
+	// A password alone does not satisfy two-factor
+	step, err := secondFactorStep(user)
+	if err != nil {
+		log.Println("Two-factor lookup error:", err)
+		return nil
+	}
+	if step != "" {
+		failure(user.ID, "two_factor")
+		return reject("Two-factor authentication is required for this account")
+	}
+
+	if err := rateLimiter.Success(ctx, check); err != nil {
+		log.Println("Rate limit error:", err)
+	}
+	logActivityFrom(from.String(), Activity{ActorID: user.ID, TargetID: user.ID, Action: "login.success", Details: map[string]interface{}{
+		"method": "radius", "nas": nas,
+	}})
+
+	resp := req.reply(radiusAccessAccept)
+	// End the session when the account expires
+	if user.Role == "user" && !user.ExpiresAt.IsZero() {
+		seconds := math.Min(math.Ceil(time.Until(user.ExpiresAt).Seconds()), math.MaxUint32)
+		resp.addUint32(attrSessionTimeout, uint32(seconds))
+	}
+	return resp
+}
+
+// Record an Accounting-Request. The response is only sent once the
+// update is stored, so the NAS retransmits on failure.
+func (s *RadiusServer) account(ctx context.Context, req *radiusPacket, from netip.Addr) *radiusPacket {
+	status, ok := req.uint32(attrAcctStatusType)
+	if !ok {
+		return nil
+	}
+	nas := nasAddress(req, from).String()
+
+	switch status {
+	case acctStart, acctInterimUpdate, acctStop:
+		if err := recordRadiusSession(ctx, req, nas, status); err != nil {
+			log.Println("RADIUS accounting error:", err)
+			return nil
+		}
+	case acctOn, acctOff:
+		// The NAS restarted, so none of its open sessions survived
+		_, err := db.ExecContext(ctx,
+			"UPDATE radius_sessions SET stopped_at = NOW(), terminate_cause = ? WHERE nas_ip = ? AND stopped_at IS NULL",
+			terminateNASReboot, nas,
+		)
+		if err != nil {
+			log.Println("RADIUS accounting error:", err)
+			return nil
+		}
+	}
+	return req.reply(radiusAccountingResponse)
+}
+
+// Upsert a session from Start, Interim-Update or Stop. Counters only grow
+// so a delayed interim update cannot roll back a later one.
+func recordRadiusSession(ctx context.Context, req *radiusPacket, nas string, status uint32) error {
+	sessionID := req.str(attrAcctSessionID)
+	if sessionID == "" {
+		return errors.New("Accounting-Request without Acct-Session-Id")
+	}
+	username := req.str(attrUserName)
+
+	sessionTime, _ := req.uint32(attrAcctSessionTime)
+	delay, _ := req.uint32(attrAcctDelayTime)
+	eventTime := time.Now().Add(-time.Duration(delay) * time.Second)
+	startedAt := eventTime.Add(-time.Duration(sessionTime) * time.Second)
+
+	octets := func(low, high byte) uint64 {
+		l, _ := req.uint32(low)
+		h, _ := req.uint32(high)
+		return uint64(h)<<32 | uint64(l)
+	}
+
+	var stoppedAt, cause interface{}
+	if status == acctStop {
+		stoppedAt = eventTime
+		if c, ok := req.uint32(attrAcctTerminateCause); ok {
+			cause = c
+		}
+	}
+	var framedIP interface{}
+	if v, ok := req.attr(attrFramedIPAddress); ok && len(v) == 4 {
+		framedIP = netip.AddrFrom4([4]byte(v)).String()
+	}
+
+	_, err := db.ExecContext(ctx,
+		`INSERT INTO radius_sessions (user_id, username, nas_ip, nas_identifier, session_id, framed_ip, calling_station_id,
+			started_at, stopped_at, session_time, input_octets, output_octets, terminate_cause)
+		VALUES ((SELECT id FROM users WHERE username = ?), ?, ?, NULLIF(?, ''), ?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			framed_ip = COALESCE(VALUES(framed_ip), framed_ip),
+			stopped_at = COALESCE(stopped_at, VALUES(stopped_at)),
+			terminate_cause = COALESCE(terminate_cause, VALUES(terminate_cause)),
+			session_time = GREATEST(session_time, VALUES(session_time)),
+			input_octets = GREATEST(input_octets, VALUES(input_octets)),
+			output_octets = GREATEST(output_octets, VALUES(output_octets))`,
+		username, username, nas, req.str(attrNASIdentifier), sessionID, framedIP, req.str(attrCallingStationID),
+		startedAt, stoppedAt, sessionTime,
+		octets(attrAcctInputOctets, attrAcctInputGigawords), octets(attrAcctOutputOctets, attrAcctOutputGigawords), cause,
+	)
+	return err
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Hide a PAP password the way a NAS does (RFC 2865 section 5.2)
+func hideUserPassword(password string, secret []byte, authenticator [16]byte) []byte {
+	plain := []byte(password)
+	if pad := len(plain) % 16; pad != 0 || len(plain) == 0 {
+		plain = append(plain, make([]byte, 16-pad)...)
+	}
+	hidden := make([]byte, len(plain))
+	prev := authenticator[:]
+	for i := 0; i < len(plain); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		b := h.Sum(nil)
+		for j := 0; j < 16; j++ {
+			hidden[i+j] = plain[i+j] ^ b[j]
+		}
+		prev = hidden[i : i+16]
+	}
+	return hidden
+}
+
+// Test servers accept the loopback clients they are exercised from
+var loopbackClients = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("::1/128")}
+
+// radiusTestClient is a minimal NAS for exercising the server over UDP
+type radiusTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	secret []byte
+	id     byte
+	wait   time.Duration // how long to wait for a reply
+}
+
+// Start a server on a loopback port and connect a client to it
+func startRadiusTest(t *testing.T, server *RadiusServer, clientSecret string) *radiusTestClient {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	server.Start(ctx, conn, &wg)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return &radiusTestClient{t: t, conn: client, secret: []byte(clientSecret), wait: 2 * time.Second}
+}
+
+// An Access-Request for PAP, or for CHAP when chap is set
+func (c *radiusTestClient) accessRequest(username, password string, chap bool) *radiusPacket {
+	c.id++
+	req := &radiusPacket{Code: radiusAccessRequest, Identifier: c.id}
+	rand.Read(req.Authenticator[:])
+	req.add(attrUserName, []byte(username))
+	req.add(attrNASIdentifier, []byte("test-nas"))
+	if chap {
+		challenge := make([]byte, 16)
+		rand.Read(challenge)
+		h := md5.New()
+		h.Write([]byte{7})
+		h.Write([]byte(password))
+		h.Write(challenge)
+		req.add(attrCHAPPassword, append([]byte{7}, h.Sum(nil)...))
+		req.add(attrCHAPChallenge, challenge)
+	} else {
+		req.add(attrUserPassword, hideUserPassword(password, c.secret, req.Authenticator))
+	}
+	req.add(attrMessageAuthenticator, make([]byte, 16))
+	return req
+}
+
+// An Accounting-Request for a session
+func (c *radiusTestClient) accountingRequest(status uint32, username, sessionID string) *radiusPacket {
+	c.id++
+	req := &radiusPacket{Code: radiusAccountingRequest, Identifier: c.id}
+	req.addUint32(attrAcctStatusType, status)
+	req.add(attrUserName, []byte(username))
+	req.add(attrAcctSessionID, []byte(sessionID))
+	req.add(attrNASIPAddress, []byte{192, 0, 2, 1})
+	return req
+}
+
+// Sign req, send it and return the verified reply, or nil on timeout
+func (c *radiusTestClient) exchange(req *radiusPacket) *radiusPacket {
+	c.t.Helper()
+	raw, err := req.encode()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if req.Code == radiusAccountingRequest {
+		sum := md5.Sum(append(append([]byte(nil), raw...), c.secret...))
+		copy(raw[4:20], sum[:])
+		req.Authenticator = [16]byte(sum)
+	} else if offset := attributeValueOffset(raw, attrMessageAuthenticator); offset >= 0 {
+		copy(raw[offset:], messageAuthenticator(raw, offset, c.secret))
+	}
+
+	if _, err := c.conn.Write(raw); err != nil {
+		c.t.Fatal(err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.wait))
+	buf := make([]byte, radiusMaxPacket)
+	n, err := c.conn.Read(buf)
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return nil
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	resp, err := parseRadiusPacket(buf[:n])
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if resp.Identifier != req.Identifier {
+		c.t.Fatalf("Response identifier %d does not match request %d", resp.Identifier, req.Identifier)
+	}
+	signed := append([]byte(nil), buf[:n]...)
+	copy(signed[4:20], req.Authenticator[:])
+	sum := md5.Sum(append(append([]byte(nil), signed...), c.secret...))
+	if !bytes.Equal(sum[:], resp.Authenticator[:]) {
+		c.t.Fatal("Invalid Response Authenticator")
+	}
+	if resp.Code != radiusAccountingResponse {
+		if present, valid := checkMessageAuthenticator(signed, c.secret); !present || !valid {
+			c.t.Fatal("Missing or invalid Message-Authenticator in response")
+		}
+	}
+	return resp
+}
+
+// TestRadiusPacketEncoding tests the packet codec and rejection of bad lengths
+func TestRadiusPacketEncoding(t *testing.T) {
+	p := &radiusPacket{Code: radiusAccessRequest, Identifier: 42}
+	p.add(attrUserName, []byte("alice"))
+	p.addUint32(attrSessionTimeout, 3600)
+	raw, err := p.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := parseRadiusPacket(append(raw, 0, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Identifier != 42 || parsed.str(attrUserName) != "alice" || len(parsed.Attributes) != 2 {
+		t.Errorf("Unexpected packet %+v", parsed)
+	}
+	if v, ok := parsed.uint32(attrSessionTimeout); !ok || v != 3600 {
+		t.Errorf("Expected Session-Timeout 3600, got %d", v)
+	}
+
+	// A header with the given attribute bytes and a matching Length
+	withAttrs := func(attrs ...byte) []byte {
+		b := append(append([]byte(nil), raw[:20]...), attrs...)
+		b[2], b[3] = 0, byte(len(b))
+		return b
+	}
+	for name, b := range map[string][]byte{
+		"short header":     raw[:19],
+		"length past end":  raw[:len(raw)-1],
+		"length below min": append([]byte{1, 1, 0, 19}, make([]byte, 16)...),
+		"length above max": append([]byte{1, 1, 0x10, 0x01}, make([]byte, 4097)...),
+		"truncated attr":   withAttrs(1),
+		"zero length attr": withAttrs(1, 0),
+		"attr past end":    withAttrs(1, 10, 'a'),
+	} {
+		if _, err := parseRadiusPacket(b); err != errMalformedRadiusPacket {
+			t.Errorf("%s: expected a malformed packet, got %v", name, err)
+		}
+	}
+
+	p.add(attrReplyMessage, make([]byte, 254))
+	if _, err := p.encode(); err == nil {
+		t.Error("Expected an oversized attribute to be rejected")
+	}
+}
+
+// TestRadiusUserPassword tests PAP password recovery across block sizes
+func TestRadiusUserPassword(t *testing.T) {
+	secret := []byte("s3cret")
+	var auth [16]byte
+	rand.Read(auth[:])
+
+	for _, password := range []string{"a", strings.Repeat("b", 16), strings.Repeat("c", 17), strings.Repeat("d", 128)} {
+		got, err := decryptUserPassword(hideUserPassword(password, secret, auth), secret, auth)
+		if err != nil || got != password {
+			t.Errorf("Expected %q, got %q (%v)", password, got, err)
+		}
+	}
+	if got, _ := decryptUserPassword(hideUserPassword("password", secret, auth), []byte("wrong"), auth); got == "password" {
+		t.Error("Expected a wrong secret to garble the password")
+	}
+	for _, hidden := range [][]byte{nil, make([]byte, 15), make([]byte, 144)} {
+		if _, err := decryptUserPassword(hidden, secret, auth); err == nil {
+			t.Errorf("Expected %d bytes to be rejected", len(hidden))
+		}
+	}
+}
+
+// TestVerifyCHAP tests CHAP responses against a cleartext password
+func TestVerifyCHAP(t *testing.T) {
+	challenge := []byte("0123456789abcdef")
+	h := md5.New()
+	h.Write([]byte{1})
+	h.Write([]byte("secret-password"))
+	h.Write(challenge)
+	response := append([]byte{1}, h.Sum(nil)...)
+
+	if !verifyCHAP(response, challenge, "secret-password") {
+		t.Error("Expected a valid CHAP response")
+	}
+	if verifyCHAP(response, challenge, "other-password") {
+		t.Error("Expected a wrong password to fail")
+	}
+	if verifyCHAP(response[:16], challenge, "secret-password") {
+		t.Error("Expected a short CHAP-Password to fail")
+	}
+}
+
+// TestRadiusResponseSigning tests the Response Authenticator and
+// Message-Authenticator of an encoded reply
+func TestRadiusResponseSigning(t *testing.T) {
+	secret := []byte("s3cret")
+	var auth [16]byte
+	rand.Read(auth[:])
+
+	resp := (&radiusPacket{Identifier: 9}).reply(radiusAccessAccept)
+	resp.addUint32(attrSessionTimeout, 60)
+	raw, err := encodeRadiusResponse(resp, auth, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw[20] != attrMessageAuthenticator {
+		t.Error("Expected the Message-Authenticator first")
+	}
+
+	signed := append([]byte(nil), raw...)
+	copy(signed[4:20], auth[:])
+	sum := md5.Sum(append(append([]byte(nil), signed...), secret...))
+	if !hmac.Equal(sum[:], raw[4:20]) {
+		t.Error("Invalid Response Authenticator")
+	}
+	if present, valid := checkMessageAuthenticator(signed, secret); !present || !valid {
+		t.Error("Invalid Message-Authenticator")
+	}
+	if _, valid := checkMessageAuthenticator(signed, []byte("wrong")); valid {
+		t.Error("Expected a wrong secret to fail the Message-Authenticator")
+	}
+}
+
+// TestRadiusServerDropsUntrusted tests that requests from unknown
+// clients or signed with the wrong secret get no reply
+func TestRadiusServerDropsUntrusted(t *testing.T) {
+	server := &RadiusServer{Secret: []byte("s3cret"), Clients: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}}
+	client := startRadiusTest(t, server, "s3cret")
+	client.wait = 300 * time.Millisecond
+	if resp := client.exchange(client.accessRequest("alice", "password", false)); resp != nil {
+		t.Errorf("Expected no reply to an unknown client, got code %d", resp.Code)
+	}
+
+	server = &RadiusServer{Secret: []byte("s3cret")}
+	client = startRadiusTest(t, server, "s3cret")
+	client.wait = 300 * time.Millisecond
+	if resp := client.exchange(client.accessRequest("alice", "password", false)); resp != nil {
+		t.Errorf("Expected no reply with no clients configured, got code %d", resp.Code)
+	}
+
+	server = &RadiusServer{Secret: []byte("s3cret"), Clients: loopbackClients}
+	client = startRadiusTest(t, server, "wrong")
+	client.wait = 300 * time.Millisecond
+	if resp := client.exchange(client.accessRequest("alice", "password", false)); resp != nil {
+		t.Errorf("Expected no reply to a bad Message-Authenticator, got code %d", resp.Code)
+	}
+	if resp := client.exchange(client.accountingRequest(acctStart, "alice", "s1")); resp != nil {
+		t.Errorf("Expected no reply to a bad accounting authenticator, got code %d", resp.Code)
+	}
+
+	server = &RadiusServer{Secret: []byte("s3cret"), Clients: loopbackClients, RequireMessageAuthenticator: true}
+	client = startRadiusTest(t, server, "s3cret")
+	client.wait = 300 * time.Millisecond
+	req := client.accessRequest("alice", "password", false)
+	req.Attributes = req.Attributes[:len(req.Attributes)-1]
+	if resp := client.exchange(req); resp != nil {
+		t.Errorf("Expected no reply without a required Message-Authenticator, got code %d", resp.Code)
+	}
+}
+
+// TestRadiusAuthentication tests PAP and CHAP against the users table,
+// the status rules and session accounting
+func TestRadiusAuthentication(t *testing.T) {
+	testDB := openTestDB(t)
+
+	hash, err := hashPassword("radius-Pass-2024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	suffix := testSuffix(t)
+	users := map[string]int{}
+	for _, u := range []struct{ name, password, status, expires string }{
+		{"ra" + suffix, hash, "active", "2099-12-31"},
+		{"rl" + suffix, "legacy-Pass-2024", "active", "2099-12-31"},
+		{"rs" + suffix, hash, "suspended", "2099-12-31"},
+		{"re" + suffix, hash, "active", "2000-01-01"},
+	} {
+		// No email, as for bulk or voucher accounts created without one
+		result, err := testDB.Exec(
+			"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, ?, 'user', ?, ?)",
+			u.name, u.password, u.status, u.expires,
+		)
+		if err != nil {
+			t.Fatalf("User insert failed: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		users[u.name] = int(id)
+	}
+	t.Cleanup(func() {
+		for _, id := range users {
+			testDB.Exec("DELETE FROM radius_sessions WHERE user_id = ?", id)
+			testDB.Exec("DELETE FROM users WHERE id = ?", id)
+		}
+	})
+
+	client := startRadiusTest(t, &RadiusServer{Secret: []byte("s3cret"), Clients: loopbackClients}, "s3cret")
+	for _, tc := range []struct {
+		name, username, password string
+		chap                     bool
+		want                     byte
+		generic                  bool
+	}{
+		{"pap", "ra" + suffix, "radius-Pass-2024", false, radiusAccessAccept, false},
+		{"wrong password", "ra" + suffix, "wrong-Pass-2024", false, radiusAccessReject, true},
+		{"unknown user", "rx" + suffix, "radius-Pass-2024", false, radiusAccessReject, true},
+		{"chap on a hashed password", "ra" + suffix, "radius-Pass-2024", true, radiusAccessReject, true},
+		{"chap on a legacy password", "rl" + suffix, "legacy-Pass-2024", true, radiusAccessAccept, false},
+		{"wrong password on a suspended account", "rs" + suffix, "wrong-Pass-2024", false, radiusAccessReject, true},
+		{"suspended", "rs" + suffix, "radius-Pass-2024", false, radiusAccessReject, false},
+		{"expired", "re" + suffix, "radius-Pass-2024", false, radiusAccessReject, false},
+	} {
+		resp := client.exchange(client.accessRequest(tc.username, tc.password, tc.chap))
+		if resp == nil || resp.Code != tc.want {
+			t.Errorf("%s: expected code %d, got %+v", tc.name, tc.want, resp)
+			continue
+		}
+		if tc.want == radiusAccessAccept {
+			if _, ok := resp.uint32(attrSessionTimeout); !ok {
+				t.Errorf("%s: expected a Session-Timeout", tc.name)
+			}
+		}
+		// Nothing before the password check tells accounts apart
+		if tc.generic && resp.str(attrReplyMessage) != "Invalid credentials" {
+			t.Errorf("%s: expected the generic reject, got %q", tc.name, resp.str(attrReplyMessage))
+		}
+	}
+
+	// Accounting: start, an interim update and a stop for one session
+	username, sessionID := "ra"+suffix, "sess-"+suffix
+	if resp := client.exchange(client.accountingRequest(acctStart, username, sessionID)); resp == nil || resp.Code != radiusAccountingResponse {
+		t.Fatalf("Expected an Accounting-Response to start, got %+v", resp)
+	}
+	interim := client.accountingRequest(acctInterimUpdate, username, sessionID)
+	interim.addUint32(attrAcctSessionTime, 60)
+	interim.addUint32(attrAcctInputOctets, 1000)
+	interim.addUint32(attrAcctOutputGigawords, 1)
+	if resp := client.exchange(interim); resp == nil {
+		t.Fatal("Expected an Accounting-Response to the interim update")
+	}
+	stop := client.accountingRequest(acctStop, username, sessionID)
+	stop.addUint32(attrAcctSessionTime, 120)
+	stop.addUint32(attrAcctInputOctets, 500) // lower than the interim count
+	stop.addUint32(attrAcctTerminateCause, 1)
+	if resp := client.exchange(stop); resp == nil {
+		t.Fatal("Expected an Accounting-Response to stop")
+	}
+
+	var userID, sessionTime, cause int
+	var input, output uint64
+	var stopped bool
+	err = testDB.QueryRow(
+		`SELECT user_id, session_time, input_octets, output_octets, stopped_at IS NOT NULL, terminate_cause
+		FROM radius_sessions WHERE nas_ip = '192.0.2.1' AND session_id = ?`,
+		sessionID,
+	).Scan(&userID, &sessionTime, &input, &output, &stopped, &cause)
+	if err != nil {
+		t.Fatalf("Session lookup failed: %v", err)
+	}
+	if userID != users[username] || sessionTime != 120 || input != 1000 || output != 1<<32 || !stopped || cause != 1 {
+		t.Errorf("Unexpected session: user %d, %ds, %d in, %d out, stopped %v, cause %d",
+			userID, sessionTime, input, output, stopped, cause)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitRule is a token bucket with optional progressive lockout.
+// Each attempt takes a token; one token is regained every Refill. After
+// LockoutThreshold consecutive failures the key is locked for LockoutBase,
+// doubling with every further failure up to LockoutMax.
+type RateLimitRule struct {
+	Name             string
+	Burst            int
+	Refill           time.Duration
+	LockoutThreshold int // 0 disables lockout
+	LockoutBase      time.Duration
+	LockoutMax       time.Duration
+}
+
+var (
+	loginIPRule = RateLimitRule{
+		Name: "login:ip", Burst: 20, Refill: 30 * time.Second,
+		LockoutThreshold: 20, LockoutBase: time.Minute, LockoutMax: time.Hour,
+	}
+	loginUserRule = RateLimitRule{
+		Name: "login:user", Burst: 5, Refill: time.Minute,
+		LockoutThreshold: 5, LockoutBase: time.Minute, LockoutMax: time.Hour,
+	}
+	signupIPRule = RateLimitRule{
+		Name: "signup:ip", Burst: 5, Refill: 10 * time.Minute,
+	}
+)
+
+func init() {
+	envInt := func(name string, dst *int) {
+		if v, err := strconv.Atoi(os.Getenv(name)); err == nil && v >= 0 {
+			*dst = v
+		}
+	}
+	envDuration := func(name string, dst *time.Duration) {
+		if d, err := time.ParseDuration(os.Getenv(name)); err == nil && d > 0 {
+			*dst = d
+		}
+	}
+
+	envInt("LOGIN_IP_BURST", &loginIPRule.Burst)
+	envDuration("LOGIN_IP_REFILL", &loginIPRule.Refill)
+	envInt("LOGIN_IP_LOCKOUT_THRESHOLD", &loginIPRule.LockoutThreshold)
+	envInt("LOGIN_USER_BURST", &loginUserRule.Burst)
+	envDuration("LOGIN_USER_REFILL", &loginUserRule.Refill)
+	envInt("LOGIN_USER_LOCKOUT_THRESHOLD", &loginUserRule.LockoutThreshold)
+	envInt("SIGNUP_IP_BURST", &signupIPRule.Burst)
+	envDuration("SIGNUP_IP_REFILL", &signupIPRule.Refill)
+
+	for _, rule := range []*RateLimitRule{&loginIPRule, &loginUserRule} {
+		envDuration("LOGIN_LOCKOUT_BASE", &rule.LockoutBase)
+		envDuration("LOGIN_LOCKOUT_MAX", &rule.LockoutMax)
+	}
+}
+
+// RateLimitState is the stored state of one key
+type RateLimitState struct {
+	Tokens      float64
+	UpdatedAt   time.Time
+	Failures    int
+	LockedUntil time.Time
+}
+
+// Take a token at now. Returns how long to wait when none is available.
+func (s *RateLimitState) take(rule RateLimitRule, now time.Time) time.Duration {
+	if now.Before(s.LockedUntil) {
+		return s.LockedUntil.Sub(now)
+	}
+
+	if s.UpdatedAt.IsZero() {
+		s.Tokens = float64(rule.Burst)
+	} else if elapsed := now.Sub(s.UpdatedAt); elapsed > 0 {
+		s.Tokens = math.Min(float64(rule.Burst), s.Tokens+float64(elapsed)/float64(rule.Refill))
+	}
+	s.UpdatedAt = now
+
+	if s.Tokens < 1 {
+		return time.Duration((1 - s.Tokens) * float64(rule.Refill))
+	}
+	s.Tokens--
+	return 0
+}
+
+// Record a failed attempt, locking the key once the threshold is reached
+func (s *RateLimitState) fail(rule RateLimitRule, now time.Time) {
+	s.Failures++
+	if rule.LockoutThreshold == 0 || s.Failures < rule.LockoutThreshold {
+		return
+	}
+
+	lockout := rule.LockoutMax
+	if doublings := s.Failures - rule.LockoutThreshold; doublings < 30 {
+		if d := rule.LockoutBase << uint(doublings); d < lockout {
+			lockout = d
+		}
+	}
+	s.LockedUntil = now.Add(lockout)
+}
+
+// RateLimitStore holds limiter state. Update must apply fn atomically so
+// replicas sharing a store see each other's attempts.
+type RateLimitStore interface {
+	Update(ctx context.Context, key string, fn func(*RateLimitState)) error
+	Prune(ctx context.Context, idleSince time.Time) (int64, error)
+}
+
+// memoryRateLimitStore suits a single replica. Idle keys are pruned as it
+// is used, since the cleanup job only runs on one replica.
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	states    map[string]*RateLimitState
+	lastPrune time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{states: map[string]*RateLimitState{}}
+}
+
+func (m *memoryRateLimitStore) Update(ctx context.Context, key string, fn func(*RateLimitState)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now := time.Now(); now.Sub(m.lastPrune) > time.Hour {
+		m.pruneLocked(now.Add(-rateLimitIdleTTL))
+		m.lastPrune = now
+	}
+	state, ok := m.states[key]
+	if !ok {
+		state = &RateLimitState{}
+		m.states[key] = state
+	}
+	fn(state)
+	return nil
+}
+
+func (m *memoryRateLimitStore) Prune(ctx context.Context, idleSince time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pruneLocked(idleSince), nil
+}
+
+func (m *memoryRateLimitStore) pruneLocked(idleSince time.Time) int64 {
+	var n int64
+	for key, state := range m.states {
+		if state.UpdatedAt.Before(idleSince) && state.LockedUntil.Before(idleSince) {
+			delete(m.states, key)
+			n++
+		}
+	}
+	return n
+}
+
+// mysqlRateLimitStore keeps state in the rate_limits table, locking the
+// key's row for the duration of each update
+type mysqlRateLimitStore struct {
+	db *sql.DB
+}
+
+func (m mysqlRateLimitStore) Update(ctx context.Context, key string, fn func(*RateLimitState)) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Create the row if needed and take its lock in one statement
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO rate_limits (rl_key) VALUES (?) ON DUPLICATE KEY UPDATE rl_key = rl_key", key,
+	); err != nil {
+		return err
+	}
+
+	var state RateLimitState
+	var updatedAt, lockedUntil sql.NullTime
+	if err := tx.QueryRowContext(ctx,
+		"SELECT tokens, updated_at, failures, locked_until FROM rate_limits WHERE rl_key = ? FOR UPDATE", key,
+	).Scan(&state.Tokens, &updatedAt, &state.Failures, &lockedUntil); err != nil {
+		return err
+	}
+	state.UpdatedAt = updatedAt.Time
+	state.LockedUntil = lockedUntil.Time
+
+	fn(&state)
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE rate_limits SET tokens = ?, updated_at = ?, failures = ?, locked_until = ? WHERE rl_key = ?",
+		state.Tokens, nullTime(state.UpdatedAt), state.Failures, nullTime(state.LockedUntil), key,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m mysqlRateLimitStore) Prune(ctx context.Context, idleSince time.Time) (int64, error) {
+	result, err := m.db.ExecContext(ctx,
+		"DELETE FROM rate_limits WHERE (updated_at IS NULL OR updated_at < ?) AND (locked_until IS NULL OR locked_until < ?)",
+		idleSince, idleSince,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// RateLimiter applies rules to keys held in a store
+type RateLimiter struct {
+	store RateLimitStore
+	now   func() time.Time
+}
+
+var rateLimiter = &RateLimiter{store: newMemoryRateLimitStore(), now: time.Now}
+
+// rateLimitCheck applies a rule to one value, such as a client IP
+type rateLimitCheck struct {
+	rule  RateLimitRule
+	value string
+}
+
+func (c rateLimitCheck) key() string {
+	return c.rule.Name + ":" + c.value
+}
+
+// Take a token for every check. Returns the longest wait if any is exhausted.
+func (l *RateLimiter) Allow(ctx context.Context, checks ...rateLimitCheck) (time.Duration, error) {
+	var wait time.Duration
+	for _, c := range checks {
+		err := l.store.Update(ctx, c.key(), func(s *RateLimitState) {
+			if d := s.take(c.rule, l.now()); d > wait {
+				wait = d
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return wait, nil
+}
+
+// Count a failed attempt against every check
+func (l *RateLimiter) Failure(ctx context.Context, checks ...rateLimitCheck) error {
+	for _, c := range checks {
+		if err := l.store.Update(ctx, c.key(), func(s *RateLimitState) {
+			s.fail(c.rule, l.now())
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clear the failure count of every check
+func (l *RateLimiter) Success(ctx context.Context, checks ...rateLimitCheck) error {
+	for _, c := range checks {
+		if err := l.store.Update(ctx, c.key(), func(s *RateLimitState) {
+			s.Failures = 0
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Throttle a request, writing a 429 response when it must wait. Store
+// errors are logged and let the request through.
+func throttle(w http.ResponseWriter, r *http.Request, checks ...rateLimitCheck) bool {
+	wait, err := rateLimiter.Allow(r.Context(), checks...)
+	if err != nil {
+		log.Println("Rate limit error:", err)
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many attempts, please try again later", http.StatusTooManyRequests)
+	return true
+}
+
+func loginChecks(r *http.Request, username string) []rateLimitCheck {
+	return []rateLimitCheck{
+		{loginIPRule, clientIP(r)},
+		{loginUserRule, strings.ToLower(strings.TrimSpace(username))},
+	}
+}
+
+// Count a failed login against the client IP and the username
+func recordLoginFailure(r *http.Request, checks []rateLimitCheck) {
+	if err := rateLimiter.Failure(r.Context(), checks...); err != nil {
+		log.Println("Rate limit error:", err)
+	}
+}
+
+// How long an idle key is kept. Failure counts are forgotten with it.
+const rateLimitIdleTTL = 24 * time.Hour
+
+// Scheduled job dropping idle limiter state from a shared store
+func rateLimitCleanupJob() Job {
+	return Job{
+		Name:    "rate-limit-cleanup",
+		Spec:    "@hourly",
+		Timeout: 5 * time.Minute,
+		Run: func(ctx context.Context) (string, error) {
+			n, err := rateLimiter.store.Prune(ctx, time.Now().Add(-rateLimitIdleTTL))
+			return fmt.Sprintf("%d rate limit entries removed", n), err
+		},
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestRateLimiter(now *time.Time) *RateLimiter {
+	return &RateLimiter{store: newMemoryRateLimitStore(), now: func() time.Time { return *now }}
+}
+
+// TestRateLimitBucket tests that the bucket empties and refills over time
+func TestRateLimitBucket(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newTestRateLimiter(&now)
+	check := rateLimitCheck{RateLimitRule{Name: "test", Burst: 3, Refill: time.Minute}, "1.2.3.4"}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if wait, _ := limiter.Allow(ctx, check); wait != 0 {
+			t.Fatalf("Attempt %d: expected to be allowed, must wait %v", i+1, wait)
+		}
+	}
+	if wait, _ := limiter.Allow(ctx, check); wait != time.Minute {
+		t.Errorf("Expected to wait 1m for the next token, got %v", wait)
+	}
+
+	now = now.Add(time.Minute)
+	if wait, _ := limiter.Allow(ctx, check); wait != 0 {
+		t.Errorf("Expected a token after refill, must wait %v", wait)
+	}
+
+	// Other keys have their own bucket
+	other := rateLimitCheck{check.rule, "5.6.7.8"}
+	if wait, _ := limiter.Allow(ctx, other); wait != 0 {
+		t.Errorf("Expected another key to be allowed, must wait %v", wait)
+	}
+}
+
+// TestRateLimitProgressiveLockout tests that lockouts double up to the cap
+func TestRateLimitProgressiveLockout(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newTestRateLimiter(&now)
+	rule := RateLimitRule{
+		Name: "test", Burst: 100, Refill: time.Second,
+		LockoutThreshold: 3, LockoutBase: time.Minute, LockoutMax: 5 * time.Minute,
+	}
+	check := rateLimitCheck{rule, "alice"}
+	ctx := context.Background()
+
+	expected := []time.Duration{0, 0, time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, lockout := range expected {
+		limiter.Failure(ctx, check)
+		wait, _ := limiter.Allow(ctx, check)
+		if wait != lockout {
+			t.Errorf("Failure %d: expected lockout %v, got %v", i+1, lockout, wait)
+		}
+		now = now.Add(wait)
+	}
+
+	// A success clears the failure count
+	limiter.Success(ctx, check)
+	limiter.Failure(ctx, check)
+	if wait, _ := limiter.Allow(ctx, check); wait != 0 {
+		t.Errorf("Expected no lockout after success, got %v", wait)
+	}
+}
+
+// TestMemoryRateLimitStorePrune tests that idle unlocked keys are removed
+func TestMemoryRateLimitStorePrune(t *testing.T) {
+	store := newMemoryRateLimitStore()
+	now := time.Now()
+	ctx := context.Background()
+
+	store.Update(ctx, "idle", func(s *RateLimitState) { s.UpdatedAt = now.Add(-48 * time.Hour) })
+	store.Update(ctx, "locked", func(s *RateLimitState) {
+		s.UpdatedAt = now.Add(-48 * time.Hour)
+		s.LockedUntil = now.Add(time.Hour)
+	})
+	store.Update(ctx, "active", func(s *RateLimitState) { s.UpdatedAt = now })
+
+	n, _ := store.Prune(ctx, now.Add(-24*time.Hour))
+	if n != 1 {
+		t.Errorf("Expected 1 key pruned, got %d", n)
+	}
+	if _, ok := store.states["idle"]; ok {
+		t.Error("Expected idle key to be pruned")
+	}
+}
+
+// TestLoginHandlerThrottled tests that exhausted clients get 429 with Retry-After
+func TestLoginHandlerThrottled(t *testing.T) {
+	saved := rateLimiter
+	defer func() { rateLimiter = saved }()
+	now := time.Now()
+	rateLimiter = newTestRateLimiter(&now)
+
+	// Exhaust the username's bucket
+	check := rateLimitCheck{loginUserRule, "123456"}
+	for i := 0; i < loginUserRule.Burst; i++ {
+		rateLimiter.Allow(context.Background(), check)
+	}
+
+	req := httptest.NewRequest("POST", "/api/auth/login", bytes.NewBufferString(`{"username":"123456","password":"x"}`))
+	w := httptest.NewRecorder()
+	LoginHandler(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var passwordResetTTL = time.Hour
+
+func init() {
+	if ttl, err := time.ParseDuration(os.Getenv("PASSWORD_RESET_TTL")); err == nil && ttl > 0 {
+		passwordResetTTL = ttl
+	}
+}
+
+var errResetTokenInvalid = errors.New("Invalid or expired reset token")
+
+// Reset requests are throttled by client IP and by the account asked about
+var (
+	forgotIPRule      = RateLimitRule{Name: "forgot:ip", Burst: 10, Refill: 5 * time.Minute}
+	forgotAccountRule = RateLimitRule{Name: "forgot:account", Burst: 3, Refill: 20 * time.Minute}
+)
+
+// Create a single-use reset token for a user. Only its hash is stored and
+// any earlier outstanding tokens are withdrawn.
+func createPasswordReset(userID int, ip string) (string, error) {
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL", userID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO password_resets (user_id, token_hash, expires_at, requested_ip) VALUES (?, ?, ?, ?)",
+		userID, hashToken(token), time.Now().Add(passwordResetTTL), ip,
+	); err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Set a new password and sign the user out everywhere
+func changePassword(tx *sql.Tx, userID int, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET password = ? WHERE id = ?", hash, userID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL", userID)
+	return err
+}
+
+// Request a password reset email. The response is the same whether or
+// not the account exists.
+func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email    string `json:"email"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	column, value := "email", strings.TrimSpace(req.Email)
+	if value == "" {
+		column, value = "username", strings.TrimSpace(req.Username)
+	}
+	if value == "" {
+		http.Error(w, "Email or username is required", http.StatusBadRequest)
+		return
+	}
+
+	if throttle(w, r,
+		rateLimitCheck{forgotIPRule, clientIP(r)},
+		rateLimitCheck{forgotAccountRule, strings.ToLower(value)},
+	) {
+		return
+	}
+
+	// Resellers may give several accounts the same email; each gets a link
+	rows, err := db.Query(
+		"SELECT id, username, email FROM users WHERE "+column+" = ? AND status <> 'archived' AND email IS NOT NULL AND email <> '' LIMIT 5",
+		value,
+	)
+	if err != nil {
+		log.Println("Password reset lookup error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	type account struct {
+		id              int
+		username, email string
+	}
+	var accounts []account
+	for rows.Next() {
+		var a account
+		if err := rows.Scan(&a.id, &a.username, &a.email); err != nil {
+			rows.Close()
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, a)
+	}
+	rows.Close()
+
+	for _, a := range accounts {
+		token, err := createPasswordReset(a.id, clientIP(r))
+		if err != nil {
+			log.Println("Password reset error:", err)
+			continue
+		}
+		logActivity(r, Activity{TargetID: a.id, Action: "password.reset_requested"})
+		sendMailAsync(Mail{
+			To:      a.email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf(
+				"A password reset was requested for account %s.\n\nOpen this link to choose a new password:\n%s/reset-password.html?token=%s\n\nThe link expires in %s and can be used once. If you did not ask for this, ignore this email.\n",
+				a.username, appURL, url.QueryEscape(token), passwordResetTTL,
+			),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If the account exists and has an email address, a reset link has been sent",
+	})
+}
+
+// Set a new password using a reset token
+func ResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var username, email string
+	err = tx.QueryRow(
+		`SELECT pr.user_id, u.username, COALESCE(u.email, '') FROM password_resets pr
+		JOIN users u ON u.id = pr.user_id
+		WHERE pr.token_hash = ? AND pr.used_at IS NULL AND pr.expires_at > NOW() FOR UPDATE`,
+		hashToken(req.Token),
+	).Scan(&userID, &username, &email)
+	if err == sql.ErrNoRows {
+		http.Error(w, errResetTokenInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := passwordPolicy.Validate(req.Password, username, email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := changePassword(tx, userID, req.Password); err != nil {
+		log.Println("Password reset error:", err)
+		http.Error(w, "Password reset error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL", userID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// A locked-out owner who proved control of the mailbox may log in again
+	if err := rateLimiter.Success(r.Context(), rateLimitCheck{loginUserRule, strings.ToLower(username)}); err != nil {
+		log.Println("Rate limit error:", err)
+	}
+
+	logActivity(r, Activity{ActorID: userID, TargetID: userID, Action: "password.reset"})
+	if email != "" {
+		sendMailAsync(passwordChangedMail(email, username))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset; please log in again"})
+}
+
+func passwordChangedMail(email, username string) Mail {
+	return Mail{
+		To:      email,
+		Subject: "Your password was changed",
+		Body: fmt.Sprintf(
+			"The password for account %s was just changed and all sessions were signed out.\n\nIf this was not you, reset your password immediately at %s/reset-password.html.\n",
+			username, appURL,
+		),
+	}
+}
+
+// Purge used and expired reset tokens
+func passwordResetCleanupJob() Job {
+	return Job{
+		Name:    "password-reset-cleanup",
+		Spec:    "@daily",
+		Timeout: 5 * time.Minute,
+		Run: func(ctx context.Context) (string, error) {
+			result, err := db.ExecContext(ctx,
+				"DELETE FROM password_resets WHERE expires_at < NOW() - INTERVAL 1 DAY OR used_at < NOW() - INTERVAL 1 DAY")
+			if err != nil {
+				return "", err
+			}
+			n, _ := result.RowsAffected()
+			return fmt.Sprintf("%d reset tokens removed", n), nil
+		},
+	}
+}
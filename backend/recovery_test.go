@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// TestForgotPasswordRequiresIdentifier tests validation before any lookup
+func TestForgotPasswordRequiresIdentifier(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/auth/forgot", bytes.NewBufferString(`{}`))
+	w := httptest.NewRecorder()
+	ForgotPasswordHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+// TestResetLinkPageExists tests that emailed reset links open a real page
+func TestResetLinkPageExists(t *testing.T) {
+	if _, err := os.Stat("../frontend/reset-password.html"); err != nil {
+		t.Errorf("Reset links point at a missing page: %v", err)
+	}
+}
+
+// TestResetPasswordSingleUse tests that a reset token works once and revokes sessions
+func TestResetPasswordSingleUse(t *testing.T) {
+	testDB := openTestDB(t)
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, email, status, expires_at) VALUES (?, 'old-password', 'user', 'reset@test.local', 'active', '2099-12-31')",
+		"rs"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("User insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	userID := int(id)
+	t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", userID) })
+
+	if _, err := createSession(userID, "user"); err != nil {
+		t.Fatalf("Session creation failed: %v", err)
+	}
+	token, err := createPasswordReset(userID, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Reset creation failed: %v", err)
+	}
+
+	reset := func() int {
+		body := `{"token":"` + token + `","password":"a-new-Passphrase"}`
+		w := httptest.NewRecorder()
+		ResetPasswordHandler(w, httptest.NewRequest("POST", "/api/auth/reset", bytes.NewBufferString(body)))
+		return w.Code
+	}
+
+	if code := reset(); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if code := reset(); code != http.StatusBadRequest {
+		t.Errorf("Expected reused token to be rejected, got %d", code)
+	}
+
+	var active int
+	testDB.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = ? AND revoked_at IS NULL", userID).Scan(&active)
+	if active != 0 {
+		t.Errorf("Expected all sessions revoked, %d remain", active)
+	}
+
+	var stored string
+	testDB.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&stored)
+	if ok, _ := verifyPassword(stored, "a-new-Passphrase"); !ok {
+		t.Error("Expected the new password to be stored")
+	}
+}
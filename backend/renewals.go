@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+var (
+	errUserNotFound    = errors.New("User not found")
+	errPackageRequired = errors.New("A package is required")
+)
+
+type RenewalQuote struct {
+	PackageID  int       `json:"package_id"`
+	OldExpiry  time.Time `json:"old_expires_at"`
+	NewExpiry  time.Time `json:"new_expires_at"`
+	DaysAdded  int       `json:"days_added"`
+	CreditDays int       `json:"credit_days"`
+	Price      float64   `json:"price"`
+	Currency   string    `json:"currency"`
+}
+
+type RenewalRecord struct {
+	ID           int       `json:"id"`
+	ActorID      *int      `json:"actor_id"`
+	Source       string    `json:"source"`
+	OldPackageID *int      `json:"old_package_id"`
+	NewPackageID int       `json:"new_package_id"`
+	OldExpiresAt time.Time `json:"old_expires_at"`
+	NewExpiresAt time.Time `json:"new_expires_at"`
+	DaysAdded    int       `json:"days_added"`
+	CreditDays   int       `json:"credit_days"`
+	Price        float64   `json:"price"`
+	Currency     string    `json:"currency"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Work out a renewal. Renewing the same package adds its days to the later
+// of now or the current expiry. Switching package converts the unused value
+// of the current package into days of the new one.
+func computeRenewal(now, currentExpiry time.Time, current *Package, target Package) RenewalQuote {
+	quote := RenewalQuote{
+		PackageID: target.ID,
+		OldExpiry: currentExpiry,
+		DaysAdded: target.Days,
+		Price:     target.Price,
+		Currency:  target.Currency,
+	}
+
+	base := now
+	if currentExpiry.After(now) {
+		base = currentExpiry
+	}
+
+	switching := current != nil && current.ID != target.ID
+	if switching && currentExpiry.After(now) && current.Currency == target.Currency && current.Days > 0 {
+		remaining := currentExpiry.Sub(now).Hours() / 24
+		credit := remaining
+		if target.Price > 0 {
+			value := remaining / float64(current.Days) * current.Price
+			credit = value / (target.Price / float64(target.Days))
+		}
+		quote.CreditDays = int(math.Floor(credit))
+		base = now
+	}
+
+	quote.NewExpiry = base.AddDate(0, 0, quote.DaysAdded+quote.CreditDays)
+	return quote
+}
+
+// Renew a user inside tx and record the renewal. packageID of 0 renews the
+// user's current package. Reseller renewals may only use reseller-visible packages.
+func applyRenewal(tx *sql.Tx, userID, packageID int, actorID int, source string) (RenewalQuote, error) {
+	var expiresAt sql.NullTime
+	var currentID sql.NullInt64
+	err := tx.QueryRow(
+		"SELECT expires_at, package_id FROM users WHERE id = ? AND role = 'user' FOR UPDATE", userID,
+	).Scan(&expiresAt, &currentID)
+	if err == sql.ErrNoRows {
+		return RenewalQuote{}, errUserNotFound
+	}
+	if err != nil {
+		return RenewalQuote{}, err
+	}
+
+	var current *Package
+	if currentID.Valid {
+		p, err := loadPackage(tx, int(currentID.Int64))
+		if err != nil && err != errPackageNotFound {
+			return RenewalQuote{}, err
+		}
+		if err == nil {
+			current = &p
+		}
+	}
+
+	if packageID == 0 {
+		if current == nil {
+			return RenewalQuote{}, errPackageRequired
+		}
+		packageID = current.ID
+	}
+
+	// Vouchers were paid for when issued, so their package is honoured
+	// even if it has been withdrawn since
+	var target Package
+	if source == "voucher" {
+		target, err = loadPackage(tx, packageID)
+	} else {
+		target, err = loadPurchasablePackage(tx, packageID, source == "reseller")
+	}
+	if err != nil {
+		return RenewalQuote{}, err
+	}
+
+	quote := computeRenewal(time.Now(), expiresAt.Time, current, target)
+
+	// Renewing reactivates accounts the lifecycle lapsed, but never lifts
+	// an admin suspension
+	if _, err := tx.Exec(
+		`UPDATE users SET expires_at = ?, package_id = ?,
+			status = IF(status IN ('expired', 'archived') OR suspension_reason = 'lapsed', 'active', status),
+			suspension_reason = IF(suspension_reason = 'lapsed', NULL, suspension_reason)
+		WHERE id = ?`,
+		quote.NewExpiry, target.ID, userID,
+	); err != nil {
+		return RenewalQuote{}, err
+	}
+
+	var oldPackageID interface{}
+	if currentID.Valid {
+		oldPackageID = currentID.Int64
+	}
+	_, err = tx.Exec(
+		`INSERT INTO renewal_history (user_id, actor_id, source, old_package_id, new_package_id, old_expires_at, new_expires_at, days_added, credit_days, price, currency)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		userID, actorID, source, oldPackageID, target.ID, expiresAt, quote.NewExpiry,
+		quote.DaysAdded, quote.CreditDays, quote.Price, quote.Currency,
+	)
+	if err != nil {
+		return RenewalQuote{}, err
+	}
+	return quote, nil
+}
+
+// Run a renewal in its own transaction and write the response.
+// ownerID restricts the renewal to users owned by that reseller when non-zero.
+func renewUser(w http.ResponseWriter, r *http.Request, userID, ownerID int, source string) {
+	var req struct {
+		PackageID int `json:"package_id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if ownerID != 0 {
+		var owned bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND reseller_id = ?)", userID, ownerID).Scan(&owned)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !owned {
+			http.Error(w, errUserNotFound.Error(), http.StatusNotFound)
+			return
+		}
+	}
+
+	quote, err := applyRenewal(tx, userID, req.PackageID, currentPrincipal(r).UserID, source)
+	switch err {
+	case nil:
+	case errUserNotFound, errPackageNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errPackageRequired, errPackageUnavailable:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		log.Println("Renewal error:", err)
+		http.Error(w, "Renewal error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Renewal error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "user.renew", userID, map[string]interface{}{
+		"source": source, "package_id": quote.PackageID, "new_expires_at": quote.NewExpiry,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"renewal": quote,
+		"message": "Account renewed successfully",
+	})
+}
+
+// User: Renew own account by redeeming a voucher. Expired accounts may
+// still call this; unpaid extensions are left to admins and resellers.
+func RenewAccount(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	checks := []rateLimitCheck{{redeemIPRule, clientIP(r)}}
+	if throttle(w, r, checks...) {
+		return
+	}
+
+	code := normalizeVoucherCode(req.Code)
+	if !validVoucherCode(code) {
+		recordLoginFailure(r, checks)
+		http.Error(w, errVoucherInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+	extendWithVoucher(w, r, code, currentPrincipal(r).UserID, checks)
+}
+
+// Admin: Extend any user
+func AdminExtendUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	renewUser(w, r, userID, 0, "admin")
+}
+
+// Reseller: Extend one of the reseller's own users
+func ResellerExtendUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	principal := currentPrincipal(r)
+	if principal.Role == "admin" {
+		renewUser(w, r, userID, 0, "admin")
+		return
+	}
+	renewUser(w, r, userID, principal.UserID, "reseller")
+}
+
+func writeRenewalHistory(w http.ResponseWriter, userID int) {
+	rows, err := db.Query(
+		`SELECT id, actor_id, source, old_package_id, new_package_id, old_expires_at, new_expires_at, days_added, credit_days, price, currency, created_at
+		FROM renewal_history WHERE user_id = ? ORDER BY id DESC`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []RenewalRecord{}
+	for rows.Next() {
+		var rec RenewalRecord
+		var actorID, oldPackageID sql.NullInt64
+		var oldExpiry sql.NullTime
+		if err := rows.Scan(&rec.ID, &actorID, &rec.Source, &oldPackageID, &rec.NewPackageID, &oldExpiry, &rec.NewExpiresAt,
+			&rec.DaysAdded, &rec.CreditDays, &rec.Price, &rec.Currency, &rec.CreatedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if actorID.Valid {
+			id := int(actorID.Int64)
+			rec.ActorID = &id
+		}
+		if oldPackageID.Valid {
+			id := int(oldPackageID.Int64)
+			rec.OldPackageID = &id
+		}
+		rec.OldExpiresAt = oldExpiry.Time
+		history = append(history, rec)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// User: Get own renewal history
+func GetRenewalHistory(w http.ResponseWriter, r *http.Request) {
+	writeRenewalHistory(w, currentPrincipal(r).UserID)
+}
+
+// Admin: Get a user's renewal history
+func AdminGetRenewalHistory(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	writeRenewalHistory(w, userID)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var renewalNow = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// TestComputeRenewalActive tests that days are added to the current expiry
+func TestComputeRenewalActive(t *testing.T) {
+	pkg := Package{ID: 1, Days: 30, Price: 2.99, Currency: "USD"}
+	expiry := renewalNow.AddDate(0, 0, 10)
+
+	quote := computeRenewal(renewalNow, expiry, &pkg, pkg)
+
+	if !quote.NewExpiry.Equal(expiry.AddDate(0, 0, 30)) {
+		t.Errorf("Expected expiry %v, got %v", expiry.AddDate(0, 0, 30), quote.NewExpiry)
+	}
+	if quote.CreditDays != 0 {
+		t.Errorf("Expected no credit, got %d", quote.CreditDays)
+	}
+}
+
+// TestComputeRenewalLapsed tests that a lapsed account renews from now
+func TestComputeRenewalLapsed(t *testing.T) {
+	pkg := Package{ID: 1, Days: 30, Price: 2.99, Currency: "USD"}
+	expiry := renewalNow.AddDate(0, 0, -5)
+
+	quote := computeRenewal(renewalNow, expiry, &pkg, pkg)
+
+	if !quote.NewExpiry.Equal(renewalNow.AddDate(0, 0, 30)) {
+		t.Errorf("Expected expiry %v, got %v", renewalNow.AddDate(0, 0, 30), quote.NewExpiry)
+	}
+}
+
+// TestComputeRenewalUpgrade tests prorated credit when switching package
+func TestComputeRenewalUpgrade(t *testing.T) {
+	monthly := Package{ID: 1, Days: 30, Price: 3, Currency: "USD"}
+	yearly := Package{ID: 4, Days: 360, Price: 24, Currency: "USD"}
+	expiry := renewalNow.AddDate(0, 0, 15)
+
+	quote := computeRenewal(renewalNow, expiry, &monthly, yearly)
+
+	// 15 unused days of monthly are worth 1.50, which buys 22 days of yearly
+	if quote.CreditDays != 22 {
+		t.Errorf("Expected 22 credit days, got %d", quote.CreditDays)
+	}
+	if !quote.NewExpiry.Equal(renewalNow.AddDate(0, 0, 360+22)) {
+		t.Errorf("Expected expiry %v, got %v", renewalNow.AddDate(0, 0, 382), quote.NewExpiry)
+	}
+}
+
+// TestComputeRenewalWithoutPackage tests renewing a user that never had a package
+func TestComputeRenewalWithoutPackage(t *testing.T) {
+	pkg := Package{ID: 2, Days: 90, Price: 7.99, Currency: "USD"}
+	expiry := renewalNow.AddDate(0, 0, 3)
+
+	quote := computeRenewal(renewalNow, expiry, nil, pkg)
+
+	if !quote.NewExpiry.Equal(expiry.AddDate(0, 0, 90)) {
+		t.Errorf("Expected expiry %v, got %v", expiry.AddDate(0, 0, 90), quote.NewExpiry)
+	}
+}
+
+// TestRenewAccountRequiresVoucher tests that users cannot renew themselves without paying
+func TestRenewAccountRequiresVoucher(t *testing.T) {
+	for _, body := range []string{`{}`, `{"package_id": 1}`, `{"code": "AAAA-BBBB-CCCC-DDDD"}`, `not json`} {
+		req := httptest.NewRequest("POST", "/api/user/renew", strings.NewReader(body))
+		req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: 1, Role: "user"}))
+		w := httptest.NewRecorder()
+		RenewAccount(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+}
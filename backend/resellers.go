@@ -0,0 +1,493 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+var (
+	errNoResellerQuota = errors.New("Reseller has no quota configured")
+	errQuotaExceeded   = errors.New("User quota exceeded")
+)
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Get a reseller's quota and the number of users counted against it
+func resellerQuotaUsage(q queryRower, resellerID int) (quota int, used int, err error) {
+	err = q.QueryRow("SELECT user_quota FROM resellers WHERE user_id = ?", resellerID).Scan(&quota)
+	if err == sql.ErrNoRows {
+		return 0, 0, errNoResellerQuota
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Unredeemed vouchers hold a slot until they become users
+	err = q.QueryRow(
+		"SELECT (SELECT COUNT(*) FROM users WHERE reseller_id = ?) + ("+outstandingVouchersQuery+")",
+		resellerID, resellerID,
+	).Scan(&used)
+	return quota, used, err
+}
+
+// Lock the reseller's quota row for the rest of tx and check that n more
+// users fit. Callers must insert the users in the same transaction.
+func reserveResellerQuota(tx *sql.Tx, resellerID, n int) error {
+	var quota int
+	err := tx.QueryRow("SELECT user_quota FROM resellers WHERE user_id = ? FOR UPDATE", resellerID).Scan(&quota)
+	if err == sql.ErrNoRows {
+		return errNoResellerQuota
+	}
+	if err != nil {
+		return err
+	}
+
+	_, used, err := resellerQuotaUsage(tx, resellerID)
+	if err != nil {
+		return err
+	}
+	if used+n > quota {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+type ResellerResponse struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Status    string    `json:"status"`
+	UserQuota int       `json:"user_quota"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type QuotaChange struct {
+	ID        int       `json:"id"`
+	OldQuota  int       `json:"old_quota"`
+	NewQuota  int       `json:"new_quota"`
+	Reason    string    `json:"reason"`
+	ChangedBy *int      `json:"changed_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const resellerSelect = `SELECT u.id, u.username, COALESCE(u.email, ''), u.status, r.user_quota, r.created_at,
+	(SELECT COUNT(*) FROM users c WHERE c.reseller_id = u.id) +
+	(SELECT COUNT(*) FROM vouchers v JOIN voucher_batches b ON b.id = v.batch_id
+		WHERE b.reseller_id = u.id AND v.redeemed_at IS NULL AND v.revoked_at IS NULL AND b.expires_at > NOW()) AS used
+	FROM resellers r JOIN users u ON u.id = r.user_id`
+
+func scanReseller(row interface{ Scan(...interface{}) error }) (ResellerResponse, error) {
+	var res ResellerResponse
+	err := row.Scan(&res.UserID, &res.Username, &res.Email, &res.Status, &res.UserQuota, &res.CreatedAt, &res.Used)
+	res.Remaining = res.UserQuota - res.Used
+	if res.Remaining < 0 {
+		res.Remaining = 0
+	}
+	return res, err
+}
+
+// Admin: List resellers with quota usage
+func AdminListResellers(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.Query(resellerSelect + " ORDER BY r.created_at DESC")
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	resellers := []ResellerResponse{}
+	for rows.Next() {
+		res, err := scanReseller(rows)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		resellers = append(resellers, res)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resellers)
+}
+
+// Admin: Get a reseller
+func AdminGetReseller(w http.ResponseWriter, r *http.Request) {
+	resellerID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid reseller ID", http.StatusBadRequest)
+		return
+	}
+
+	res, err := scanReseller(db.QueryRow(resellerSelect+" WHERE r.user_id = ?", resellerID))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reseller not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Admin: Create the reseller profile for an existing reseller account
+func AdminCreateReseller(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID    int  `json:"user_id"`
+		UserQuota *int `json:"user_quota"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	quota := defaultResellerQuota
+	if req.UserQuota != nil {
+		quota = *req.UserQuota
+	}
+	if quota < 0 {
+		http.Error(w, "User quota must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	var role string
+	err := db.QueryRow("SELECT role FROM users WHERE id = ?", req.UserID).Scan(&role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if role != "reseller" {
+		http.Error(w, "User is not a reseller", http.StatusBadRequest)
+		return
+	}
+
+	result, err := db.Exec("INSERT IGNORE INTO resellers (user_id, user_quota) VALUES (?, ?)", req.UserID, quota)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Reseller profile already exists", http.StatusConflict)
+		return
+	}
+
+	logPrincipalActivity(r, "reseller.create", req.UserID, map[string]interface{}{"user_quota": quota})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":    req.UserID,
+		"user_quota": quota,
+		"message":    "Reseller created successfully",
+	})
+}
+
+// Admin: Set a reseller's quota to an absolute value
+func AdminSetResellerQuota(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserQuota *int   `json:"user_quota"`
+		Reason    string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserQuota == nil {
+		http.Error(w, "User quota is required", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	changeResellerQuota(w, r, func(old int) int { return *req.UserQuota }, req.Reason)
+}
+
+// Admin: Raise or lower a reseller's quota by a delta
+func AdminAdjustResellerQuota(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Delta  int    `json:"delta"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Delta == 0 {
+		http.Error(w, "A non-zero delta is required", http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, "A reason is required", http.StatusBadRequest)
+		return
+	}
+
+	changeResellerQuota(w, r, func(old int) int { return old + req.Delta }, req.Reason)
+}
+
+// Apply a quota change under a row lock and record it in the audit table
+func changeResellerQuota(w http.ResponseWriter, r *http.Request, next func(old int) int, reason string) {
+	resellerID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid reseller ID", http.StatusBadRequest)
+		return
+	}
+	changedBy := currentPrincipal(r).UserID
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var oldQuota int
+	err = tx.QueryRow("SELECT user_quota FROM resellers WHERE user_id = ? FOR UPDATE", resellerID).Scan(&oldQuota)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reseller not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	newQuota := next(oldQuota)
+	if newQuota < 0 {
+		http.Error(w, "User quota must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE resellers SET user_quota = ? WHERE user_id = ?", newQuota, resellerID); err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO reseller_quota_changes (reseller_id, changed_by, old_quota, new_quota, reason) VALUES (?, ?, ?, ?, ?)",
+		resellerID, changedBy, oldQuota, newQuota, reason,
+	)
+	if err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":   resellerID,
+		"old_quota": oldQuota,
+		"new_quota": newQuota,
+		"message":   "Quota updated successfully",
+	})
+}
+
+// Admin: Quota change history for a reseller
+func AdminResellerQuotaHistory(w http.ResponseWriter, r *http.Request) {
+	resellerID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid reseller ID", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT id, old_quota, new_quota, reason, changed_by, created_at FROM reseller_quota_changes WHERE reseller_id = ? ORDER BY id DESC",
+		resellerID,
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	changes := []QuotaChange{}
+	for rows.Next() {
+		var c QuotaChange
+		var changedBy sql.NullInt64
+		if err := rows.Scan(&c.ID, &c.OldQuota, &c.NewQuota, &c.Reason, &changedBy, &c.CreatedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if changedBy.Valid {
+			id := int(changedBy.Int64)
+			c.ChangedBy = &id
+		}
+		changes = append(changes, c)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+// Admin: Move all of a reseller's users to another reseller
+func AdminTransferResellerUsers(w http.ResponseWriter, r *http.Request) {
+	resellerID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid reseller ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		TargetResellerID int  `json:"target_reseller_id"`
+		Force            bool `json:"force"` // allow exceeding the target's quota
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TargetResellerID == 0 {
+		http.Error(w, "Target reseller is required", http.StatusBadRequest)
+		return
+	}
+	if req.TargetResellerID == resellerID {
+		http.Error(w, "Cannot transfer users to the same reseller", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock both profiles in a stable order to avoid deadlocks
+	rows, err := tx.Query(
+		"SELECT user_id, user_quota FROM resellers WHERE user_id IN (?, ?) ORDER BY user_id FOR UPDATE",
+		resellerID, req.TargetResellerID,
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	quotas := map[int]int{}
+	for rows.Next() {
+		var id, quota int
+		if err := rows.Scan(&id, &quota); err != nil {
+			rows.Close()
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		quotas[id] = quota
+	}
+	rows.Close()
+
+	if _, ok := quotas[resellerID]; !ok {
+		http.Error(w, "Reseller not found", http.StatusNotFound)
+		return
+	}
+	targetQuota, ok := quotas[req.TargetResellerID]
+	if !ok {
+		http.Error(w, "Target reseller not found", http.StatusNotFound)
+		return
+	}
+
+	var moving int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE reseller_id = ?", resellerID).Scan(&moving); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	// The target's unredeemed vouchers hold quota like its users do
+	_, targetUsed, err := resellerQuotaUsage(tx, req.TargetResellerID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if !req.Force && targetUsed+moving > targetQuota {
+		http.Error(w, "Transfer would exceed the target reseller's quota", http.StatusConflict)
+		return
+	}
+
+	result, err := tx.Exec("UPDATE users SET reseller_id = ? WHERE reseller_id = ?", req.TargetResellerID, resellerID)
+	if err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+	moved, _ := result.RowsAffected()
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "reseller.transfer_users", resellerID, map[string]interface{}{
+		"from_reseller_id": resellerID, "to_reseller_id": req.TargetResellerID, "count": moved, "force": req.Force,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transferred": moved,
+		"message":     "Users transferred successfully",
+	})
+}
+
+// Admin: Remove a reseller profile that no longer owns any users
+func AdminDeleteReseller(w http.ResponseWriter, r *http.Request) {
+	resellerID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid reseller ID", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Creating users or vouchers locks this row too, so none can slip in
+	// between the checks and the delete
+	var exists int
+	err = tx.QueryRow("SELECT 1 FROM resellers WHERE user_id = ? FOR UPDATE", resellerID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Reseller not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	var owned, vouchers int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users WHERE reseller_id = ?", resellerID).Scan(&owned); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if owned > 0 {
+		http.Error(w, "Reseller still owns users; transfer them first", http.StatusConflict)
+		return
+	}
+	if err := tx.QueryRow(outstandingVouchersQuery, resellerID).Scan(&vouchers); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if vouchers > 0 {
+		http.Error(w, "Reseller still has unredeemed vouchers; revoke them first", http.StatusConflict)
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM resellers WHERE user_id = ?", resellerID); err != nil {
+		http.Error(w, "Delete error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Delete error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "reseller.delete", resellerID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Reseller deleted successfully"})
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Open the integration database, skipping when none is configured.
+// TEST_DATABASE_DSN must point at a MySQL database loaded with schema.sql.
+func openTestDB(t *testing.T) *sql.DB {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	if !strings.Contains(dsn, "parseTime") {
+		if strings.Contains(dsn, "?") {
+			dsn += "&parseTime=true"
+		} else {
+			dsn += "?parseTime=true"
+		}
+	}
+
+	testDB, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("Database connection error: %v", err)
+	}
+	if err := testDB.Ping(); err != nil {
+		t.Fatalf("Database ping error: %v", err)
+	}
+
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+	})
+	return testDB
+}
+
+// A random suffix keeping usernames unique across test runs
+func testSuffix(t *testing.T) string {
+	suffix, err := randomString("0123456789", 8)
+	if err != nil {
+		t.Fatalf("Random suffix error: %v", err)
+	}
+	return suffix
+}
+
+// TestResellerCreateUserQuotaConcurrency fires parallel creates and checks the quota holds
+func TestResellerCreateUserQuotaConcurrency(t *testing.T) {
+	testDB := openTestDB(t)
+
+	const quota = 5
+	const attempts = 50
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, email, status, expires_at) VALUES (?, 'x', 'reseller', 'quota@test.local', 'active', '2099-12-31')",
+		"qt"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("Reseller insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	resellerID := int(id)
+	t.Cleanup(func() {
+		testDB.Exec("DELETE FROM users WHERE reseller_id = ?", resellerID)
+		testDB.Exec("DELETE FROM users WHERE id = ?", resellerID)
+	})
+
+	if _, err := testDB.Exec("INSERT INTO resellers (user_id, user_quota) VALUES (?, ?)", resellerID, quota); err != nil {
+		t.Fatalf("Quota insert failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/api/reseller/create-user", bytes.NewBufferString(`{"expiry_days": 30}`))
+			req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: resellerID, Role: "reseller"}))
+			w := httptest.NewRecorder()
+			ResellerCreateUser(w, req)
+
+			if w.Code == http.StatusOK {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM users WHERE reseller_id = ?", resellerID).Scan(&count)
+
+	if created != quota || count != quota {
+		t.Errorf("Expected exactly %d users, got %d successful responses and %d rows", quota, created, count)
+	}
+}
+
+// TestResellerCreateUserWithoutQuotaRow tests that a missing resellers row is an explicit error
+func TestResellerCreateUserWithoutQuotaRow(t *testing.T) {
+	testDB := openTestDB(t)
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, email, status, expires_at) VALUES (?, 'x', 'reseller', 'noquota@test.local', 'active', '2099-12-31')",
+		"nq"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("Reseller insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+
+	req, _ := http.NewRequest("POST", "/api/reseller/create-user", bytes.NewBufferString(`{"expiry_days": 30}`))
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: int(id), Role: "reseller"}))
+	w := httptest.NewRecorder()
+	ResellerCreateUser(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", w.Code)
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte(errNoResellerQuota.Error())) {
+		t.Errorf("Expected quota error, got %q", w.Body.String())
+	}
+}
+
+// Call an admin reseller handler on resellerID
+func callResellerAdmin(h http.HandlerFunc, adminID, resellerID int, body string) *httptest.ResponseRecorder {
+	id := strconv.Itoa(resellerID)
+	req := httptest.NewRequest("POST", "/api/admin/resellers/"+id, strings.NewReader(body))
+	req = mux.SetURLVars(req, map[string]string{"id": id})
+	req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: adminID, Role: "admin"}))
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+// TestSetResellerQuotaRequiresReason tests that absolute quota changes are explained
+func TestSetResellerQuotaRequiresReason(t *testing.T) {
+	w := callResellerAdmin(AdminSetResellerQuota, 1, 2, `{"user_quota": 10}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+// TestResellerQuotaManagement tests usage counts, quota changes with their
+// history and transferring users between resellers
+func TestResellerQuotaManagement(t *testing.T) {
+	testDB := openTestDB(t)
+
+	insertUser := func(role string, resellerID interface{}) int {
+		result, err := testDB.Exec(
+			"INSERT INTO users (username, password, role, status, expires_at, reseller_id) VALUES (?, 'x', ?, 'active', '2099-12-31', ?)",
+			"rq"+testSuffix(t), role, resellerID,
+		)
+		if err != nil {
+			t.Fatalf("User insert failed: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+		return int(id)
+	}
+
+	admin := insertUser("admin", nil)
+	source := insertUser("reseller", nil)
+	target := insertUser("reseller", nil)
+	t.Cleanup(func() { testDB.Exec("DELETE FROM activity_logs WHERE target_id IN (?, ?)", source, target) })
+	for _, id := range []int{source, target} {
+		body := `{"user_id": ` + strconv.Itoa(id) + `, "user_quota": 5}`
+		req := httptest.NewRequest("POST", "/api/admin/resellers", strings.NewReader(body))
+		req = req.WithContext(withPrincipal(req.Context(), Principal{UserID: admin, Role: "admin"}))
+		w := httptest.NewRecorder()
+		AdminCreateReseller(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Create reseller failed: %d %s", w.Code, w.Body.String())
+		}
+	}
+	customers := []int{insertUser("user", source), insertUser("user", source)}
+
+	// Listing counts each reseller's users
+	req := httptest.NewRequest("GET", "/api/admin/resellers", nil)
+	w := httptest.NewRecorder()
+	AdminListResellers(w, req)
+	var list []ResellerResponse
+	json.NewDecoder(w.Body).Decode(&list)
+	found := false
+	for _, res := range list {
+		if res.UserID == source {
+			found = true
+			if res.UserQuota != 5 || res.Used != 2 || res.Remaining != 3 {
+				t.Errorf("Expected quota 5, used 2, remaining 3, got %+v", res)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Reseller missing from the list")
+	}
+
+	// Set, then adjust, each recorded in the history
+	if w := callResellerAdmin(AdminSetResellerQuota, admin, target, `{"user_quota": 1, "reason": "trial"}`); w.Code != http.StatusOK {
+		t.Fatalf("Set quota failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := callResellerAdmin(AdminAdjustResellerQuota, admin, target, `{"delta": -2, "reason": "oops"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a negative quota to be refused, got %d", w.Code)
+	}
+	if w := callResellerAdmin(AdminAdjustResellerQuota, admin, target, `{"delta": 4, "reason": "upgrade"}`); w.Code != http.StatusOK {
+		t.Fatalf("Adjust quota failed: %d %s", w.Code, w.Body.String())
+	}
+
+	w = callResellerAdmin(AdminResellerQuotaHistory, admin, target, "")
+	var history []QuotaChange
+	json.NewDecoder(w.Body).Decode(&history)
+	if len(history) != 2 {
+		t.Fatalf("Expected 2 quota changes, got %d", len(history))
+	}
+	if h := history[0]; h.OldQuota != 1 || h.NewQuota != 5 || h.Reason != "upgrade" || h.ChangedBy == nil || *h.ChangedBy != admin {
+		t.Errorf("Unexpected latest change: %+v", h)
+	}
+	if h := history[1]; h.OldQuota != 5 || h.NewQuota != 1 || h.Reason != "trial" {
+		t.Errorf("Unexpected first change: %+v", h)
+	}
+
+	// The target's outstanding vouchers count against the transfer
+	var packageID int
+	if err := testDB.QueryRow("SELECT id FROM packages LIMIT 1").Scan(&packageID); err != nil {
+		t.Skip("No package available")
+	}
+	result, err := testDB.Exec(
+		"INSERT INTO voucher_batches (package_id, reseller_id, quantity, expires_at) VALUES (?, ?, 4, NOW() + INTERVAL 1 DAY)",
+		packageID, target,
+	)
+	if err != nil {
+		t.Fatalf("Batch insert failed: %v", err)
+	}
+	batchID, _ := result.LastInsertId()
+	t.Cleanup(func() { testDB.Exec("DELETE FROM voucher_batches WHERE id = ?", batchID) })
+	for i := 0; i < 4; i++ {
+		if _, err := testDB.Exec("INSERT INTO vouchers (batch_id, code_hash) VALUES (?, ?)", batchID, hashToken("rq"+testSuffix(t))); err != nil {
+			t.Fatalf("Voucher insert failed: %v", err)
+		}
+	}
+	transfer := `{"target_reseller_id": ` + strconv.Itoa(target) + `}`
+	if w := callResellerAdmin(AdminTransferResellerUsers, admin, source, transfer); w.Code != http.StatusConflict {
+		t.Errorf("Expected outstanding vouchers to block the transfer, got %d", w.Code)
+	}
+	testDB.Exec("UPDATE vouchers SET revoked_at = NOW() WHERE batch_id = ?", batchID)
+
+	// Transfer moves every user and is audited
+	if w := callResellerAdmin(AdminTransferResellerUsers, admin, source, transfer); w.Code != http.StatusOK {
+		t.Fatalf("Transfer failed: %d %s", w.Code, w.Body.String())
+	}
+	for _, id := range customers {
+		var owner int
+		testDB.QueryRow("SELECT reseller_id FROM users WHERE id = ?", id).Scan(&owner)
+		if owner != target {
+			t.Errorf("User %d: expected reseller %d, got %d", id, target, owner)
+		}
+	}
+
+	var details string
+	err = testDB.QueryRow(
+		"SELECT details FROM activity_logs WHERE action = 'reseller.transfer_users' AND actor_id = ? AND target_id = ?",
+		admin, source,
+	).Scan(&details)
+	if err != nil {
+		t.Fatalf("Transfer not audited: %v", err)
+	}
+	var logged struct {
+		From  int `json:"from_reseller_id"`
+		To    int `json:"to_reseller_id"`
+		Count int `json:"count"`
+	}
+	json.Unmarshal([]byte(details), &logged)
+	if logged.From != source || logged.To != target || logged.Count != 2 {
+		t.Errorf("Unexpected audit details: %s", details)
+	}
+
+	// Only a profile without users or vouchers can be deleted, and the
+	// delete is audited
+	if w := callResellerAdmin(AdminDeleteReseller, admin, target, ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected a reseller with users to be kept, got %d", w.Code)
+	}
+	if w := callResellerAdmin(AdminDeleteReseller, admin, source, ""); w.Code != http.StatusOK {
+		t.Fatalf("Delete reseller failed: %d %s", w.Code, w.Body.String())
+	}
+	if w := callResellerAdmin(AdminDeleteReseller, admin, source, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a second delete to find nothing, got %d", w.Code)
+	}
+
+	var created, deleted int
+	testDB.QueryRow("SELECT COUNT(*) FROM activity_logs WHERE action = 'reseller.create' AND target_id IN (?, ?)", source, target).Scan(&created)
+	testDB.QueryRow("SELECT COUNT(*) FROM activity_logs WHERE action = 'reseller.delete' AND target_id = ?", source).Scan(&deleted)
+	if created != 2 || deleted != 1 {
+		t.Errorf("Expected 2 create and 1 delete entries, got %d and %d", created, deleted)
+	}
+}
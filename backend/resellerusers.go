@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+var (
+	errSuspendedByAdmin = errors.New("User was suspended by an administrator")
+	errNotSuspended     = errors.New("User is not suspended")
+	errCannotSuspend    = errors.New("User cannot be suspended in its current status")
+)
+
+// Resolve the {id} of a customer the caller may manage: a reseller's own
+// users, or any end user for an admin. Writes the error response and
+// returns false when the user is missing or belongs to someone else.
+func ownedCustomer(w http.ResponseWriter, r *http.Request) (userID int, ok bool) {
+	userID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, false
+	}
+
+	principal := currentPrincipal(r)
+	query, args := "SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND role = 'user' AND reseller_id = ?)", []interface{}{userID, principal.UserID}
+	if principal.Role == "admin" {
+		query, args = "SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND role = 'user')", []interface{}{userID}
+	}
+
+	var owned bool
+	if err := db.QueryRow(query, args...).Scan(&owned); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return 0, false
+	}
+	if !owned {
+		http.Error(w, errUserNotFound.Error(), http.StatusNotFound)
+		return 0, false
+	}
+	return userID, true
+}
+
+// Reseller: Suspend one of the reseller's own users. The suspension is
+// recorded as the reseller's so it cannot lift one imposed by an admin.
+func ResellerSuspendUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := ownedCustomer(w, r)
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec(
+		"UPDATE users SET status = 'suspended', suspension_reason = 'reseller' WHERE id = ? AND status IN ('active', 'expired')",
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, errCannotSuspend.Error(), http.StatusConflict)
+		return
+	}
+
+	if err := revokeUserSessions(userID); err != nil {
+		http.Error(w, "Session revocation error", http.StatusInternalServerError)
+		return
+	}
+	if err := revokeUserCertificates(userID); err != nil {
+		log.Println("Certificate revocation error:", err)
+		http.Error(w, "Certificate revocation error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "reseller.suspend_user", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "User suspended successfully"})
+}
+
+// Reseller: Lift a suspension the reseller imposed. Users past their
+// expiry return to expired and need an extension to log in.
+func ResellerActivateUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := ownedCustomer(w, r)
+	if !ok {
+		return
+	}
+
+	var status string
+	var reason sql.NullString
+	if err := db.QueryRow("SELECT status, suspension_reason FROM users WHERE id = ?", userID).Scan(&status, &reason); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	switch {
+	case status != "suspended":
+		http.Error(w, errNotSuspended.Error(), http.StatusConflict)
+		return
+	case reason.String != "reseller":
+		http.Error(w, errSuspendedByAdmin.Error(), http.StatusForbidden)
+		return
+	}
+
+	result, err := db.Exec(
+		`UPDATE users SET status = IF(expires_at IS NOT NULL AND expires_at < NOW(), 'expired', 'active'), suspension_reason = NULL
+		WHERE id = ? AND status = 'suspended' AND suspension_reason = 'reseller'`,
+		userID,
+	)
+	if err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, errNotSuspended.Error(), http.StatusConflict)
+		return
+	}
+
+	logPrincipalActivity(r, "reseller.activate_user", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "User activated successfully"})
+}
+
+// Reseller: Replace a user's password with a generated one and sign them
+// out. The new password is returned once so it can be passed on.
+func ResellerResetUserPassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := ownedCustomer(w, r)
+	if !ok {
+		return
+	}
+
+	password, err := generatePassword("user")
+	if err != nil {
+		http.Error(w, "Credential generation error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var username string
+	var email sql.NullString
+	if err := tx.QueryRow("SELECT username, email FROM users WHERE id = ? FOR UPDATE", userID).Scan(&username, &email); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if err := changePassword(tx, userID, password); err != nil {
+		log.Println("Password reset error:", err)
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+
+	if email.String != "" {
+		sendMailAsync(passwordChangedMail(email.String, username))
+	}
+	logPrincipalActivity(r, "reseller.reset_password", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user_id":  userID,
+		"username": username,
+		"password": password,
+		"message":  "Password reset successfully",
+	})
+}
+
+// Reseller: Delete one of the reseller's own users, freeing its quota slot
+func ResellerDeleteUser(w http.ResponseWriter, r *http.Request) {
+	userID, ok := ownedCustomer(w, r)
+	if !ok {
+		return
+	}
+
+	var username string
+	db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username)
+
+	if err := revokeUserCertificates(userID); err != nil {
+		log.Println("Certificate revocation error:", err)
+		http.Error(w, "Certificate revocation error", http.StatusInternalServerError)
+		return
+	}
+
+	// Sessions are removed by the foreign key cascade
+	if _, err := db.Exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+		http.Error(w, "Delete error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "reseller.delete_user", userID, map[string]interface{}{"username": username})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "User deleted successfully"})
+}
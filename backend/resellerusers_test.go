@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// Call a reseller customer action on userID as principal
+func callCustomerAction(h http.HandlerFunc, principal Principal, userID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "/api/reseller/users/"+userID, nil)
+	req = mux.SetURLVars(req, map[string]string{"id": userID})
+	req = req.WithContext(withPrincipal(req.Context(), principal))
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+// TestOwnedCustomerInvalidID tests that a malformed ID is rejected before querying
+func TestOwnedCustomerInvalidID(t *testing.T) {
+	w := callCustomerAction(ResellerSuspendUser, Principal{UserID: 1, Role: "reseller"}, "abc")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+// TestResellerCustomerActions tests ownership and the suspension rules
+func TestResellerCustomerActions(t *testing.T) {
+	testDB := openTestDB(t)
+
+	insertUser := func(role string, resellerID interface{}) int {
+		result, err := testDB.Exec(
+			"INSERT INTO users (username, password, role, status, expires_at, reseller_id) VALUES (?, 'x', ?, 'active', '2099-12-31', ?)",
+			"rc"+testSuffix(t), role, resellerID,
+		)
+		if err != nil {
+			t.Fatalf("User insert failed: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+		return int(id)
+	}
+
+	owner := Principal{UserID: insertUser("reseller", nil), Role: "reseller"}
+	other := Principal{UserID: insertUser("reseller", nil), Role: "reseller"}
+	customer := strconv.Itoa(insertUser("user", owner.UserID))
+
+	if w := callCustomerAction(ResellerSuspendUser, other, customer); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another reseller to get 404, got %d", w.Code)
+	}
+
+	if w := callCustomerAction(ResellerSuspendUser, owner, customer); w.Code != http.StatusOK {
+		t.Fatalf("Expected suspend to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := callCustomerAction(ResellerActivateUser, owner, customer); w.Code != http.StatusOK {
+		t.Fatalf("Expected activate to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// An admin suspension stays in place
+	testDB.Exec("UPDATE users SET status = 'suspended', suspension_reason = 'admin' WHERE id = ?", customer)
+	if w := callCustomerAction(ResellerActivateUser, owner, customer); w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for an admin suspension, got %d", w.Code)
+	}
+
+	if w := callCustomerAction(ResellerResetUserPassword, owner, customer); w.Code != http.StatusOK {
+		t.Errorf("Expected password reset to succeed, got %d", w.Code)
+	}
+
+	if w := callCustomerAction(ResellerDeleteUser, other, customer); w.Code != http.StatusNotFound {
+		t.Errorf("Expected another reseller to get 404, got %d", w.Code)
+	}
+	if w := callCustomerAction(ResellerDeleteUser, owner, customer); w.Code != http.StatusOK {
+		t.Fatalf("Expected delete to succeed, got %d", w.Code)
+	}
+	if err := testDB.QueryRow("SELECT id FROM users WHERE id = ?", customer).Scan(new(int)); err != sql.ErrNoRows {
+		t.Errorf("Expected user to be deleted, got %v", err)
+	}
+}
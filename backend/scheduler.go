@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Job is a unit of scheduled background work. Run returns a short summary
+// that is stored as the job's last result.
+type Job struct {
+	Name     string
+	Spec     string
+	Timeout  time.Duration
+	Run      func(ctx context.Context) (string, error)
+	schedule Schedule
+}
+
+// JobState is the persisted record of a job's runs
+type JobState struct {
+	Name       string     `json:"name"`
+	Spec       string     `json:"schedule"`
+	LastRunAt  *time.Time `json:"last_run_at"`
+	LastStatus string     `json:"last_status"` // success, error
+	LastResult string     `json:"last_result"`
+	LastError  string     `json:"last_error,omitempty"`
+	DurationMs int64      `json:"last_duration_ms"`
+	NextRunAt  *time.Time `json:"next_run_at"`
+	RunBy      string     `json:"run_by"`
+}
+
+// JobStore persists job state shared by all replicas
+type JobStore interface {
+	Load(ctx context.Context, name string) (JobState, bool, error)
+	Save(ctx context.Context, state JobState) error
+}
+
+// JobLocker elects a single replica to run a job. release must be called
+// once the job has finished.
+type JobLocker interface {
+	TryLock(ctx context.Context, name string) (release func(), ok bool, err error)
+}
+
+// Scheduler runs jobs on their schedules. Every replica runs a scheduler;
+// the locker and the persisted next run time ensure each due run happens once.
+type Scheduler struct {
+	store    JobStore
+	locker   JobLocker
+	instance string
+	poll     time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	jobs    []*Job
+	running map[string]bool
+	wg      sync.WaitGroup
+}
+
+func NewScheduler(store JobStore, locker JobLocker) *Scheduler {
+	host, _ := os.Hostname()
+	return &Scheduler{
+		store:    store,
+		locker:   locker,
+		instance: fmt.Sprintf("%s:%d", host, os.Getpid()),
+		poll:     30 * time.Second,
+		now:      time.Now,
+		running:  map[string]bool{},
+	}
+}
+
+// Register a job, validating its schedule
+func (s *Scheduler) Add(job Job) error {
+	schedule, err := parseSchedule(job.Spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %v", job.Name, err)
+	}
+	job.schedule = schedule
+	if job.Timeout <= 0 {
+		job.Timeout = 10 * time.Minute
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job)
+	return nil
+}
+
+// Poll for due jobs until ctx is done, then wait for running jobs to finish
+func (s *Scheduler) Start(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(s.poll)
+		defer ticker.Stop()
+
+		for {
+			s.RunDue(ctx)
+			select {
+			case <-ctx.Done():
+				s.wg.Wait()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Start every due job that is not already running in this process.
+// Jobs run in the background; RunDue does not wait for them.
+func (s *Scheduler) RunDue(ctx context.Context) {
+	s.mu.Lock()
+	jobs := append([]*Job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	for _, job := range jobs {
+		if !s.claimLocal(job.Name) {
+			continue
+		}
+		s.wg.Add(1)
+		go func(job *Job) {
+			defer s.wg.Done()
+			defer s.releaseLocal(job.Name)
+			if err := s.runIfDue(ctx, job); err != nil && ctx.Err() == nil {
+				log.Printf("Scheduler: job %s: %v", job.Name, err)
+			}
+		}(job)
+	}
+}
+
+func (s *Scheduler) claimLocal(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running[name] {
+		return false
+	}
+	s.running[name] = true
+	return true
+}
+
+func (s *Scheduler) releaseLocal(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, name)
+}
+
+func (s *Scheduler) isDue(ctx context.Context, job *Job) (bool, error) {
+	state, found, err := s.store.Load(ctx, job.Name)
+	if err != nil {
+		return false, err
+	}
+	// A job with no recorded state runs straight away
+	return !found || state.NextRunAt == nil || !s.now().Before(*state.NextRunAt), nil
+}
+
+func (s *Scheduler) runIfDue(ctx context.Context, job *Job) error {
+	if due, err := s.isDue(ctx, job); err != nil || !due {
+		return err
+	}
+
+	release, ok, err := s.locker.TryLock(ctx, job.Name)
+	if err != nil || !ok {
+		return err
+	}
+	defer release()
+
+	// Another replica may have run the job between the check and the lock
+	if due, err := s.isDue(ctx, job); err != nil || !due {
+		return err
+	}
+
+	started := s.now()
+	runCtx, cancel := context.WithTimeout(ctx, job.Timeout)
+	result, runErr := job.Run(runCtx)
+	cancel()
+
+	state := JobState{
+		Name:       job.Name,
+		Spec:       job.Spec,
+		LastRunAt:  &started,
+		LastStatus: "success",
+		LastResult: result,
+		DurationMs: s.now().Sub(started).Milliseconds(),
+		RunBy:      s.instance,
+	}
+	if runErr != nil {
+		state.LastStatus = "error"
+		state.LastError = runErr.Error()
+	}
+	if next := job.schedule.Next(started); !next.IsZero() {
+		state.NextRunAt = &next
+	}
+
+	// Record the run even if shutdown cancelled ctx mid-job
+	saveCtx, cancelSave := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelSave()
+	return s.store.Save(saveCtx, state)
+}
+
+// Registered jobs merged with their persisted state
+func (s *Scheduler) Status(ctx context.Context) ([]JobState, error) {
+	s.mu.Lock()
+	jobs := append([]*Job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	states := make([]JobState, 0, len(jobs))
+	for _, job := range jobs {
+		state, found, err := s.store.Load(ctx, job.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			state = JobState{Name: job.Name}
+		}
+		state.Spec = job.Spec
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// mysqlJobStore keeps job state in the scheduled_jobs table
+type mysqlJobStore struct {
+	db *sql.DB
+}
+
+func (m mysqlJobStore) Load(ctx context.Context, name string) (JobState, bool, error) {
+	var state JobState
+	var lastRun, nextRun sql.NullTime
+	var status, result, lastErr, runBy sql.NullString
+	var duration sql.NullInt64
+
+	err := m.db.QueryRowContext(ctx,
+		`SELECT name, schedule, last_run_at, last_status, last_result, last_error, last_duration_ms, next_run_at, run_by
+		FROM scheduled_jobs WHERE name = ?`, name,
+	).Scan(&state.Name, &state.Spec, &lastRun, &status, &result, &lastErr, &duration, &nextRun, &runBy)
+	if err == sql.ErrNoRows {
+		return JobState{}, false, nil
+	}
+	if err != nil {
+		return JobState{}, false, err
+	}
+
+	if lastRun.Valid {
+		state.LastRunAt = &lastRun.Time
+	}
+	if nextRun.Valid {
+		state.NextRunAt = &nextRun.Time
+	}
+	state.LastStatus = status.String
+	state.LastResult = result.String
+	state.LastError = lastErr.String
+	state.DurationMs = duration.Int64
+	state.RunBy = runBy.String
+	return state, true, nil
+}
+
+func (m mysqlJobStore) Save(ctx context.Context, state JobState) error {
+	_, err := m.db.ExecContext(ctx,
+		`INSERT INTO scheduled_jobs (name, schedule, last_run_at, last_status, last_result, last_error, last_duration_ms, next_run_at, run_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE schedule = VALUES(schedule), last_run_at = VALUES(last_run_at), last_status = VALUES(last_status),
+			last_result = VALUES(last_result), last_error = VALUES(last_error), last_duration_ms = VALUES(last_duration_ms),
+			next_run_at = VALUES(next_run_at), run_by = VALUES(run_by)`,
+		state.Name, state.Spec, state.LastRunAt, state.LastStatus, state.LastResult, state.LastError,
+		state.DurationMs, state.NextRunAt, state.RunBy,
+	)
+	return err
+}
+
+// mysqlJobLocker uses GET_LOCK advisory locks. They belong to a connection,
+// so each lock pins a dedicated connection until released.
+type mysqlJobLocker struct {
+	db *sql.DB
+}
+
+func (m mysqlJobLocker) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	key := "vpn-management:job:" + name
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", key).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	if acquired.Int64 != 1 {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	release := func() {
+		conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", key)
+		conn.Close()
+	}
+	return release, true, nil
+}
+
+var jobScheduler *Scheduler
+
+// Admin: List scheduled jobs and their last results
+func AdminListJobs(w http.ResponseWriter, r *http.Request) {
+	if jobScheduler == nil {
+		http.Error(w, "Scheduler not running", http.StatusServiceUnavailable)
+		return
+	}
+
+	states, err := jobScheduler.Status(r.Context())
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(states)
+}
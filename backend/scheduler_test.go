@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type memoryJobStore struct {
+	mu     sync.Mutex
+	states map[string]JobState
+}
+
+func (m *memoryJobStore) Load(ctx context.Context, name string) (JobState, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	state, ok := m.states[name]
+	return state, ok, nil
+}
+
+func (m *memoryJobStore) Save(ctx context.Context, state JobState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.states[state.Name] = state
+	return nil
+}
+
+type memoryJobLocker struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func (m *memoryJobLocker) TryLock(ctx context.Context, name string) (func(), bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held[name] {
+		return nil, false, nil
+	}
+	m.held[name] = true
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.held, name)
+	}, true, nil
+}
+
+// TestParseScheduleErrors tests that malformed specs are rejected
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "5-1 * * * *", "*/0 * * * *", "@every 1ms", "@every soon"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+// TestCronScheduleNext tests next run calculation for cron expressions
+func TestCronScheduleNext(t *testing.T) {
+	from := time.Date(2026, 3, 14, 10, 17, 30, 0, time.UTC) // a Saturday
+
+	cases := map[string]time.Time{
+		"* * * * *":        time.Date(2026, 3, 14, 10, 18, 0, 0, time.UTC),
+		"*/15 * * * *":     time.Date(2026, 3, 14, 10, 30, 0, 0, time.UTC),
+		"@hourly":          time.Date(2026, 3, 14, 11, 0, 0, 0, time.UTC),
+		"@daily":           time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC),
+		"30 2 * * 1-5":     time.Date(2026, 3, 16, 2, 30, 0, 0, time.UTC),
+		"0 0 1 * *":        time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC),
+		"0 12 * * 7":       time.Date(2026, 3, 15, 12, 0, 0, 0, time.UTC),
+		"0 9 13,20 * 1":    time.Date(2026, 3, 16, 9, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":       time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		"5,10 10-11 * * *": time.Date(2026, 3, 14, 11, 5, 0, 0, time.UTC),
+	}
+	for spec, want := range cases {
+		schedule, err := parseSchedule(spec)
+		if err != nil {
+			t.Errorf("%s: parse failed: %v", spec, err)
+			continue
+		}
+		if got := schedule.Next(from); !got.Equal(want) {
+			t.Errorf("%s: expected %v, got %v", spec, want, got)
+		}
+	}
+}
+
+// TestEverySchedule tests fixed interval schedules
+func TestEverySchedule(t *testing.T) {
+	schedule, err := parseSchedule("@every 90m")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := schedule.Next(from); !got.Equal(from.Add(90 * time.Minute)) {
+		t.Errorf("Expected %v, got %v", from.Add(90*time.Minute), got)
+	}
+}
+
+// TestSchedulerRunsOnceAcrossReplicas tests that replicas sharing a store and locker run a due job once
+func TestSchedulerRunsOnceAcrossReplicas(t *testing.T) {
+	store := &memoryJobStore{states: map[string]JobState{}}
+	locker := &memoryJobLocker{held: map[string]bool{}}
+
+	var runs int32
+	job := Job{
+		Name: "test",
+		Spec: "@hourly",
+		Run: func(ctx context.Context) (string, error) {
+			atomic.AddInt32(&runs, 1)
+			time.Sleep(10 * time.Millisecond)
+			return "done", nil
+		},
+	}
+
+	var replicas []*Scheduler
+	for i := 0; i < 5; i++ {
+		s := NewScheduler(store, locker)
+		if err := s.Add(job); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		replicas = append(replicas, s)
+	}
+
+	for round := 0; round < 3; round++ {
+		for _, s := range replicas {
+			s.RunDue(context.Background())
+		}
+		for _, s := range replicas {
+			s.wg.Wait()
+		}
+	}
+
+	if runs != 1 {
+		t.Errorf("Expected 1 run, got %d", runs)
+	}
+
+	state, _, _ := store.Load(context.Background(), "test")
+	if state.LastStatus != "success" || state.LastResult != "done" {
+		t.Errorf("Unexpected state %+v", state)
+	}
+	if state.NextRunAt == nil || !state.NextRunAt.After(*state.LastRunAt) {
+		t.Error("Expected next run after last run")
+	}
+}
+
+// TestSchedulerRecordsErrorsAndTimeouts tests failure state and per-job timeouts
+func TestSchedulerRecordsErrorsAndTimeouts(t *testing.T) {
+	store := &memoryJobStore{states: map[string]JobState{}}
+	s := NewScheduler(store, &memoryJobLocker{held: map[string]bool{}})
+
+	s.Add(Job{
+		Name:    "slow",
+		Spec:    "@every 1m",
+		Timeout: 20 * time.Millisecond,
+		Run: func(ctx context.Context) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		},
+	})
+	s.Add(Job{
+		Name: "failing",
+		Spec: "@every 1m",
+		Run: func(ctx context.Context) (string, error) {
+			return "", errors.New("boom")
+		},
+	})
+
+	s.RunDue(context.Background())
+	s.wg.Wait()
+
+	slow, _, _ := store.Load(context.Background(), "slow")
+	if slow.LastStatus != "error" || slow.LastError != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected timeout error, got %+v", slow)
+	}
+	failing, _, _ := store.Load(context.Background(), "failing")
+	if failing.LastError != "boom" {
+		t.Errorf("Expected boom, got %+v", failing)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+func init() {
+	if ttl, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_TTL")); err == nil && ttl > 0 {
+		accessTokenTTL = ttl
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("REFRESH_TOKEN_TTL")); err == nil && ttl > 0 {
+		refreshTokenTTL = ttl
+	}
+}
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errSessionReused   = errors.New("refresh token reuse detected")
+)
+
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int
+}
+
+// Generate a URL-safe random token of n bytes
+func generateSecureToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Refresh tokens are only ever stored as SHA-256 digests
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create a new session and issue its first token pair
+func createSession(userID int, role string) (TokenPair, error) {
+	sid := make([]byte, 16)
+	if _, err := rand.Read(sid); err != nil {
+		return TokenPair{}, err
+	}
+	sessionID := hex.EncodeToString(sid)
+
+	refreshToken, err := generateSecureToken(32)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO sessions (id, user_id, refresh_token_hash, expires_at) VALUES (?, ?, ?, ?)",
+		sessionID, userID, hashToken(refreshToken), time.Now().Add(refreshTokenTTL),
+	)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	accessToken, err := generateToken(userID, role, sessionID)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// Exchange a refresh token for a new pair, rotating the refresh token.
+// Presenting an already rotated token revokes the whole session.
+func rotateSession(refreshToken string) (TokenPair, User, error) {
+	var user User
+	var sessionID, reusedSessionID string
+	tokenHash := hashToken(refreshToken)
+
+	err := db.QueryRow(
+		`SELECT s.id, u.id, u.username, u.role, u.email, u.status, u.created_at, u.expires_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.refresh_token_hash = ? AND s.revoked_at IS NULL AND s.expires_at > NOW()`,
+		tokenHash,
+	).Scan(&sessionID, &user.ID, &user.Username, &user.Role, &user.Email, &user.Status, &user.CreatedAt, &user.ExpiresAt)
+
+	if err == sql.ErrNoRows {
+		// A rotated token being replayed means it was likely stolen
+		err = db.QueryRow("SELECT id FROM sessions WHERE previous_token_hash = ?", tokenHash).Scan(&reusedSessionID)
+		if err == nil {
+			revokeSession(reusedSessionID)
+			return TokenPair{}, User{}, errSessionReused
+		}
+		return TokenPair{}, User{}, errSessionNotFound
+	}
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+
+	// Expired accounts may keep refreshing so they can reach the renewal endpoints
+	if err := accountStatusError(user.Role, user.Status, user.ExpiresAt); err != nil && err != errAccountExpired {
+		revokeSession(sessionID)
+		return TokenPair{}, User{}, err
+	}
+
+	newRefresh, err := generateSecureToken(32)
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+
+	result, err := db.Exec(
+		`UPDATE sessions SET previous_token_hash = refresh_token_hash, refresh_token_hash = ?, last_used_at = NOW()
+		WHERE id = ? AND refresh_token_hash = ?`,
+		hashToken(newRefresh), sessionID, tokenHash,
+	)
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+	// Lost a race with a concurrent refresh of the same token
+	if n, _ := result.RowsAffected(); n == 0 {
+		return TokenPair{}, User{}, errSessionNotFound
+	}
+
+	accessToken, err := generateToken(user.ID, user.Role, sessionID)
+	if err != nil {
+		return TokenPair{}, User{}, err
+	}
+
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: newRefresh,
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+	}, user, nil
+}
+
+// Check that a session is live and its account may still authenticate.
+// The returned principal reflects the account's current role. For expired
+// accounts both a renewal-only principal and errAccountExpired are returned.
+func validateSession(sessionID string, userID int) (Principal, error) {
+	var role, status string
+	var expiresAt time.Time
+	var resellerID sql.NullInt64
+	var revokedAt sql.NullTime
+
+	err := db.QueryRow(
+		`SELECT u.role, u.status, u.expires_at, u.reseller_id, s.revoked_at
+		FROM sessions s JOIN users u ON u.id = s.user_id
+		WHERE s.id = ? AND s.user_id = ? AND s.expires_at > NOW()`,
+		sessionID, userID,
+	).Scan(&role, &status, &expiresAt, &resellerID, &revokedAt)
+
+	if err == sql.ErrNoRows || revokedAt.Valid {
+		return Principal{}, errSessionNotFound
+	}
+	if err != nil {
+		return Principal{}, err
+	}
+
+	p := Principal{UserID: userID, Role: role, SessionID: sessionID}
+	if resellerID.Valid {
+		id := int(resellerID.Int64)
+		p.ResellerID = &id
+	}
+
+	// Expired accounts keep a renewal-only principal alongside the error
+	switch err := accountStatusError(role, status, expiresAt); err {
+	case nil:
+		return p, nil
+	case errAccountExpired:
+		p.RenewalOnly = true
+		return p, err
+	default:
+		return Principal{}, err
+	}
+}
+
+// Revoke a single session
+func revokeSession(sessionID string) error {
+	_, err := db.Exec("UPDATE sessions SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", sessionID)
+	return err
+}
+
+// Revoke every session belonging to a user
+func revokeUserSessions(userID int) error {
+	_, err := db.Exec("UPDATE sessions SET revoked_at = NOW() WHERE user_id = ? AND revoked_at IS NULL", userID)
+	return err
+}
+
+// Refresh handler
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, user, err := rotateSession(req.RefreshToken)
+	if err != nil {
+		if err != errSessionNotFound && err != errSessionReused &&
+			err != errAccountSuspended && err != errAccountArchived {
+			log.Println("Session refresh error:", err)
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AuthResponse{
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    tokens.ExpiresIn,
+		User:         user,
+	})
+}
+
+// Logout handler
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if err := revokeSession(currentPrincipal(r).SessionID); err != nil {
+		http.Error(w, "Logout error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
+}
+
+// Scheduled job deleting sessions that can no longer be refreshed
+func sessionCleanupJob() Job {
+	return Job{
+		Name:    "session-cleanup",
+		Spec:    "@daily",
+		Timeout: 5 * time.Minute,
+		Run: func(ctx context.Context) (string, error) {
+			result, err := db.ExecContext(ctx,
+				"DELETE FROM sessions WHERE expires_at < NOW() OR revoked_at < NOW() - INTERVAL 7 DAY")
+			if err != nil {
+				return "", err
+			}
+			n, _ := result.RowsAffected()
+			return fmt.Sprintf("%d sessions removed", n), nil
+		},
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+// TestGenerateSecureToken tests that tokens are random and URL safe
+func TestGenerateSecureToken(t *testing.T) {
+	a, err := generateSecureToken(32)
+	if err != nil {
+		t.Fatalf("Token generation failed: %v", err)
+	}
+	b, _ := generateSecureToken(32)
+
+	if a == b {
+		t.Error("Expected distinct tokens")
+	}
+	if len(a) != 43 {
+		t.Errorf("Expected 43 characters, got %d", len(a))
+	}
+}
+
+// TestHashToken tests that refresh tokens hash deterministically
+func TestHashToken(t *testing.T) {
+	if hashToken("abc") != hashToken("abc") {
+		t.Error("Expected stable hash")
+	}
+	if hashToken("abc") == hashToken("abd") {
+		t.Error("Expected distinct hashes")
+	}
+	if len(hashToken("abc")) != 64 {
+		t.Errorf("Expected 64 hex characters, got %d", len(hashToken("abc")))
+	}
+}
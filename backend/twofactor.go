@@ -0,0 +1,692 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TOTP parameters (RFC 6238) understood by every common authenticator app
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // periods accepted either side of now
+
+	recoveryCodeCount     = 10
+	twoFactorChallengeTTL = 5 * time.Minute
+)
+
+var totpIssuer = "VPN Management"
+
+func init() {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		totpIssuer = issuer
+	}
+}
+
+var (
+	errTwoFactorEnabled    = errors.New("Two-factor authentication is already enabled")
+	errTwoFactorNotEnabled = errors.New("Two-factor authentication is not enabled")
+	errTwoFactorNoSetup    = errors.New("Start two-factor setup first")
+	errTwoFactorCode       = errors.New("Invalid authentication code")
+	errTwoFactorRequired   = errors.New("Two-factor authentication is required for this account")
+	errChallengeInvalid    = errors.New("Login challenge is invalid or has expired")
+)
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPad.EncodeToString(b), nil
+}
+
+// Compute the code for one time step (RFC 4226 dynamic truncation)
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// Check code against the steps around now. Steps at or before lastCounter
+// were already used and are refused so a code cannot be replayed. Returns
+// the matched step.
+func validateTOTP(secret, code string, now time.Time, lastCounter int64) (int64, bool) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastCounter {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, uint64(step))), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// The otpauth URI authenticator apps scan as a QR code
+func otpauthURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", totpIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// Recovery codes look like "abcde-fghij" and are stored hashed
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		s, err := randomString(credentialAlphabets["lower"], 10)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(code)), "-", "")
+}
+
+type twoFactorState struct {
+	Secret      string
+	Enabled     bool
+	LastCounter int64
+}
+
+func loadTwoFactor(q queryRower, userID int, lock bool) (twoFactorState, bool, error) {
+	query := "SELECT secret, enabled_at IS NOT NULL, last_counter FROM user_totp WHERE user_id = ?"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	var s twoFactorState
+	err := q.QueryRow(query, userID).Scan(&s.Secret, &s.Enabled, &s.LastCounter)
+	if err == sql.ErrNoRows {
+		return twoFactorState{}, false, nil
+	}
+	return s, err == nil, err
+}
+
+// Two-factor policy, stored in settings so admins can change it at runtime
+type TwoFactorPolicy struct {
+	RequireAdmin    bool `json:"require_admin"`
+	RequireReseller bool `json:"require_reseller"`
+}
+
+func loadTwoFactorPolicy() (TwoFactorPolicy, error) {
+	var p TwoFactorPolicy
+	rows, err := db.Query("SELECT name, value FROM settings WHERE name IN ('require_2fa_admin', 'require_2fa_reseller')")
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return p, err
+		}
+		switch name {
+		case "require_2fa_admin":
+			p.RequireAdmin = value == "true"
+		case "require_2fa_reseller":
+			p.RequireReseller = value == "true"
+		}
+	}
+	return p, rows.Err()
+}
+
+func (p TwoFactorPolicy) requires(role string) bool {
+	return (role == "admin" && p.RequireAdmin) || (role == "reseller" && p.RequireReseller)
+}
+
+// What a staff login needs after its password: "verify" a code, "setup"
+// two-factor because policy requires it, or nothing
+func secondFactorStep(user User) (string, error) {
+	if user.Role != "admin" && user.Role != "reseller" {
+		return "", nil
+	}
+	state, found, err := loadTwoFactor(db, user.ID, false)
+	if err != nil {
+		return "", err
+	}
+	if found && state.Enabled {
+		return "verify", nil
+	}
+	policy, err := loadTwoFactorPolicy()
+	if err != nil {
+		return "", err
+	}
+	if policy.requires(user.Role) {
+		return "setup", nil
+	}
+	return "", nil
+}
+
+// A short-lived token proving the password step succeeded. It carries no
+// session, so it is useless as an access token.
+func issueTwoFactorChallenge(userID int) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"user_id": userID,
+		"typ":     "2fa",
+		"exp":     time.Now().Add(twoFactorChallengeTTL).Unix(),
+	})
+	return token.SignedString(jwtSecret)
+}
+
+func parseTwoFactorChallenge(challenge string) (int, error) {
+	claims, err := verifyToken(challenge)
+	if err != nil {
+		return 0, errChallengeInvalid
+	}
+	userID, _ := claims["user_id"].(float64)
+	if typ, _ := claims["typ"].(string); typ != "2fa" || userID == 0 {
+		return 0, errChallengeInvalid
+	}
+	return int(userID), nil
+}
+
+// Start (or restart) enrollment with a new secret. Enabled accounts must
+// disable two-factor first.
+func beginTwoFactorSetup(userID int) (string, error) {
+	state, found, err := loadTwoFactor(db, userID, false)
+	if err != nil {
+		return "", err
+	}
+	if found && state.Enabled {
+		return "", errTwoFactorEnabled
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(
+		`INSERT INTO user_totp (user_id, secret) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE secret = VALUES(secret), enabled_at = NULL, last_counter = 0`,
+		userID, secret,
+	)
+	return secret, err
+}
+
+// Enable two-factor once the first code checks out. Returns fresh
+// recovery codes, shown to the user this one time.
+func confirmTwoFactorSetup(userID int, code string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	state, found, err := loadTwoFactor(tx, userID, true)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errTwoFactorNoSetup
+	}
+	if state.Enabled {
+		return nil, errTwoFactorEnabled
+	}
+
+	step, ok := validateTOTP(state.Secret, strings.TrimSpace(code), time.Now(), state.LastCounter)
+	if !ok {
+		return nil, errTwoFactorCode
+	}
+	if _, err := tx.Exec("UPDATE user_totp SET enabled_at = NOW(), last_counter = ? WHERE user_id = ?", step, userID); err != nil {
+		return nil, err
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashToken(normalizeRecoveryCode(code)),
+		); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// Check a TOTP code or an unused recovery code for an enabled account.
+// Returns "totp" or "recovery_code".
+func verifySecondFactor(userID int, code string) (string, error) {
+	code = strings.TrimSpace(code)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	state, found, err := loadTwoFactor(tx, userID, true)
+	if err != nil {
+		return "", err
+	}
+	if !found || !state.Enabled {
+		return "", errTwoFactorNotEnabled
+	}
+
+	if step, ok := validateTOTP(state.Secret, code, time.Now(), state.LastCounter); ok {
+		if _, err := tx.Exec("UPDATE user_totp SET last_counter = ? WHERE user_id = ?", step, userID); err != nil {
+			return "", err
+		}
+		return "totp", tx.Commit()
+	}
+
+	result, err := tx.Exec(
+		"UPDATE recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		userID, hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		return "", errTwoFactorCode
+	}
+	return "recovery_code", tx.Commit()
+}
+
+func writeTwoFactorError(w http.ResponseWriter, err error) {
+	switch err {
+	case errTwoFactorCode:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errTwoFactorEnabled, errTwoFactorNotEnabled, errTwoFactorNoSetup, errTwoFactorRequired:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Println("Two-factor error:", err)
+		http.Error(w, "Two-factor error", http.StatusInternalServerError)
+	}
+}
+
+// Second login step. Accounts enrolling because policy requires it first
+// call /api/auth/2fa/setup with the challenge, then confirm their first
+// code here and receive their recovery codes with the tokens.
+func TwoFactorLoginHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+		Code           string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := parseTwoFactorChallenge(req.ChallengeToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := loadLoginUser(userID)
+	if err != nil {
+		http.Error(w, errChallengeInvalid.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Codes are guessed like passwords, so share the login limits
+	checks := loginChecks(r, user.Username)
+	if throttle(w, r, checks...) {
+		return
+	}
+
+	state, found, err := loadTwoFactor(db, userID, false)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	if !found {
+		writeTwoFactorError(w, errTwoFactorNoSetup)
+		return
+	}
+
+	var method string
+	var recoveryCodes []string
+	if !state.Enabled {
+		recoveryCodes, err = confirmTwoFactorSetup(userID, req.Code)
+		method = "setup"
+	} else {
+		method, err = verifySecondFactor(userID, req.Code)
+	}
+	if err == errTwoFactorCode {
+		recordLoginFailure(r, checks)
+		logActivity(r, Activity{TargetID: userID, Action: "login.failure", Details: map[string]interface{}{
+			"username": user.Username, "reason": "bad_2fa_code",
+		}})
+	}
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	if method == "setup" {
+		logActivity(r, Activity{ActorID: userID, TargetID: userID, Action: "2fa.enable"})
+	}
+	completeLogin(w, r, user, checks[1], method, recoveryCodes)
+}
+
+// Begin enrollment during login when policy requires two-factor
+func TwoFactorLoginSetupHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := parseTwoFactorChallenge(req.ChallengeToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	user, err := loadLoginUser(userID)
+	if err != nil {
+		http.Error(w, errChallengeInvalid.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	writeTwoFactorSetup(w, user.ID, user.Username)
+}
+
+func writeTwoFactorSetup(w http.ResponseWriter, userID int, username string) {
+	secret, err := beginTwoFactorSetup(userID)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": otpauthURI(username, secret),
+		"message":     "Scan the URI with an authenticator app, then confirm with a code",
+	})
+}
+
+// Staff: Two-factor status
+func GetTwoFactorStatus(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+	state, found, err := loadTwoFactor(db, principal.UserID, false)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	policy, err := loadTwoFactorPolicy()
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	var remaining int
+	db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", principal.UserID).Scan(&remaining)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":                  found && state.Enabled,
+		"required":                 policy.requires(principal.Role),
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// Staff: Start two-factor enrollment
+func BeginTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+	var username string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = ?", principal.UserID).Scan(&username); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	writeTwoFactorSetup(w, principal.UserID, username)
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// Staff: Confirm enrollment with a first code
+func ConfirmTwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID := currentPrincipal(r).UserID
+	codes, err := confirmTwoFactorSetup(userID, req.Code)
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	logPrincipalActivity(r, "2fa.enable", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recovery_codes": codes,
+		"message":        "Two-factor authentication enabled. Store the recovery codes somewhere safe.",
+	})
+}
+
+// Staff: Disable two-factor with a current code, unless policy requires it
+func DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	principal := currentPrincipal(r)
+	policy, err := loadTwoFactorPolicy()
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	if policy.requires(principal.Role) {
+		writeTwoFactorError(w, errTwoFactorRequired)
+		return
+	}
+	if _, err := verifySecondFactor(principal.UserID, req.Code); err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	if err := resetTwoFactor(principal.UserID); err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	logPrincipalActivity(r, "2fa.disable", principal.UserID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// Staff: Replace recovery codes, confirming with a current code
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var req twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID := currentPrincipal(r).UserID
+	if _, err := verifySecondFactor(userID, req.Code); err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	logPrincipalActivity(r, "2fa.recovery_codes", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recovery_codes": codes})
+}
+
+func resetTwoFactor(userID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Admin: Reset a user's two-factor, e.g. after a lost device. Their
+// sessions are revoked so the next login goes through enrollment.
+func AdminResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := resetTwoFactor(userID); err != nil {
+		writeTwoFactorError(w, err)
+		return
+	}
+	if err := revokeUserSessions(userID); err != nil {
+		http.Error(w, "Session revocation error", http.StatusInternalServerError)
+		return
+	}
+	logPrincipalActivity(r, "2fa.reset", userID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication reset"})
+}
+
+// Revoke the sessions of staff the policy now requires two-factor for but
+// who have not enabled it, so their next login goes through enrollment
+func revokeUnenrolledSessions(policy TwoFactorPolicy) (int64, error) {
+	var roles []interface{}
+	for _, role := range []string{"admin", "reseller"} {
+		if policy.requires(role) {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		return 0, nil
+	}
+
+	result, err := db.Exec(
+		`UPDATE sessions s JOIN users u ON u.id = s.user_id
+		LEFT JOIN user_totp t ON t.user_id = u.id AND t.enabled_at IS NOT NULL
+		SET s.revoked_at = NOW()
+		WHERE s.revoked_at IS NULL AND t.user_id IS NULL AND u.role IN (?`+strings.Repeat(", ?", len(roles)-1)+`)`,
+		roles...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Admin: Get the two-factor policy
+func AdminGetTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := loadTwoFactorPolicy()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// Admin: Require two-factor for the admin and/or reseller roles
+func AdminSetTwoFactorPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy TwoFactorPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	for name, value := range map[string]bool{
+		"require_2fa_admin":    policy.RequireAdmin,
+		"require_2fa_reseller": policy.RequireReseller,
+	} {
+		if _, err := db.Exec(
+			"INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)",
+			name, fmt.Sprint(value),
+		); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	revoked, err := revokeUnenrolledSessions(policy)
+	if err != nil {
+		http.Error(w, "Session revocation error", http.StatusInternalServerError)
+		return
+	}
+	logPrincipalActivity(r, "2fa.policy", 0, map[string]interface{}{
+		"require_admin": policy.RequireAdmin, "require_reseller": policy.RequireReseller,
+		"sessions_revoked": revoked,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTOTPCodeVectors checks the RFC 6238 SHA-1 test vectors, truncated to six digits
+func TestTOTPCodeVectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, expected := range vectors {
+		if code := totpCode(secret, uint64(unix/totpPeriod)); code != expected {
+			t.Errorf("At %d: expected %s, got %s", unix, expected, code)
+		}
+	}
+}
+
+// TestValidateTOTP tests clock skew and replay protection
+func TestValidateTOTP(t *testing.T) {
+	secret := base32NoPad.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+
+	code := totpCode([]byte("12345678901234567890"), uint64(step))
+	got, ok := validateTOTP(secret, code, now, 0)
+	if !ok || got != step {
+		t.Fatalf("Expected current code to validate at step %d, got %d %v", step, got, ok)
+	}
+
+	if _, ok := validateTOTP(secret, code, now, step); ok {
+		t.Error("Expected a used code to be refused")
+	}
+	if _, ok := validateTOTP(secret, code, now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Error("Expected the previous step to be accepted")
+	}
+	if _, ok := validateTOTP(secret, code, now.Add(3*totpPeriod*time.Second), 0); ok {
+		t.Error("Expected a stale code to be refused")
+	}
+	if _, ok := validateTOTP(secret, "12345", now, 0); ok {
+		t.Error("Expected a short code to be refused")
+	}
+}
+
+// TestOtpauthURI tests the URI authenticator apps scan
+func TestOtpauthURI(t *testing.T) {
+	uri := otpauthURI("12345678", "JBSWY3DPEHPK3PXP")
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("Invalid URI %s: %v", uri, err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || !strings.HasSuffix(u.Path, ":12345678") {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+	if u.Query().Get("secret") != "JBSWY3DPEHPK3PXP" || u.Query().Get("issuer") != totpIssuer {
+		t.Errorf("Unexpected parameters in %s", uri)
+	}
+}
+
+// TestTwoFactorChallenge tests that challenges and access tokens are not interchangeable
+func TestTwoFactorChallenge(t *testing.T) {
+	challenge, err := issueTwoFactorChallenge(7)
+	if err != nil {
+		t.Fatalf("Challenge failed: %v", err)
+	}
+	if userID, err := parseTwoFactorChallenge(challenge); err != nil || userID != 7 {
+		t.Errorf("Expected user 7, got %d %v", userID, err)
+	}
+
+	access, _ := generateToken(7, "admin", "session")
+	if _, err := parseTwoFactorChallenge(access); err != errChallengeInvalid {
+		t.Errorf("Expected an access token to be rejected, got %v", err)
+	}
+}
+
+// TestRecoveryCodes tests code format and normalization
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatalf("Generation failed: %v", err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Errorf("Expected %d codes, got %d", recoveryCodeCount, len(codes))
+	}
+	if len(codes[0]) != 11 || codes[0][5] != '-' {
+		t.Errorf("Unexpected code format %q", codes[0])
+	}
+	if normalizeRecoveryCode(" ABCDE-fghij ") != "abcdefghij" {
+		t.Error("Expected codes to be normalized")
+	}
+}
+
+// TestTwoFactorPolicyRequires tests the per-role policy
+func TestTwoFactorPolicyRequires(t *testing.T) {
+	p := TwoFactorPolicy{RequireAdmin: true}
+	if !p.requires("admin") || p.requires("reseller") || p.requires("user") {
+		t.Errorf("Unexpected requirements for %+v", p)
+	}
+}
+
+// TestPolicyRevokesUnenrolledSessions tests that requiring two-factor signs
+// out staff of that role who have not enrolled, and nobody else
+func TestPolicyRevokesUnenrolledSessions(t *testing.T) {
+	testDB := openTestDB(t)
+	suffix := testSuffix(t)
+
+	sessions := map[string]string{}
+	for _, role := range []string{"admin", "reseller"} {
+		result, err := testDB.Exec(
+			"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, 'x', ?, 'active', '2099-12-31')",
+			role[:2]+"2f"+suffix, role,
+		)
+		if err != nil {
+			t.Fatalf("User insert failed: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+
+		tokens, err := createSession(int(id), role)
+		if err != nil {
+			t.Fatalf("Session error: %v", err)
+		}
+		claims, _ := verifyToken(tokens.AccessToken)
+		sessions[role], _ = claims["sid"].(string)
+	}
+
+	if _, err := revokeUnenrolledSessions(TwoFactorPolicy{RequireAdmin: true}); err != nil {
+		t.Fatalf("Revocation failed: %v", err)
+	}
+
+	for role, want := range map[string]bool{"admin": true, "reseller": false} {
+		var revoked bool
+		testDB.QueryRow("SELECT revoked_at IS NOT NULL FROM sessions WHERE id = ?", sessions[role]).Scan(&revoked)
+		if revoked != want {
+			t.Errorf("%s: expected revoked=%v, got %v", role, want, revoked)
+		}
+	}
+}
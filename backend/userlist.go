@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Accounts without an expiry sort after every dated one
+const noExpirySortValue = "9999-12-31 23:59:59"
+
+// Expressions the user lists can be sorted by. id breaks ties so the keyset
+// cursor is unique.
+var userSortColumns = map[string]string{
+	"created_at": "created_at",
+	"expires_at": "COALESCE(expires_at, '" + noExpirySortValue + "')",
+	"username":   "username",
+	"id":         "id",
+}
+
+var userStatuses = map[string]bool{
+	"pending_verification": true, "active": true, "expired": true, "suspended": true, "archived": true,
+}
+
+// userListQuery holds the filters, sort and page of a user list request
+type userListQuery struct {
+	Statuses       []string
+	Role           string
+	ResellerID     int
+	ExpiringWithin int // days
+	Search         string
+	Sort           string
+	Descending     bool
+	Limit          int
+	Cursor         *userCursor
+}
+
+// userCursor is the sort key of the last row on the previous page
+type userCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func (c userCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeUserCursor(s string) (*userCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c userCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Parse list parameters: status (comma separated), role, reseller_id,
+// expiring_within (days), q, sort, order, limit and cursor
+func parseUserListQuery(values url.Values) (userListQuery, error) {
+	q := userListQuery{Sort: "created_at", Descending: true, Limit: 50}
+
+	if s := values.Get("status"); s != "" {
+		for _, status := range strings.Split(s, ",") {
+			if !userStatuses[status] {
+				return q, errors.New("Invalid status " + status)
+			}
+			q.Statuses = append(q.Statuses, status)
+		}
+	}
+
+	switch role := values.Get("role"); role {
+	case "", "admin", "reseller", "user":
+		q.Role = role
+	default:
+		return q, errors.New("Invalid role")
+	}
+
+	for _, f := range []struct {
+		param string
+		dst   *int
+		max   int
+	}{
+		{"reseller_id", &q.ResellerID, math.MaxInt32},
+		{"expiring_within", &q.ExpiringWithin, 3650},
+		{"limit", &q.Limit, 500},
+	} {
+		value := values.Get(f.param)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > f.max {
+			return q, errors.New("Invalid " + f.param)
+		}
+		*f.dst = n
+	}
+
+	q.Search = strings.TrimSpace(values.Get("q"))
+
+	if sort := values.Get("sort"); sort != "" {
+		if _, ok := userSortColumns[sort]; !ok {
+			return q, errors.New("Invalid sort")
+		}
+		q.Sort = sort
+	}
+	switch values.Get("order") {
+	case "":
+	case "asc":
+		q.Descending = false
+	case "desc":
+		q.Descending = true
+	default:
+		return q, errors.New("Invalid order")
+	}
+
+	if c := values.Get("cursor"); c != "" {
+		cursor, err := decodeUserCursor(c)
+		if err != nil || cursor.Sort != q.Sort {
+			return q, errors.New("Invalid cursor")
+		}
+		q.Cursor = cursor
+	}
+	return q, nil
+}
+
+// Escape LIKE wildcards in user input
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Build the WHERE clause, without and with the page cursor
+func (q userListQuery) where() (filter string, args []interface{}, paged string, pagedArgs []interface{}) {
+	clauses := []string{"1 = 1"}
+
+	if len(q.Statuses) > 0 {
+		clauses = append(clauses, "status IN (?"+strings.Repeat(", ?", len(q.Statuses)-1)+")")
+		for _, s := range q.Statuses {
+			args = append(args, s)
+		}
+	}
+	if q.Role != "" {
+		clauses = append(clauses, "role = ?")
+		args = append(args, q.Role)
+	}
+	if q.ResellerID != 0 {
+		clauses = append(clauses, "reseller_id = ?")
+		args = append(args, q.ResellerID)
+	}
+	if q.ExpiringWithin != 0 {
+		clauses = append(clauses, "expires_at BETWEEN NOW() AND NOW() + INTERVAL ? DAY")
+		args = append(args, q.ExpiringWithin)
+	}
+	if q.Search != "" {
+		pattern := "%" + likeEscape(q.Search) + "%"
+		clauses = append(clauses, "(username LIKE ? OR email LIKE ?)")
+		args = append(args, pattern, pattern)
+	}
+	filter = strings.Join(clauses, " AND ")
+
+	paged, pagedArgs = filter, args
+	if q.Cursor != nil {
+		op := ">"
+		if q.Descending {
+			op = "<"
+		}
+		col := userSortColumns[q.Sort]
+		paged += " AND (" + col + " " + op + " ? OR (" + col + " = ? AND id " + op + " ?))"
+		pagedArgs = append(append([]interface{}{}, args...), q.Cursor.Value, q.Cursor.Value, q.Cursor.ID)
+	}
+	return filter, args, paged, pagedArgs
+}
+
+func (q userListQuery) orderBy() string {
+	dir := " ASC"
+	if q.Descending {
+		dir = " DESC"
+	}
+	return userSortColumns[q.Sort] + dir + ", id" + dir
+}
+
+// The cursor value of a row for the current sort
+func (q userListQuery) cursorFor(u UserResponse) userCursor {
+	c := userCursor{Sort: q.Sort, ID: u.ID}
+	switch q.Sort {
+	case "created_at":
+		c.Value = u.CreatedAt.UTC().Format("2006-01-02 15:04:05")
+	case "expires_at":
+		c.Value = noExpirySortValue
+		if !u.ExpiresAt.IsZero() {
+			c.Value = u.ExpiresAt.UTC().Format("2006-01-02 15:04:05")
+		}
+	case "username":
+		c.Value = u.Username
+	case "id":
+		c.Value = strconv.Itoa(u.ID)
+	}
+	return c
+}
+
+// Write one page of users matching the request. A non-zero resellerID
+// restricts the list to that reseller's customers.
+func writeUserList(w http.ResponseWriter, r *http.Request, resellerID int) {
+	q, err := parseUserListQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if resellerID != 0 {
+		q.ResellerID = resellerID
+	}
+
+	filter, args, paged, pagedArgs := q.where()
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE "+filter, args...).Scan(&total); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := db.Query(
+		"SELECT id, username, COALESCE(email, ''), role, status, created_at, expires_at, reseller_id FROM users WHERE "+
+			paged+" ORDER BY "+q.orderBy()+" LIMIT ?",
+		append(pagedArgs, q.Limit+1)...,
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []UserResponse{}
+	for rows.Next() {
+		var user UserResponse
+		var expiresAt sql.NullTime
+		var reseller sql.NullInt64
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Role, &user.Status, &user.CreatedAt, &expiresAt, &reseller); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		user.ExpiresAt = expiresAt.Time
+		if reseller.Valid {
+			id := int(reseller.Int64)
+			user.ResellerID = &id
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{"items": users, "total": total, "next_cursor": nil}
+	if len(users) > q.Limit {
+		users = users[:q.Limit]
+		resp["items"] = users
+		resp["next_cursor"] = q.cursorFor(users[q.Limit-1]).encode()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestParseUserListQuery tests defaults and accepted parameters
+func TestParseUserListQuery(t *testing.T) {
+	q, err := parseUserListQuery(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Sort != "created_at" || !q.Descending || q.Limit != 50 {
+		t.Errorf("Unexpected defaults: %+v", q)
+	}
+
+	values, _ := url.ParseQuery("status=active,expired&role=user&reseller_id=7&expiring_within=14&q=%20bob%20&sort=username&order=asc&limit=10")
+	q, err = parseUserListQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Statuses) != 2 || q.Role != "user" || q.ResellerID != 7 || q.ExpiringWithin != 14 ||
+		q.Search != "bob" || q.Sort != "username" || q.Descending || q.Limit != 10 {
+		t.Errorf("Unexpected query: %+v", q)
+	}
+
+	filter, args, _, _ := q.where()
+	if !strings.Contains(filter, "status IN (?, ?)") || len(args) != 7 {
+		t.Errorf("Unexpected filter %q with %d args", filter, len(args))
+	}
+	if q.orderBy() != "username ASC, id ASC" {
+		t.Errorf("Unexpected order %q", q.orderBy())
+	}
+}
+
+// TestUserCursorRoundTrip tests that a page cursor resumes after its row
+func TestUserCursorRoundTrip(t *testing.T) {
+	q := userListQuery{Sort: "expires_at", Descending: true}
+	cursor := q.cursorFor(UserResponse{ID: 42, ExpiresAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)})
+
+	values := url.Values{"sort": {"expires_at"}, "cursor": {cursor.encode()}}
+	parsed, err := parseUserListQuery(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Cursor.ID != 42 || parsed.Cursor.Value != "2025-01-02 03:04:05" {
+		t.Errorf("Unexpected cursor %+v", parsed.Cursor)
+	}
+
+	_, _, paged, args := parsed.where()
+	if !strings.Contains(paged, "id < ?") || len(args) != 3 {
+		t.Errorf("Unexpected page clause %q with %d args", paged, len(args))
+	}
+
+	// A cursor from one sort cannot continue another
+	values.Set("sort", "created_at")
+	if _, err := parseUserListQuery(values); err == nil {
+		t.Error("Expected cursor for a different sort to be rejected")
+	}
+
+	// Accounts without an expiry page after all dated ones
+	if c := q.cursorFor(UserResponse{ID: 1}); c.Value != noExpirySortValue {
+		t.Errorf("Expected sentinel for missing expiry, got %q", c.Value)
+	}
+}
+
+// TestLikeEscape tests that search input cannot inject wildcards
+func TestLikeEscape(t *testing.T) {
+	if got := likeEscape(`50%_off\`); got != `50\%\_off\\` {
+		t.Errorf("Unexpected escape %q", got)
+	}
+}
+
+// TestGetAllUsersRejectsBadParams tests validation before querying
+func TestGetAllUsersRejectsBadParams(t *testing.T) {
+	for _, query := range []string{"limit=0", "limit=501", "sort=password", "order=up", "status=gone", "role=root", "cursor=x", "expiring_within=-1"} {
+		req := httptest.NewRequest("GET", "/api/admin/users?"+query, nil)
+		w := httptest.NewRecorder()
+		GetAllUsers(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EmailVerificationPolicy controls public signups, which start in
+// pending_verification until the customer follows the emailed link.
+// Accounts still unverified LinkTTL after their last link was sent are
+// removed.
+type EmailVerificationPolicy struct {
+	AllowUnverifiedLogin bool
+	LinkTTL              time.Duration
+}
+
+var emailVerification = EmailVerificationPolicy{LinkTTL: 48 * time.Hour}
+
+func init() {
+	emailVerification.AllowUnverifiedLogin = os.Getenv("UNVERIFIED_LOGIN") == "allow"
+	if ttl, err := time.ParseDuration(os.Getenv("EMAIL_VERIFICATION_TTL")); err == nil && ttl > 0 {
+		emailVerification.LinkTTL = ttl
+	}
+}
+
+var (
+	errAccountUnverified       = errors.New("Email address has not been verified")
+	errVerificationLinkInvalid = errors.New("Invalid verification link")
+	errVerificationLinkExpired = errors.New("Verification link has expired")
+)
+
+var (
+	verifyIPRule      = RateLimitRule{Name: "verify:ip", Burst: 5, Refill: 10 * time.Minute}
+	verifyAccountRule = RateLimitRule{Name: "verify:account", Burst: 2, Refill: 15 * time.Minute}
+)
+
+// The MAC covers the email address so changing it voids older links
+func verificationMAC(userID int, email string, expires int64) []byte {
+	key := hmac.New(sha256.New, jwtSecret)
+	key.Write([]byte("email-verification"))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	fmt.Fprintf(mac, "%d\n%s\n%d", userID, strings.ToLower(email), expires)
+	return mac.Sum(nil)
+}
+
+// Sign a verification token of the form <user id>.<expiry>.<mac>
+func signVerificationToken(userID int, email string, expires time.Time) string {
+	return fmt.Sprintf("%d.%d.%s", userID, expires.Unix(),
+		base64.RawURLEncoding.EncodeToString(verificationMAC(userID, email, expires.Unix())))
+}
+
+// Split a verification token. The MAC is checked by checkVerificationToken
+// once the account's email is known.
+func parseVerificationToken(token string) (userID int, expires int64, mac []byte, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, 0, nil, errVerificationLinkInvalid
+	}
+	if userID, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, nil, errVerificationLinkInvalid
+	}
+	if expires, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return 0, 0, nil, errVerificationLinkInvalid
+	}
+	if mac, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return 0, 0, nil, errVerificationLinkInvalid
+	}
+	return userID, expires, mac, nil
+}
+
+func checkVerificationToken(userID int, email string, expires int64, mac []byte, now time.Time) error {
+	if !hmac.Equal(mac, verificationMAC(userID, email, expires)) {
+		return errVerificationLinkInvalid
+	}
+	if now.Unix() > expires {
+		return errVerificationLinkExpired
+	}
+	return nil
+}
+
+// Sign a link for the address and note when it was sent, so the cleanup
+// only removes accounts whose newest link has expired
+func verificationLink(userID int, email string) string {
+	token := signVerificationToken(userID, email, time.Now().Add(emailVerification.LinkTTL))
+	if _, err := db.Exec("UPDATE users SET verification_sent_at = NOW() WHERE id = ?", userID); err != nil {
+		log.Println("Verification send time error:", err)
+	}
+	return fmt.Sprintf("%s/api/auth/verify-email?token=%s", appURL, url.QueryEscape(token))
+}
+
+func sendVerificationMail(userID int, username, email string) {
+	sendMailAsync(Mail{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Welcome! Your VPN username is %s.\n\nConfirm your email address by opening this link:\n%s\n\nThe link expires in %s.\n",
+			username, verificationLink(userID, email), emailVerification.LinkTTL,
+		),
+	})
+}
+
+// Ask an existing account to confirm a changed address
+func sendEmailChangeMail(userID int, email string) {
+	sendMailAsync(Mail{
+		To:      email,
+		Subject: "Verify your new email address",
+		Body: fmt.Sprintf(
+			"The email address on your VPN account was changed to this one.\n\nConfirm it by opening this link:\n%s\n\nThe link expires in %s.\n",
+			verificationLink(userID, email), emailVerification.LinkTTL,
+		),
+	})
+}
+
+// Verify an email address. Links opened in a browser (GET) redirect to the
+// login page; API clients POST {"token": ...} and receive JSON.
+func VerifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if r.Method == http.MethodPost {
+		var req struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		token = req.Token
+	}
+
+	err := verifyEmail(r, token)
+	if r.Method == http.MethodGet {
+		verified := "1"
+		if err != nil {
+			verified = "0"
+		}
+		http.Redirect(w, r, "/login.html?verified="+verified, http.StatusSeeOther)
+		return
+	}
+
+	switch err {
+	case nil:
+	case errVerificationLinkInvalid, errVerificationLinkExpired:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Email address verified"})
+}
+
+// Check token and activate its account. Verifying twice is not an error.
+func verifyEmail(r *http.Request, token string) error {
+	userID, expires, mac, err := parseVerificationToken(token)
+	if err != nil {
+		return err
+	}
+
+	var email string
+	err = db.QueryRow("SELECT COALESCE(email, '') FROM users WHERE id = ?", userID).Scan(&email)
+	if err == sql.ErrNoRows {
+		return errVerificationLinkInvalid
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkVerificationToken(userID, email, expires, mac, time.Now()); err != nil {
+		return err
+	}
+
+	result, err := db.Exec(
+		`UPDATE users SET email_verified_at = NOW(),
+			status = IF(status = 'pending_verification', 'active', status)
+		WHERE id = ? AND email_verified_at IS NULL`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		logActivity(r, Activity{ActorID: userID, TargetID: userID, Action: "email.verified", Details: map[string]interface{}{
+			"email": email,
+		}})
+	}
+	return nil
+}
+
+// Send a fresh verification link. The response is the same whether or not
+// an unverified account matched.
+func ResendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email    string `json:"email"`
+		Username string `json:"username"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	column, value := "email", strings.TrimSpace(req.Email)
+	if value == "" {
+		column, value = "username", strings.TrimSpace(req.Username)
+	}
+	if value == "" {
+		http.Error(w, "Email or username is required", http.StatusBadRequest)
+		return
+	}
+
+	if throttle(w, r,
+		rateLimitCheck{verifyIPRule, clientIP(r)},
+		rateLimitCheck{verifyAccountRule, strings.ToLower(value)},
+	) {
+		return
+	}
+
+	var userID int
+	var username, email string
+	err := db.QueryRow(
+		"SELECT id, username, email FROM users WHERE "+column+" = ? AND status = 'pending_verification' AND email IS NOT NULL LIMIT 1",
+		value,
+	).Scan(&userID, &username, &email)
+	switch err {
+	case nil:
+		sendVerificationMail(userID, username, email)
+	case sql.ErrNoRows:
+	default:
+		log.Println("Verification lookup error:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "If an unverified account matches, a new verification link has been sent",
+	})
+}
+
+// Remove signups whose newest verification link has expired unused,
+// releasing their email address. Accounts paid for with a voucher are
+// kept; they can ask for a new link.
+func unverifiedCleanupJob() Job {
+	return Job{
+		Name:    "unverified-signup-cleanup",
+		Spec:    "@hourly",
+		Timeout: 5 * time.Minute,
+		Run: func(ctx context.Context) (string, error) {
+			result, err := db.ExecContext(ctx,
+				`DELETE FROM users WHERE role = 'user' AND status = 'pending_verification'
+				AND COALESCE(verification_sent_at, created_at) < NOW() - INTERVAL ? SECOND
+				AND NOT EXISTS (SELECT 1 FROM vouchers v WHERE v.redeemed_by = users.id)`,
+				int64(emailVerification.LinkTTL.Seconds()),
+			)
+			if err != nil {
+				return "", err
+			}
+			n, _ := result.RowsAffected()
+			return fmt.Sprintf("%d unverified signups removed", n), nil
+		},
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestVerificationToken tests signing and checking email verification links
+func TestVerificationToken(t *testing.T) {
+	now := time.Now()
+	token := signVerificationToken(42, "Jane@Example.com", now.Add(time.Hour))
+
+	userID, expires, mac, err := parseVerificationToken(token)
+	if err != nil || userID != 42 {
+		t.Fatalf("Parse failed: %d, %v", userID, err)
+	}
+
+	if err := checkVerificationToken(userID, "jane@example.com", expires, mac, now); err != nil {
+		t.Errorf("Expected valid token, got %v", err)
+	}
+	if err := checkVerificationToken(userID, "other@example.com", expires, mac, now); err != errVerificationLinkInvalid {
+		t.Errorf("Expected a changed email to void the link, got %v", err)
+	}
+	if err := checkVerificationToken(43, "jane@example.com", expires, mac, now); err != errVerificationLinkInvalid {
+		t.Errorf("Expected another user ID to be rejected, got %v", err)
+	}
+	if err := checkVerificationToken(userID, "jane@example.com", expires+3600, mac, now); err != errVerificationLinkInvalid {
+		t.Errorf("Expected an extended expiry to be rejected, got %v", err)
+	}
+	if err := checkVerificationToken(userID, "jane@example.com", expires, mac, now.Add(2*time.Hour)); err != errVerificationLinkExpired {
+		t.Errorf("Expected expired link, got %v", err)
+	}
+
+	for _, bad := range []string{"", "42", "x.1.abc", "42.y.abc", "42.1.!!"} {
+		if _, _, _, err := parseVerificationToken(bad); err == nil {
+			t.Errorf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
+// TestAccountStatusErrorUnverified tests the unverified login policy
+func TestAccountStatusErrorUnverified(t *testing.T) {
+	saved := emailVerification
+	defer func() { emailVerification = saved }()
+	future := time.Now().Add(time.Hour)
+
+	emailVerification.AllowUnverifiedLogin = false
+	if err := accountStatusError("user", "pending_verification", future); err != errAccountUnverified {
+		t.Errorf("Expected errAccountUnverified, got %v", err)
+	}
+
+	emailVerification.AllowUnverifiedLogin = true
+	if err := accountStatusError("user", "pending_verification", future); err != nil {
+		t.Errorf("Expected unverified login to be allowed, got %v", err)
+	}
+}
+
+// TestVerifyEmailRejectsMalformedToken tests the JSON error response
+func TestVerifyEmailRejectsMalformedToken(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/auth/verify-email", bytes.NewBufferString(`{"token":"nonsense"}`))
+	w := httptest.NewRecorder()
+	VerifyEmailHandler(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/auth/verify-email?token=nonsense", nil)
+	w = httptest.NewRecorder()
+	VerifyEmailHandler(w, req)
+
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login.html?verified=0" {
+		t.Errorf("Expected redirect to the failure page, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// TestUnverifiedCleanupUsesLatestLink tests that a resent link keeps an old
+// signup until that link expires
+func TestUnverifiedCleanupUsesLatestLink(t *testing.T) {
+	testDB := openTestDB(t)
+	suffix := testSuffix(t)
+	ttl := int64(emailVerification.LinkTTL.Seconds())
+
+	insert := func(name string, sentAgo int64) int64 {
+		result, err := testDB.Exec(
+			`INSERT INTO users (username, password, role, status, created_at, verification_sent_at)
+			VALUES (?, 'x', 'user', 'pending_verification', NOW() - INTERVAL ? SECOND, NOW() - INTERVAL ? SECOND)`,
+			name+suffix, 2*ttl, sentAgo,
+		)
+		if err != nil {
+			t.Fatalf("User insert failed: %v", err)
+		}
+		id, _ := result.LastInsertId()
+		t.Cleanup(func() { testDB.Exec("DELETE FROM users WHERE id = ?", id) })
+		return id
+	}
+
+	resent := insert("vr", 60)
+	stale := insert("vs", ttl+60)
+
+	if _, err := unverifiedCleanupJob().Run(context.Background()); err != nil {
+		t.Fatalf("Cleanup error: %v", err)
+	}
+
+	var n int
+	testDB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", resent).Scan(&n)
+	if n != 1 {
+		t.Error("Expected the account with a fresh link to be kept")
+	}
+	testDB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", stale).Scan(&n)
+	if n != 0 {
+		t.Error("Expected the account whose link expired to be removed")
+	}
+}
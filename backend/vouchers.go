@@ -0,0 +1,603 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Voucher codes are 15 random characters and a check character, shown in
+// groups of four. The alphabet leaves out 0/O and 1/I so codes can be
+// typed from a printed card.
+const (
+	voucherAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	voucherLength   = 16
+)
+
+var (
+	errVoucherInvalid  = errors.New("Invalid voucher code")
+	errVoucherRedeemed = errors.New("Voucher has already been redeemed")
+	errVoucherExpired  = errors.New("Voucher has expired")
+)
+
+var redeemIPRule = RateLimitRule{
+	Name: "redeem:ip", Burst: 10, Refill: time.Minute,
+	LockoutThreshold: 10, LockoutBase: time.Minute, LockoutMax: time.Hour,
+}
+
+// Vouchers issued by a reseller that can still be redeemed. They hold a
+// quota slot each until redeemed, revoked or expired.
+const outstandingVouchersQuery = `SELECT COUNT(*) FROM vouchers v JOIN voucher_batches b ON b.id = v.batch_id
+	WHERE b.reseller_id = ? AND v.redeemed_at IS NULL AND v.revoked_at IS NULL AND b.expires_at > NOW()`
+
+// Luhn mod N check character over voucherAlphabet. It catches any single
+// mistyped character and most swaps of neighbours.
+func voucherCheckChar(payload string) (byte, bool) {
+	n := len(voucherAlphabet)
+	factor, sum := 2, 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		point := strings.IndexByte(voucherAlphabet, payload[i])
+		if point < 0 {
+			return 0, false
+		}
+		addend := factor * point
+		sum += addend/n + addend%n
+		factor = 3 - factor
+	}
+	return voucherAlphabet[(n-sum%n)%n], true
+}
+
+func generateVoucherCode() (string, error) {
+	payload, err := randomString(voucherAlphabet, voucherLength-1)
+	if err != nil {
+		return "", err
+	}
+	check, _ := voucherCheckChar(payload)
+	return payload + string(check), nil
+}
+
+// Uppercase a typed code and drop separators
+func normalizeVoucherCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(strings.TrimSpace(code)))
+}
+
+// Whether a normalized code is well formed with a matching check character
+func validVoucherCode(code string) bool {
+	if len(code) != voucherLength {
+		return false
+	}
+	check, ok := voucherCheckChar(code[:voucherLength-1])
+	return ok && check == code[voucherLength-1]
+}
+
+// Display a code in dash separated groups of four
+func formatVoucherCode(code string) string {
+	var groups []string
+	for i := 0; i < len(code); i += 4 {
+		end := i + 4
+		if end > len(code) {
+			end = len(code)
+		}
+		groups = append(groups, code[i:end])
+	}
+	return strings.Join(groups, "-")
+}
+
+// VoucherBatch summarises a batch of vouchers
+type VoucherBatch struct {
+	ID          int       `json:"id"`
+	PackageID   int       `json:"package_id"`
+	ResellerID  *int      `json:"reseller_id"`
+	CreatedBy   *int      `json:"created_by"`
+	Note        string    `json:"note"`
+	Quantity    int       `json:"quantity"`
+	Redeemed    int       `json:"redeemed"`
+	Revoked     int       `json:"revoked"`
+	Outstanding int       `json:"outstanding"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Reseller: Generate a batch of single-use vouchers for a package. Each
+// unredeemed voucher holds a slot of the reseller's quota; admin batches
+// are not counted against any quota.
+func ResellerCreateVouchers(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+
+	var req struct {
+		PackageID int    `json:"package_id"`
+		Quantity  int    `json:"quantity"`
+		ValidDays int    `json:"valid_days"`
+		Note      string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity < 1 || req.Quantity > maxBulkUsers {
+		http.Error(w, fmt.Sprintf("Quantity must be between 1 and %d", maxBulkUsers), http.StatusBadRequest)
+		return
+	}
+	if req.ValidDays == 0 {
+		req.ValidDays = 365
+	}
+	if req.ValidDays < 1 || req.ValidDays > 3650 {
+		http.Error(w, "Invalid valid_days", http.StatusBadRequest)
+		return
+	}
+	if len(req.Note) > 255 {
+		http.Error(w, "Note is too long", http.StatusBadRequest)
+		return
+	}
+
+	pkg, err := loadPurchasablePackage(db, req.PackageID, principal.Role == "reseller")
+	switch err {
+	case nil:
+	case errPackageNotFound, errPackageUnavailable:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	default:
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	codes := make([]string, req.Quantity)
+	for i := range codes {
+		if codes[i], err = generateVoucherCode(); err != nil {
+			http.Error(w, "Code generation error", http.StatusInternalServerError)
+			return
+		}
+	}
+	expiresAt := time.Now().AddDate(0, 0, req.ValidDays)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var resellerID interface{}
+	if principal.Role == "reseller" {
+		switch err := reserveResellerQuota(tx, principal.UserID, req.Quantity); err {
+		case nil:
+		case errNoResellerQuota, errQuotaExceeded:
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		default:
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		resellerID = principal.UserID
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO voucher_batches (package_id, reseller_id, created_by, quantity, note, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		pkg.ID, resellerID, principal.UserID, req.Quantity, req.Note, expiresAt,
+	)
+	if err != nil {
+		http.Error(w, "Creation error", http.StatusInternalServerError)
+		return
+	}
+	batchID, _ := result.LastInsertId()
+
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT INTO vouchers (batch_id, code_hash) VALUES (?, ?)", batchID, hashToken(code)); err != nil {
+			log.Println("Voucher creation error:", err)
+			http.Error(w, "Creation error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Creation error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "voucher.create_batch", 0, map[string]interface{}{
+		"batch_id": batchID, "package_id": pkg.ID, "quantity": req.Quantity, "expires_at": expiresAt,
+	})
+
+	// Codes are only stored hashed, so this is the one chance to save them
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsCSV(r) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="vouchers-%d.csv"`, batchID))
+		out := csv.NewWriter(w)
+		out.Write([]string{"code", "batch_id", "package", "days", "expires_at"})
+		for _, code := range codes {
+			out.Write([]string{formatVoucherCode(code), strconv.FormatInt(batchID, 10), pkg.Name, strconv.Itoa(pkg.Days), expiresAt.UTC().Format(time.RFC3339)})
+		}
+		out.Flush()
+		return
+	}
+
+	formatted := make([]string, len(codes))
+	for i, code := range codes {
+		formatted[i] = formatVoucherCode(code)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"batch_id":   batchID,
+		"package":    pkg,
+		"codes":      formatted,
+		"expires_at": expiresAt,
+		"message":    "Vouchers created successfully",
+	})
+}
+
+// Reseller: List voucher batches with redemption counts. Admins see every batch.
+func ResellerGetVoucherBatches(w http.ResponseWriter, r *http.Request) {
+	principal := currentPrincipal(r)
+
+	where, args := "", []interface{}{}
+	if principal.Role == "reseller" {
+		where, args = "WHERE b.reseller_id = ?", append(args, principal.UserID)
+	}
+
+	rows, err := db.Query(
+		`SELECT b.id, b.package_id, b.reseller_id, b.created_by, COALESCE(b.note, ''), b.quantity,
+			COUNT(v.redeemed_at), COUNT(v.revoked_at), b.expires_at, b.created_at
+		FROM voucher_batches b LEFT JOIN vouchers v ON v.batch_id = b.id `+where+`
+		GROUP BY b.id ORDER BY b.id DESC`,
+		args...,
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	batches := []VoucherBatch{}
+	for rows.Next() {
+		var b VoucherBatch
+		var resellerID, createdBy sql.NullInt64
+		if err := rows.Scan(&b.ID, &b.PackageID, &resellerID, &createdBy, &b.Note, &b.Quantity,
+			&b.Redeemed, &b.Revoked, &b.ExpiresAt, &b.CreatedAt); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if resellerID.Valid {
+			id := int(resellerID.Int64)
+			b.ResellerID = &id
+		}
+		if createdBy.Valid {
+			id := int(createdBy.Int64)
+			b.CreatedBy = &id
+		}
+		if b.ExpiresAt.After(time.Now()) {
+			b.Outstanding = b.Quantity - b.Redeemed - b.Revoked
+		}
+		batches = append(batches, b)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batches)
+}
+
+// Reseller: Revoke the unredeemed vouchers of a batch, releasing their quota
+func ResellerRevokeVoucherBatch(w http.ResponseWriter, r *http.Request) {
+	batchID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid batch ID", http.StatusBadRequest)
+		return
+	}
+
+	principal := currentPrincipal(r)
+	query, args := "SELECT EXISTS(SELECT 1 FROM voucher_batches WHERE id = ?)", []interface{}{batchID}
+	if principal.Role == "reseller" {
+		query, args = "SELECT EXISTS(SELECT 1 FROM voucher_batches WHERE id = ? AND reseller_id = ?)", append(args, principal.UserID)
+	}
+	var owned bool
+	if err := db.QueryRow(query, args...).Scan(&owned); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !owned {
+		http.Error(w, "Voucher batch not found", http.StatusNotFound)
+		return
+	}
+
+	result, err := db.Exec(
+		"UPDATE vouchers SET revoked_at = NOW() WHERE batch_id = ? AND redeemed_at IS NULL AND revoked_at IS NULL",
+		batchID,
+	)
+	if err != nil {
+		http.Error(w, "Update error", http.StatusInternalServerError)
+		return
+	}
+	revoked, _ := result.RowsAffected()
+
+	logPrincipalActivity(r, "voucher.revoke_batch", 0, map[string]interface{}{"batch_id": batchID, "revoked": revoked})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"revoked": revoked,
+		"message": "Vouchers revoked successfully",
+	})
+}
+
+// A voucher locked for redemption
+type lockedVoucher struct {
+	ID         int
+	BatchID    int
+	PackageID  int
+	ResellerID sql.NullInt64
+}
+
+// Lock an unused voucher inside tx
+func lockVoucher(tx *sql.Tx, code string) (lockedVoucher, error) {
+	var v lockedVoucher
+	var redeemedAt, revokedAt sql.NullTime
+	var expiresAt time.Time
+	err := tx.QueryRow(
+		`SELECT v.id, v.batch_id, b.package_id, b.reseller_id, v.redeemed_at, v.revoked_at, b.expires_at
+		FROM vouchers v JOIN voucher_batches b ON b.id = v.batch_id
+		WHERE v.code_hash = ? FOR UPDATE`,
+		hashToken(code),
+	).Scan(&v.ID, &v.BatchID, &v.PackageID, &v.ResellerID, &redeemedAt, &revokedAt, &expiresAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return v, errVoucherInvalid
+	case err != nil:
+		return v, err
+	case revokedAt.Valid:
+		return v, errVoucherInvalid
+	case redeemedAt.Valid:
+		return v, errVoucherRedeemed
+	case expiresAt.Before(time.Now()):
+		return v, errVoucherExpired
+	}
+	return v, nil
+}
+
+// Redeem a voucher. With username and password it extends that account by
+// the voucher's package; otherwise a new account is created with the given
+// password (and optional email) and signed in.
+func RedeemVoucherHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code     string `json:"code"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	checks := []rateLimitCheck{{redeemIPRule, clientIP(r)}}
+	if req.Username != "" {
+		checks = append(checks, loginChecks(r, req.Username)[1])
+	}
+	if throttle(w, r, checks...) {
+		return
+	}
+
+	code := normalizeVoucherCode(req.Code)
+	if !validVoucherCode(code) {
+		recordLoginFailure(r, checks[:1])
+		http.Error(w, errVoucherInvalid.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		http.Error(w, "Password is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Username != "" {
+		redeemExtend(w, r, code, req.Username, req.Password, checks)
+		return
+	}
+	redeemCreate(w, r, code, req.Email, req.Password, checks)
+}
+
+// Write the response for a voucher that could not be redeemed
+func voucherError(w http.ResponseWriter, r *http.Request, err error, checks []rateLimitCheck) {
+	switch err {
+	case errVoucherInvalid:
+		recordLoginFailure(r, checks[:1])
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errVoucherRedeemed, errVoucherExpired:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errPackageNotFound:
+		http.Error(w, "The voucher's package no longer exists", http.StatusConflict)
+	default:
+		log.Println("Voucher redemption error:", err)
+		http.Error(w, "Redemption error", http.StatusInternalServerError)
+	}
+}
+
+// Extend an existing account, authenticated by its password
+func redeemExtend(w http.ResponseWriter, r *http.Request, code, username, password string, checks []rateLimitCheck) {
+	var userID int
+	var hash string
+	err := db.QueryRow("SELECT id, password FROM users WHERE username = ? AND role = 'user'", username).Scan(&userID, &hash)
+	if err != nil {
+		rejectPassword(password)
+		recordLoginFailure(r, checks)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if ok, _ := verifyPassword(hash, password); !ok {
+		recordLoginFailure(r, checks)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	extendWithVoucher(w, r, code, userID, checks)
+}
+
+// Redeem a voucher against an existing user, extending them by its package
+func extendWithVoucher(w http.ResponseWriter, r *http.Request, code string, userID int, checks []rateLimitCheck) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	voucher, err := lockVoucher(tx, code)
+	if err != nil {
+		voucherError(w, r, err, checks)
+		return
+	}
+	quote, err := applyRenewal(tx, userID, voucher.PackageID, userID, "voucher")
+	if err != nil {
+		voucherError(w, r, err, checks)
+		return
+	}
+	if _, err := tx.Exec("UPDATE vouchers SET redeemed_at = NOW(), redeemed_by = ? WHERE id = ?", userID, voucher.ID); err != nil {
+		voucherError(w, r, err, checks)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		voucherError(w, r, err, checks)
+		return
+	}
+
+	logActivity(r, Activity{ActorID: userID, TargetID: userID, Action: "voucher.redeem", Details: map[string]interface{}{
+		"batch_id": voucher.BatchID, "mode": "extend", "new_expires_at": quote.NewExpiry,
+	}})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"renewal": quote,
+		"message": "Voucher redeemed; your account has been extended",
+	})
+}
+
+// Create a new account from a voucher and sign it in. The account belongs
+// to the reseller who issued the voucher, whose quota slot it takes over.
+func redeemCreate(w http.ResponseWriter, r *http.Request, code, email, password string, checks []rateLimitCheck) {
+	email = strings.TrimSpace(email)
+	if err := passwordPolicy.Validate(password, email); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if email != "" {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email = ?)", email).Scan(&exists); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			http.Error(w, "Email address is already registered", http.StatusConflict)
+			return
+		}
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		http.Error(w, "Password hashing error", http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	voucher, err := lockVoucher(tx, code)
+	if err != nil {
+		voucherError(w, r, err, checks)
+		return
+	}
+	// Vouchers were paid for when issued, so a package archived since
+	// then is still honoured
+	pkg, err := loadPackage(tx, voucher.PackageID)
+	if err != nil {
+		voucherError(w, r, err, checks)
+		return
+	}
+	expiresAt := time.Now().AddDate(0, 0, pkg.Days)
+
+	var resellerID interface{}
+	if voucher.ResellerID.Valid {
+		resellerID = voucher.ResellerID.Int64
+	}
+
+	// An email address has to be verified, as for public signups
+	status := "active"
+	if email != "" {
+		status = "pending_verification"
+	}
+
+	var result sql.Result
+	username, err := withGeneratedUsername("user", func(username string) error {
+		result, err = tx.Exec(
+			"INSERT INTO users (username, password, role, email, status, expires_at, package_id, reseller_id) VALUES (?, ?, 'user', ?, ?, ?, ?, ?)",
+			username, hash, email, status, expiresAt, pkg.ID, resellerID,
+		)
+		return err
+	})
+	if err != nil {
+		voucherError(w, r, err, checks)
+		return
+	}
+	id, _ := result.LastInsertId()
+	userID := int(id)
+
+	if _, err := tx.Exec("UPDATE vouchers SET redeemed_at = NOW(), redeemed_by = ? WHERE id = ?", userID, voucher.ID); err != nil {
+		voucherError(w, r, err, checks)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		voucherError(w, r, err, checks)
+		return
+	}
+
+	logActivity(r, Activity{ActorID: userID, TargetID: userID, Action: "voucher.redeem", Details: map[string]interface{}{
+		"batch_id": voucher.BatchID, "mode": "create", "package_id": pkg.ID,
+	}})
+
+	resp := map[string]interface{}{
+		"user": User{
+			ID:        userID,
+			Username:  username,
+			Role:      "user",
+			Email:     email,
+			Status:    status,
+			CreatedAt: time.Now(),
+			ExpiresAt: expiresAt,
+		},
+		"username": username,
+		"package":  pkg,
+		"message":  "Voucher redeemed! Your VPN username is: " + username,
+	}
+
+	if status == "pending_verification" {
+		sendVerificationMail(userID, username, email)
+		resp["verification_required"] = true
+		resp["message"] = "Voucher redeemed! Your VPN username is: " + username + ". Check your email to verify your address."
+	}
+
+	// Sign in unless the address must be verified first
+	if status == "active" || emailVerification.AllowUnverifiedLogin {
+		tokens, err := createSession(userID, "user")
+		if err != nil {
+			http.Error(w, "Token generation error", http.StatusInternalServerError)
+			return
+		}
+		resp["token"] = tokens.AccessToken
+		resp["refresh_token"] = tokens.RefreshToken
+		resp["expires_in"] = tokens.ExpiresIn
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestVoucherCodeChecksum tests generation, formatting and typo detection
+func TestVoucherCodeChecksum(t *testing.T) {
+	code, err := generateVoucherCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !validVoucherCode(code) {
+		t.Fatalf("Generated code %q failed its checksum", code)
+	}
+
+	formatted := formatVoucherCode(code)
+	if len(formatted) != voucherLength+3 || strings.Count(formatted, "-") != 3 {
+		t.Errorf("Unexpected format %q", formatted)
+	}
+	if normalizeVoucherCode(" "+strings.ToLower(formatted)+" ") != code {
+		t.Errorf("Normalizing %q did not recover %q", formatted, code)
+	}
+
+	// Every single character substitution is caught
+	for i := 0; i < len(code); i++ {
+		for j := 0; j < len(voucherAlphabet); j++ {
+			if voucherAlphabet[j] == code[i] {
+				continue
+			}
+			typo := code[:i] + string(voucherAlphabet[j]) + code[i+1:]
+			if validVoucherCode(typo) {
+				t.Fatalf("Typo %q of %q passed the checksum", typo, code)
+			}
+		}
+	}
+
+	for _, bad := range []string{"", "ABCD", code + "A", strings.Replace(code, code[:1], "0", 1)} {
+		if validVoucherCode(bad) {
+			t.Errorf("Expected %q to be invalid", bad)
+		}
+	}
+}
+
+// TestRedeemVoucherRejectsBadCodes tests that malformed codes fail before querying
+func TestRedeemVoucherRejectsBadCodes(t *testing.T) {
+	for _, body := range []string{`{"code": "AAAA-BBBB", "password": "x"}`, `{"code": "", "password": "x"}`, `not json`} {
+		req := httptest.NewRequest("POST", "/api/auth/redeem", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		RedeemVoucherHandler(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", body, w.Code)
+		}
+	}
+}
+
+// TestVouchersAgainstQuota tests that vouchers hold quota until redeemed
+// and that a code works only once
+func TestVouchersAgainstQuota(t *testing.T) {
+	testDB := openTestDB(t)
+
+	result, err := testDB.Exec(
+		"INSERT INTO users (username, password, role, status, expires_at) VALUES (?, 'x', 'reseller', 'active', '2099-12-31')",
+		"vc"+testSuffix(t),
+	)
+	if err != nil {
+		t.Fatalf("Reseller insert failed: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	reseller := Principal{UserID: int(id), Role: "reseller"}
+	t.Cleanup(func() {
+		testDB.Exec("DELETE FROM voucher_batches WHERE reseller_id = ?", reseller.UserID)
+		testDB.Exec("DELETE FROM users WHERE reseller_id = ?", reseller.UserID)
+		testDB.Exec("DELETE FROM users WHERE id = ?", reseller.UserID)
+	})
+	if _, err := testDB.Exec("INSERT INTO resellers (user_id, user_quota) VALUES (?, 3)", reseller.UserID); err != nil {
+		t.Fatalf("Quota insert failed: %v", err)
+	}
+	var packageID int
+	if err := testDB.QueryRow("SELECT id FROM packages WHERE active = TRUE AND visible_to_resellers = TRUE LIMIT 1").Scan(&packageID); err != nil {
+		t.Skip("No reseller package available")
+	}
+
+	createVouchers := func(quantity int) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]int{"package_id": packageID, "quantity": quantity})
+		req := httptest.NewRequest("POST", "/api/reseller/vouchers", bytes.NewReader(body))
+		req = req.WithContext(withPrincipal(req.Context(), reseller))
+		w := httptest.NewRecorder()
+		ResellerCreateVouchers(w, req)
+		return w
+	}
+
+	w := createVouchers(3)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var batch struct {
+		Codes []string `json:"codes"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &batch)
+
+	if w := createVouchers(1); w.Code != http.StatusForbidden {
+		t.Errorf("Expected outstanding vouchers to fill the quota, got %d", w.Code)
+	}
+
+	redeem := func(code string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"code": code, "password": "voucher-Pass-2024"})
+		req := httptest.NewRequest("POST", "/api/auth/redeem", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		RedeemVoucherHandler(w, req)
+		return w
+	}
+
+	w = redeem(batch.Codes[0])
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected redemption to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var redeemed struct {
+		Username string `json:"username"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &redeemed)
+
+	// An account redeemed without an email keeps signing in afterwards
+	checkLoginAndRefresh(t, redeemed.Username, "voucher-Pass-2024")
+
+	if w := redeem(batch.Codes[0]); w.Code != http.StatusConflict {
+		t.Errorf("Expected a second redemption to conflict, got %d", w.Code)
+	}
+
+	// An email address must be verified before the account signs in
+	saved := emailVerification
+	t.Cleanup(func() { emailVerification = saved })
+	emailVerification.AllowUnverifiedLogin = false
+
+	body, _ := json.Marshal(map[string]string{"code": batch.Codes[1], "password": "voucher-Pass-2024", "email": "vc" + testSuffix(t) + "@test.local"})
+	req := httptest.NewRequest("POST", "/api/auth/redeem", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	RedeemVoucherHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected redemption with an email to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	var pending struct {
+		User                 User   `json:"user"`
+		Token                string `json:"token"`
+		VerificationRequired bool   `json:"verification_required"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &pending)
+	var status string
+	testDB.QueryRow("SELECT status FROM users WHERE id = ?", pending.User.ID).Scan(&status)
+	if status != "pending_verification" || !pending.VerificationRequired || pending.Token != "" {
+		t.Errorf("Expected an unverified account without a session, got %s %+v", status, pending)
+	}
+
+	// The redeemed vouchers became the reseller's users
+	quota, used, err := resellerQuotaUsage(testDB, reseller.UserID)
+	if err != nil || quota != 3 || used != 3 {
+		t.Errorf("Expected 3 of 3 used, got %d of %d (%v)", used, quota, err)
+	}
+}
+
+// Log in as username and refresh the resulting session, failing the test
+// if either step does not issue tokens
+func checkLoginAndRefresh(t *testing.T, username, password string) {
+	t.Helper()
+
+	body, _ := json.Marshal(LoginRequest{Username: username, Password: password})
+	req := httptest.NewRequest("POST", "/api/auth/login", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	LoginHandler(w, req)
+	var login AuthResponse
+	json.Unmarshal(w.Body.Bytes(), &login)
+	if w.Code != http.StatusOK || login.Token == "" {
+		t.Fatalf("Login as %s failed: %d %s", username, w.Code, w.Body.String())
+	}
+
+	body, _ = json.Marshal(map[string]string{"refresh_token": login.RefreshToken})
+	req = httptest.NewRequest("POST", "/api/auth/refresh", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	RefreshHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Refresh as %s failed: %d %s", username, w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WireGuardConfig is the server side of the tunnel that client configs
+// point at. Clients get consecutive addresses from the pools; the first
+// host address of each pool belongs to the server.
+type WireGuardConfig struct {
+	Endpoint            string
+	ServerPublicKey     string
+	DNS                 []string
+	AllowedIPs          []string
+	IPv4Pool            netip.Prefix
+	IPv6Pool            netip.Prefix
+	PersistentKeepalive int
+	MTU                 int
+}
+
+var wireguard = WireGuardConfig{
+	DNS:                 []string{"1.1.1.1"},
+	AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+	IPv4Pool:            netip.MustParsePrefix("10.8.0.0/24"),
+	IPv6Pool:            netip.MustParsePrefix("fd42:42:42::/64"),
+	PersistentKeepalive: 25,
+}
+
+// Secret sealing device private keys at rest. Without DEVICE_KEY_SECRET
+// a key is derived from the JWT secret.
+var deviceKeySecret []byte
+
+func init() {
+	wireguard.Endpoint = os.Getenv("WG_ENDPOINT")
+	wireguard.ServerPublicKey = os.Getenv("WG_SERVER_PUBLIC_KEY")
+
+	list := func(name string, dst *[]string) {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = nil
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					*dst = append(*dst, item)
+				}
+			}
+		}
+	}
+	list("WG_DNS", &wireguard.DNS)
+	list("WG_ALLOWED_IPS", &wireguard.AllowedIPs)
+
+	// An empty pool variable disables that address family
+	pool := func(name string, dst *netip.Prefix, is4 bool) {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		*dst = netip.Prefix{}
+		if v == "" {
+			return
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil || p.Addr().Is4() != is4 {
+			log.Fatalf("Invalid %s: %q", name, v)
+		}
+		*dst = p.Masked()
+	}
+	pool("WG_IPV4_POOL", &wireguard.IPv4Pool, true)
+	pool("WG_IPV6_POOL", &wireguard.IPv6Pool, false)
+	if !wireguard.IPv4Pool.IsValid() && !wireguard.IPv6Pool.IsValid() {
+		log.Fatal("At least one of WG_IPV4_POOL and WG_IPV6_POOL must be set")
+	}
+
+	if v, err := strconv.Atoi(os.Getenv("WG_PERSISTENT_KEEPALIVE")); err == nil && v >= 0 {
+		wireguard.PersistentKeepalive = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("WG_MTU")); err == nil && v > 0 {
+		wireguard.MTU = v
+	}
+
+	deviceKeySecret = []byte(os.Getenv("DEVICE_KEY_SECRET"))
+}
+
+var (
+	errAddressPoolExhausted = errors.New("No tunnel addresses left in the pool")
+	errDeviceNotFound       = errors.New("Device not found")
+	errWireGuardUnavailable = errors.New("WireGuard is not configured on this server")
+)
+
+// Largest client index that fits every enabled pool. Index 1 is the
+// server and the top of an IPv4 pool is its broadcast address.
+func (c WireGuardConfig) maxIndex() int {
+	max := 1 << 24
+	if c.IPv4Pool.IsValid() {
+		if n := 1<<(32-c.IPv4Pool.Bits()) - 2; n < max {
+			max = n
+		}
+	}
+	if c.IPv6Pool.IsValid() && 128-c.IPv6Pool.Bits() < 24 {
+		if n := 1<<(128-c.IPv6Pool.Bits()) - 1; n < max {
+			max = n
+		}
+	}
+	return max
+}
+
+// The address at offset index within prefix
+func addrAt(prefix netip.Prefix, index int) netip.Addr {
+	b := prefix.Masked().Addr().AsSlice()
+	carry := index
+	for i := len(b) - 1; i >= 0 && carry > 0; i-- {
+		sum := int(b[i]) + carry&0xff
+		b[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// Lowest client index not in used, which must be sorted
+func firstFreeIndex(used []int, max int) (int, error) {
+	next := 2
+	for _, i := range used {
+		if i > next {
+			break
+		}
+		if i == next {
+			next++
+		}
+	}
+	if next > max {
+		return 0, errAddressPoolExhausted
+	}
+	return next, nil
+}
+
+// A Curve25519 key pair in WireGuard's base64 encoding
+type wireGuardKeyPair struct {
+	Private string
+	Public  string
+}
+
+// Generate a key pair clamped the same way as `wg genkey`
+func generateWireGuardKey() (wireGuardKeyPair, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return wireGuardKeyPair{}, err
+	}
+	b[0] &= 248
+	b[31] = b[31]&127 | 64
+
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return wireGuardKeyPair{}, err
+	}
+	return wireGuardKeyPair{
+		Private: base64.StdEncoding.EncodeToString(b),
+		Public:  base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()),
+	}, nil
+}
+
+func deviceKeyCipher() (cipher.AEAD, error) {
+	secret := deviceKeySecret
+	if len(secret) == 0 {
+		mac := hmac.New(sha256.New, jwtSecret)
+		mac.Write([]byte("device-keys"))
+		secret = mac.Sum(nil)
+	}
+	key := sha256.Sum256(secret)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt a device private key for storage
+func sealDeviceKey(private string) (string, error) {
+	gcm, err := deviceKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(private), nil)), nil
+}
+
+func openDeviceKey(sealed string) (string, error) {
+	gcm, err := deviceKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < gcm.NonceSize() {
+		return "", errors.New("Malformed device key")
+	}
+	plain, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	return string(plain), err
+}
+
+// Device is a WireGuard peer belonging to a user
+type Device struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Name      string    `json:"name"`
+	PublicKey string    `json:"public_key"`
+	IPv4      string    `json:"ipv4,omitempty"`
+	IPv6      string    `json:"ipv6,omitempty"`
+	NodeID    *int      `json:"node_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Tunnel addresses of d with host prefix lengths
+func (d Device) addresses() []string {
+	var addrs []string
+	if d.IPv4 != "" {
+		addrs = append(addrs, d.IPv4+"/32")
+	}
+	if d.IPv6 != "" {
+		addrs = append(addrs, d.IPv6+"/128")
+	}
+	return addrs
+}
+
+// Create a device with a fresh key pair and the lowest free tunnel
+// addresses. Reading the taken indexes FOR UPDATE serialises concurrent
+// allocations; the unique index is the backstop.
+func allocateDevice(tx *sql.Tx, userID int, name string) (Device, error) {
+	keys, err := generateWireGuardKey()
+	if err != nil {
+		return Device{}, err
+	}
+	sealed, err := sealDeviceKey(keys.Private)
+	if err != nil {
+		return Device{}, err
+	}
+
+	rows, err := tx.Query("SELECT ip_index FROM devices ORDER BY ip_index FOR UPDATE")
+	if err != nil {
+		return Device{}, err
+	}
+	var used []int
+	for rows.Next() {
+		var i int
+		if err := rows.Scan(&i); err != nil {
+			rows.Close()
+			return Device{}, err
+		}
+		used = append(used, i)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return Device{}, err
+	}
+
+	index, err := firstFreeIndex(used, wireguard.maxIndex())
+	if err != nil {
+		return Device{}, err
+	}
+
+	d := Device{UserID: userID, Name: name, PublicKey: keys.Public, CreatedAt: time.Now()}
+	var ipv4, ipv6 interface{}
+	if wireguard.IPv4Pool.IsValid() {
+		d.IPv4 = addrAt(wireguard.IPv4Pool, index).String()
+		ipv4 = d.IPv4
+	}
+	if wireguard.IPv6Pool.IsValid() {
+		d.IPv6 = addrAt(wireguard.IPv6Pool, index).String()
+		ipv6 = d.IPv6
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO devices (user_id, name, public_key, private_key_enc, ip_index, ipv4, ipv6) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, name, keys.Public, sealed, index, ipv4, ipv6,
+	)
+	if err != nil {
+		return Device{}, err
+	}
+	id, _ := result.LastInsertId()
+	d.ID = int(id)
+	return d, nil
+}
+
+// Render a wg-quick configuration for a device
+func renderClientConfig(c WireGuardConfig, d Device, privateKey string) string {
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", privateKey)
+	fmt.Fprintf(&b, "Address = %s\n", strings.Join(d.addresses(), ", "))
+	if len(c.DNS) > 0 {
+		fmt.Fprintf(&b, "DNS = %s\n", strings.Join(c.DNS, ", "))
+	}
+	if c.MTU > 0 {
+		fmt.Fprintf(&b, "MTU = %d\n", c.MTU)
+	}
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", c.ServerPublicKey)
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(c.AllowedIPs, ", "))
+	fmt.Fprintf(&b, "Endpoint = %s\n", c.Endpoint)
+	if c.PersistentKeepalive > 0 {
+		fmt.Fprintf(&b, "PersistentKeepalive = %d\n", c.PersistentKeepalive)
+	}
+	return b.String()
+}
+
+// Render the [Peer] sections the server needs for the given devices
+func renderServerPeers(devices []Device, usernames map[int]string) string {
+	var b strings.Builder
+	for i, d := range devices {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "# %s: %s\n", usernames[d.UserID], strings.NewReplacer("\n", " ", "\r", " ").Replace(d.Name))
+		b.WriteString("[Peer]\n")
+		fmt.Fprintf(&b, "PublicKey = %s\n", d.PublicKey)
+		fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(d.addresses(), ", "))
+	}
+	return b.String()
+}
+
+// User: Register a device and provision its WireGuard peer, up to the
+// account's device limit
+func CreateDevice(w http.ResponseWriter, r *http.Request) {
+	userID := currentPrincipal(r).UserID
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	name, err := deviceName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the user row serialises registrations so parallel requests
+	// cannot both take the last slot
+	if _, err := tx.Exec("SELECT id FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	limit, used, err := deviceLimit(tx, userID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if used >= limit {
+		http.Error(w, errDeviceLimitReached.Error(), http.StatusForbidden)
+		return
+	}
+
+	device, err := allocateDevice(tx, userID, name)
+	if err == errAddressPoolExhausted {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Println("Device provisioning error:", err)
+		http.Error(w, "Provisioning error", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Provisioning error", http.StatusInternalServerError)
+		return
+	}
+
+	logPrincipalActivity(r, "device.create", userID, map[string]interface{}{
+		"device_id": device.ID, "name": device.Name, "ipv4": device.IPv4, "ipv6": device.IPv6,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
+
+// User: Download a device's wg-quick config. format=conf returns the file
+// itself; otherwise JSON with the config and the payload for a QR code.
+// The device is assigned the least-loaded server, within region if given.
+func GetDeviceConfig(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := pathID(r)
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	node, err := deviceNode(currentPrincipal(r).UserID, deviceID, r.URL.Query().Get("region"))
+	switch {
+	case err == errDeviceNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == errNoNodeAvailable:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		log.Println("Node assignment error:", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	server := wireguard
+	if node.ID != 0 {
+		server.Endpoint, server.ServerPublicKey = node.WireGuardEndpoint, node.WireGuardPublicKey
+	}
+	if server.Endpoint == "" || server.ServerPublicKey == "" {
+		http.Error(w, errWireGuardUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var sealed string
+	row := db.QueryRow(
+		"SELECT id, user_id, name, public_key, COALESCE(ipv4, ''), COALESCE(ipv6, ''), created_at, private_key_enc FROM devices WHERE id = ? AND user_id = ?",
+		deviceID, currentPrincipal(r).UserID,
+	)
+	var d Device
+	err = row.Scan(&d.ID, &d.UserID, &d.Name, &d.PublicKey, &d.IPv4, &d.IPv6, &d.CreatedAt, &sealed)
+	if err == sql.ErrNoRows {
+		http.Error(w, errDeviceNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	privateKey, err := openDeviceKey(sealed)
+	if err != nil {
+		log.Println("Device key error:", err)
+		http.Error(w, "Device key error", http.StatusInternalServerError)
+		return
+	}
+
+	if node.ID != 0 {
+		d.NodeID = &node.ID
+	}
+	config := renderClientConfig(server, d, privateKey)
+	filename := fmt.Sprintf("vpn-%d.conf", d.ID)
+
+	// The config holds the device's private key
+	w.Header().Set("Cache-Control", "no-store")
+
+	if r.URL.Query().Get("format") == "conf" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		w.Write([]byte(config))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{
+		"device":     d,
+		"config":     config,
+		"qr_payload": config,
+		"filename":   filename,
+	}
+	if node.ID != 0 {
+		response["server"] = map[string]interface{}{"id": node.ID, "name": node.Name, "hostname": node.Hostname, "region": node.Region}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Admin: The [Peer] sections for every device of an account that may
+// connect, for syncing the server interface. node_id limits them to the
+// devices assigned to one server.
+func AdminGetWireGuardPeers(w http.ResponseWriter, r *http.Request) {
+	where, args := "", []interface{}{}
+	if v := r.URL.Query().Get("node_id"); v != "" {
+		nodeID, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid node_id", http.StatusBadRequest)
+			return
+		}
+		where, args = " AND d.node_id = ?", append(args, nodeID)
+	}
+
+	rows, err := db.Query(
+		`SELECT d.id, d.user_id, d.name, d.public_key, COALESCE(d.ipv4, ''), COALESCE(d.ipv6, ''), d.created_at, u.username
+		FROM devices d JOIN users u ON u.id = d.user_id
+		WHERE u.status = 'active' AND (u.expires_at IS NULL OR u.expires_at > NOW() OR u.role <> 'user')`+where+`
+		ORDER BY d.ip_index`,
+		args...,
+	)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var devices []Device
+	usernames := map[int]string{}
+	for rows.Next() {
+		var d Device
+		var username string
+		if err := rows.Scan(&d.ID, &d.UserID, &d.Name, &d.PublicKey, &d.IPv4, &d.IPv6, &d.CreatedAt, &username); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		devices = append(devices, d)
+		usernames[d.UserID] = username
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(renderServerPeers(devices, usernames)))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// TestGenerateWireGuardKey tests key encoding, clamping and the public half
+func TestGenerateWireGuardKey(t *testing.T) {
+	keys, err := generateWireGuardKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := base64.StdEncoding.DecodeString(keys.Private)
+	if err != nil || len(private) != 32 {
+		t.Fatalf("Unexpected private key %q", keys.Private)
+	}
+	if private[0]&7 != 0 || private[31]&128 != 0 || private[31]&64 == 0 {
+		t.Error("Private key is not clamped")
+	}
+
+	key, _ := ecdh.X25519().NewPrivateKey(private)
+	if base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()) != keys.Public {
+		t.Error("Public key does not match the private key")
+	}
+}
+
+// TestSealDeviceKey tests that stored private keys round-trip and are not plaintext
+func TestSealDeviceKey(t *testing.T) {
+	sealed, err := sealDeviceKey("private-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "private-key") {
+		t.Error("Sealed key contains the plaintext")
+	}
+	if opened, err := openDeviceKey(sealed); err != nil || opened != "private-key" {
+		t.Errorf("Expected round trip, got %q (%v)", opened, err)
+	}
+	if _, err := openDeviceKey(sealed[:len(sealed)-4] + "AAAA"); err == nil {
+		t.Error("Expected a tampered key to be rejected")
+	}
+}
+
+// TestAddressAllocation tests pool offsets and gap filling
+func TestAddressAllocation(t *testing.T) {
+	if got := addrAt(netip.MustParsePrefix("10.8.0.0/16"), 258); got.String() != "10.8.1.2" {
+		t.Errorf("Unexpected IPv4 address %s", got)
+	}
+	if got := addrAt(netip.MustParsePrefix("fd42::/64"), 65537); got.String() != "fd42::1:1" {
+		t.Errorf("Unexpected IPv6 address %s", got)
+	}
+
+	c := WireGuardConfig{IPv4Pool: netip.MustParsePrefix("10.0.0.0/29"), IPv6Pool: netip.MustParsePrefix("fd00::/64")}
+	if c.maxIndex() != 6 {
+		t.Errorf("Expected 6 as the last index of a /29, got %d", c.maxIndex())
+	}
+
+	for _, tc := range []struct {
+		used []int
+		want int
+	}{
+		{nil, 2},
+		{[]int{2, 3, 5}, 4},
+		{[]int{2, 3, 4}, 5},
+		{[]int{3, 4}, 2},
+	} {
+		if got, err := firstFreeIndex(tc.used, 6); err != nil || got != tc.want {
+			t.Errorf("firstFreeIndex(%v) = %d, %v; want %d", tc.used, got, err, tc.want)
+		}
+	}
+	if _, err := firstFreeIndex([]int{2, 3, 4, 5, 6}, 6); err != errAddressPoolExhausted {
+		t.Errorf("Expected a full pool to be exhausted, got %v", err)
+	}
+}
+
+// TestRenderClientConfig tests the wg-quick output
+func TestRenderClientConfig(t *testing.T) {
+	c := WireGuardConfig{
+		Endpoint:            "vpn.example.com:51820",
+		ServerPublicKey:     "SERVERKEY=",
+		DNS:                 []string{"1.1.1.1", "2606:4700:4700::1111"},
+		AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+		PersistentKeepalive: 25,
+	}
+	d := Device{IPv4: "10.8.0.2", IPv6: "fd42:42:42::2"}
+
+	want := `[Interface]
+PrivateKey = CLIENTKEY=
+Address = 10.8.0.2/32, fd42:42:42::2/128
+DNS = 1.1.1.1, 2606:4700:4700::1111
+
+[Peer]
+PublicKey = SERVERKEY=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = vpn.example.com:51820
+PersistentKeepalive = 25
+`
+	if got := renderClientConfig(c, d, "CLIENTKEY="); got != want {
+		t.Errorf("Unexpected config:\n%s", got)
+	}
+
+	peers := renderServerPeers([]Device{{UserID: 7, Name: "phone\n[Peer]", PublicKey: "PEERKEY=", IPv4: "10.8.0.2"}}, map[int]string{7: "12345678"})
+	if strings.Count(peers, "\n[Peer]\n") != 1 || !strings.Contains(peers, "AllowedIPs = 10.8.0.2/32\n") {
+		t.Errorf("Unexpected server peers:\n%s", peers)
+	}
+}
@@ -0,0 +1,281 @@
+-- Upgrade a database created from the original schema.sql to the current
+-- schema. Apply once, after taking a backup; see "Upgrading an existing
+-- database" in README.md. Fresh installs get all of this from schema.sql.
+USE vpn_management;
+
+-- Package catalog fields
+ALTER TABLE packages
+    ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD' AFTER price,
+    ADD COLUMN active BOOLEAN NOT NULL DEFAULT TRUE AFTER description,
+    ADD COLUMN sort_order INT NOT NULL DEFAULT 0 AFTER active,
+    ADD COLUMN bandwidth_limit_gb INT NULL AFTER sort_order,
+    ADD COLUMN max_devices INT NOT NULL DEFAULT 1 AFTER bandwidth_limit_gb,
+    ADD COLUMN visible_to_resellers BOOLEAN NOT NULL DEFAULT TRUE AFTER max_devices,
+    ADD COLUMN archived_at TIMESTAMP NULL AFTER visible_to_resellers,
+    ADD COLUMN updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP AFTER created_at,
+    ADD INDEX (active, sort_order);
+
+UPDATE packages SET sort_order = id;
+
+-- Account lifecycle, verification, device limits and ownership
+ALTER TABLE users
+    ADD COLUMN email_verified_at TIMESTAMP NULL AFTER email,
+    MODIFY COLUMN status ENUM('pending_verification', 'active', 'expired', 'suspended', 'archived') NOT NULL DEFAULT 'active',
+    ADD COLUMN suspension_reason ENUM('admin', 'reseller', 'lapsed') NULL AFTER status,
+    ADD COLUMN max_devices INT NULL AFTER package_id,
+    ADD COLUMN created_by INT NULL AFTER reseller_id,
+    ADD FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL;
+
+-- Suspensions made before reasons were recorded were made by admins
+UPDATE users SET suspension_reason = 'admin' WHERE status = 'suspended';
+
+-- The audit trail moves from user_id to actor_id/target_id without foreign
+-- keys, so it is rebuilt rather than altered. Old entries described the
+-- user acting on their own account.
+RENAME TABLE activity_logs TO activity_logs_old;
+
+CREATE TABLE activity_logs (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    actor_id INT NULL,
+    target_id INT NULL,
+    action VARCHAR(100) NOT NULL,
+    ip_address VARCHAR(45),
+    details JSON NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX(actor_id, id),
+    INDEX(target_id, id),
+    INDEX(action, id),
+    INDEX(created_at)
+);
+
+INSERT INTO activity_logs (id, actor_id, target_id, action, ip_address, created_at)
+SELECT id, user_id, user_id, COALESCE(action, ''), ip_address, created_at FROM activity_logs_old;
+
+DROP TABLE activity_logs_old;
+
+-- Audit trail of reseller quota changes
+CREATE TABLE IF NOT EXISTS reseller_quota_changes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    reseller_id INT NOT NULL,
+    changed_by INT NULL,
+    old_quota INT NOT NULL,
+    new_quota INT NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (reseller_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (changed_by) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX(reseller_id)
+);
+
+-- Login sessions backing rotating refresh tokens
+CREATE TABLE IF NOT EXISTS sessions (
+    id CHAR(32) PRIMARY KEY,
+    user_id INT NOT NULL,
+    refresh_token_hash CHAR(64) NOT NULL UNIQUE,
+    previous_token_hash CHAR(64) NULL,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NULL,
+    last_used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX(user_id),
+    INDEX(previous_token_hash),
+    INDEX(expires_at)
+);
+
+-- Single-use password reset tokens; only their SHA-256 is stored
+CREATE TABLE IF NOT EXISTS password_resets (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    requested_ip VARCHAR(45),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX(user_id),
+    INDEX(expires_at)
+);
+
+-- TOTP secrets for staff two-factor; enabled_at is NULL until confirmed
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INT PRIMARY KEY,
+    secret VARCHAR(64) NOT NULL,
+    enabled_at TIMESTAMP NULL,
+    last_counter BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- Single-use two-factor recovery codes, stored as SHA-256
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX(user_id, code_hash)
+);
+
+-- Runtime settings changed by admins, such as the two-factor policy
+CREATE TABLE IF NOT EXISTS settings (
+    name VARCHAR(100) PRIMARY KEY,
+    value VARCHAR(255) NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+-- Subscription renewals and package changes
+CREATE TABLE IF NOT EXISTS renewal_history (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    actor_id INT NULL,
+    source ENUM('self', 'admin', 'reseller', 'voucher') NOT NULL,
+    old_package_id INT NULL,
+    new_package_id INT NOT NULL,
+    old_expires_at TIMESTAMP NULL,
+    new_expires_at TIMESTAMP NULL,
+    days_added INT NOT NULL,
+    credit_days INT NOT NULL DEFAULT 0,
+    price DECIMAL(10, 2) NOT NULL,
+    currency CHAR(3) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (actor_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (old_package_id) REFERENCES packages(id),
+    FOREIGN KEY (new_package_id) REFERENCES packages(id),
+    INDEX(user_id, created_at)
+);
+
+-- Background job state shared by all backend replicas
+CREATE TABLE IF NOT EXISTS scheduled_jobs (
+    name VARCHAR(100) PRIMARY KEY,
+    schedule VARCHAR(100) NOT NULL,
+    last_run_at TIMESTAMP NULL,
+    last_status VARCHAR(20) NULL,
+    last_result TEXT,
+    last_error TEXT,
+    last_duration_ms BIGINT NULL,
+    next_run_at TIMESTAMP NULL,
+    run_by VARCHAR(255) NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+-- Login and signup throttling state, keyed by rule and client IP or username
+CREATE TABLE IF NOT EXISTS rate_limits (
+    rl_key VARCHAR(191) PRIMARY KEY,
+    tokens DOUBLE NOT NULL DEFAULT 0,
+    updated_at DATETIME(6) NULL,
+    failures INT NOT NULL DEFAULT 0,
+    locked_until DATETIME(6) NULL,
+    INDEX(updated_at)
+);
+
+-- Prepaid vouchers. A reseller's unredeemed vouchers count against its quota.
+CREATE TABLE IF NOT EXISTS voucher_batches (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    package_id INT NOT NULL,
+    reseller_id INT NULL,
+    created_by INT NULL,
+    quantity INT NOT NULL,
+    note VARCHAR(255),
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (package_id) REFERENCES packages(id),
+    FOREIGN KEY (reseller_id) REFERENCES users(id) ON DELETE SET NULL,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX(reseller_id)
+);
+
+-- Codes are stored as SHA-256 hashes and shown only when generated
+CREATE TABLE IF NOT EXISTS vouchers (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    batch_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL UNIQUE,
+    redeemed_at TIMESTAMP NULL,
+    redeemed_by INT NULL,
+    revoked_at TIMESTAMP NULL,
+    FOREIGN KEY (batch_id) REFERENCES voucher_batches(id) ON DELETE CASCADE,
+    FOREIGN KEY (redeemed_by) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX(batch_id)
+);
+
+-- is open to every package.
+CREATE TABLE IF NOT EXISTS nodes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(64) NOT NULL UNIQUE,
+    hostname VARCHAR(253) NOT NULL,
+    region VARCHAR(32) NOT NULL,
+    wireguard_endpoint VARCHAR(255) NULL,
+    wireguard_public_key CHAR(44) NULL,
+    openvpn_remote VARCHAR(255) NULL,
+    capacity INT NOT NULL DEFAULT 250,
+    health ENUM('healthy', 'degraded', 'down') NOT NULL DEFAULT 'healthy',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    INDEX(region)
+);
+
+CREATE TABLE IF NOT EXISTS node_packages (
+    node_id INT NOT NULL,
+    package_id INT NOT NULL,
+    PRIMARY KEY (node_id, package_id),
+    FOREIGN KEY (node_id) REFERENCES nodes(id) ON DELETE CASCADE,
+    FOREIGN KEY (package_id) REFERENCES packages(id) ON DELETE CASCADE
+);
+
+-- pools; private keys are encrypted with DEVICE_KEY_SECRET.
+CREATE TABLE IF NOT EXISTS devices (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    public_key CHAR(44) NOT NULL UNIQUE,
+    private_key_enc VARCHAR(255) NOT NULL,
+    ip_index INT NOT NULL UNIQUE,
+    ipv4 VARCHAR(15) NULL UNIQUE,
+    ipv6 VARCHAR(39) NULL UNIQUE,
+    node_id INT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (node_id) REFERENCES nodes(id) ON DELETE SET NULL,
+    INDEX(user_id),
+    INDEX(node_id)
+);
+
+-- without a cascade so revoked certificates stay on the CRL after deletion.
+CREATE TABLE IF NOT EXISTS client_certificates (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NULL,
+    serial VARCHAR(40) NOT NULL UNIQUE,
+    cert_pem TEXT NOT NULL,
+    key_enc TEXT NOT NULL,
+    not_after TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX(user_id),
+    INDEX(revoked_at, not_after)
+);
+
+-- is cleared rather than cascaded so usage history survives deletion.
+CREATE TABLE IF NOT EXISTS radius_sessions (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NULL,
+    username VARCHAR(253) NOT NULL,
+    nas_ip VARCHAR(45) NOT NULL,
+    nas_identifier VARCHAR(253) NULL,
+    session_id VARCHAR(253) NOT NULL,
+    framed_ip VARCHAR(45) NULL,
+    calling_station_id VARCHAR(253) NULL,
+    started_at TIMESTAMP NOT NULL,
+    stopped_at TIMESTAMP NULL,
+    session_time INT UNSIGNED NOT NULL DEFAULT 0,
+    input_octets BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    output_octets BIGINT UNSIGNED NOT NULL DEFAULT 0,
+    terminate_cause INT UNSIGNED NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+    UNIQUE KEY (nas_ip, session_id),
+    INDEX(user_id, started_at),
+    INDEX(nas_ip, stopped_at)
+);
@@ -0,0 +1,6 @@
+-- Record when the newest email verification link was sent, so unverified
+-- signups are removed only once that link has expired. Apply after 001.
+USE vpn_management;
+
+ALTER TABLE users
+    ADD COLUMN verification_sent_at TIMESTAMP NULL AFTER email_verified_at;
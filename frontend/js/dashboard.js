@@ -34,6 +34,64 @@ document.addEventListener('DOMContentLoaded', async () => {
     setupEventListeners();
 });
 
+// Fetch an API path with the access token. Access tokens are short-lived,
+// so a 401 refreshes the session once and retries the request.
+async function apiFetch(path, options = {}) {
+    let response = await fetch(`${API_URL}${path}`, withToken(options));
+    if (response.status === 401 && await refreshSession()) {
+        response = await fetch(`${API_URL}${path}`, withToken(options));
+    }
+    return response;
+}
+
+function withToken(options) {
+    return {
+        ...options,
+        headers: { ...options.headers, 'Authorization': `Bearer ${token}` }
+    };
+}
+
+// Refresh in progress; refresh tokens are single-use, so concurrent 401s
+// must share one refresh rather than each spending the same token
+let refreshing = null;
+
+// Trade the refresh token for a new pair. When that fails the session is
+// over and the user signs in again.
+function refreshSession() {
+    if (!refreshing) {
+        refreshing = (async () => {
+            const refreshToken = localStorage.getItem('refresh_token');
+            if (refreshToken) {
+                const response = await fetch(`${API_URL}/auth/refresh`, {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify({ refresh_token: refreshToken })
+                });
+                if (response.ok) {
+                    const data = await response.json();
+                    token = data.token;
+                    localStorage.setItem('token', data.token);
+                    localStorage.setItem('refresh_token', data.refresh_token);
+                    localStorage.setItem('user', JSON.stringify(data.user));
+                    return true;
+                }
+            }
+            clearSession();
+            window.location.href = 'login.html';
+            return false;
+        })().catch(() => false).finally(() => {
+            refreshing = null;
+        });
+    }
+    return refreshing;
+}
+
+function clearSession() {
+    localStorage.removeItem('token');
+    localStorage.removeItem('refresh_token');
+    localStorage.removeItem('user');
+}
+
 function showTab(tabName) {
     // Hide all content
     document.querySelectorAll('.content-tab').forEach(tab => {
@@ -62,9 +120,7 @@ function showTab(tabName) {
 
 async function loadProfile() {
     try {
-        const response = await fetch(`${API_URL}/user/profile`, {
-            headers: { 'Authorization': `Bearer ${token}` }
-        });
+        const response = await apiFetch(`/user/profile`);
         
         const user = await response.json();
         
@@ -88,11 +144,9 @@ async function loadProfile() {
 
 async function loadAllUsers() {
     try {
-        const response = await fetch(`${API_URL}/admin/users`, {
-            headers: { 'Authorization': `Bearer ${token}` }
-        });
+        const response = await apiFetch(`/admin/users`);
         
-        const users = await response.json();
+        const { items: users } = await response.json();
         const tbody = document.getElementById('usersTableBody');
         
         tbody.innerHTML = users.map(user => `
@@ -108,14 +162,14 @@ async function loadAllUsers() {
                 </td>
                 <td>${new Date(user.expires_at).toLocaleDateString()}</td>
                 <td>
-                    ${user.status === 'active' ? `
-                        <button class="btn btn-sm btn-warning" onclick="suspendUser(${user.id})">
-                            Suspend
-                        </button>
-                    ` : `
+                    ${user.status === 'suspended' ? `
                         <button class="btn btn-sm btn-success" onclick="activateUser(${user.id})">
                             Activate
                         </button>
+                    ` : `
+                        <button class="btn btn-sm btn-warning" onclick="suspendUser(${user.id})">
+                            Suspend
+                        </button>
                     `}
                     <button class="btn btn-sm btn-danger" onclick="deleteUser(${user.id})">
                         Delete
@@ -130,9 +184,8 @@ async function loadAllUsers() {
 
 async function suspendUser(userId) {
     try {
-        const response = await fetch(`${API_URL}/admin/users/${userId}/suspend`, {
-            method: 'PUT',
-            headers: { 'Authorization': `Bearer ${token}` }
+        const response = await apiFetch(`/admin/users/${userId}/suspend`, {
+            method: 'PUT'
         });
         
         await loadAllUsers();
@@ -144,10 +197,13 @@ async function suspendUser(userId) {
 
 async function activateUser(userId) {
     try {
-        const response = await fetch(`${API_URL}/admin/users/${userId}/activate`, {
-            method: 'PUT',
-            headers: { 'Authorization': `Bearer ${token}` }
+        const response = await apiFetch(`/admin/users/${userId}/activate`, {
+            method: 'PUT'
         });
+        if (!response.ok) {
+            alert(await response.text());
+            return;
+        }
         
         await loadAllUsers();
         alert('User activated successfully');
@@ -159,9 +215,8 @@ async function activateUser(userId) {
 async function deleteUser(userId) {
     if (confirm('Are you sure you want to delete this user?')) {
         try {
-            const response = await fetch(`${API_URL}/admin/users/${userId}/delete`, {
-                method: 'DELETE',
-                headers: { 'Authorization': `Bearer ${token}` }
+            const response = await apiFetch(`/admin/users/${userId}/delete`, {
+                method: 'DELETE'
             });
             
             await loadAllUsers();
@@ -175,9 +230,7 @@ async function deleteUser(userId) {
 async function loadResellerData() {
     try {
         // Load quota
-        const quotaResponse = await fetch(`${API_URL}/reseller/quota`, {
-            headers: { 'Authorization': `Bearer ${token}` }
-        });
+        const quotaResponse = await apiFetch(`/reseller/quota`);
         const quotaData = await quotaResponse.json();
         
         document.getElementById('totalQuota').textContent = quotaData.total_quota;
@@ -185,10 +238,8 @@ async function loadResellerData() {
         document.getElementById('remainingQuota').textContent = quotaData.remaining;
         
         // Load users
-        const usersResponse = await fetch(`${API_URL}/reseller/users`, {
-            headers: { 'Authorization': `Bearer ${token}` }
-        });
-        const users = await usersResponse.json();
+        const usersResponse = await apiFetch(`/reseller/users`);
+        const { items: users } = await usersResponse.json();
         
         const tbody = document.getElementById('resellerUsersTableBody');
         tbody.innerHTML = users.map(user => `
@@ -219,10 +270,9 @@ function setupEventListeners() {
             const email = document.getElementById('newEmail').value;
             
             try {
-                const response = await fetch(`${API_URL}/user/update`, {
+                const response = await apiFetch(`/user/update`, {
                     method: 'PUT',
                     headers: {
-                        'Authorization': `Bearer ${token}`,
                         'Content-Type': 'application/json'
                     },
                     body: JSON.stringify({ email })
@@ -246,10 +296,9 @@ function setupEventListeners() {
             const expiryDays = parseInt(document.getElementById('expiryDays').value);
             
             try {
-                const response = await fetch(`${API_URL}/reseller/create-user`, {
+                const response = await apiFetch(`/reseller/create-user`, {
                     method: 'POST',
                     headers: {
-                        'Authorization': `Bearer ${token}`,
                         'Content-Type': 'application/json'
                     },
                     body: JSON.stringify({ email, expiry_days: expiryDays })
@@ -268,9 +317,15 @@ function setupEventListeners() {
     }
 }
 
-function logout() {
-    localStorage.removeItem('token');
-    localStorage.removeItem('user');
+// Revoke the session on the server before forgetting it here, so the
+// refresh token cannot be used again
+async function logout() {
+    try {
+        await apiFetch('/auth/logout', { method: 'POST' });
+    } catch (error) {
+        console.error('Error signing out:', error);
+    }
+    clearSession();
     window.location.href = 'login.html';
 }
 
@@ -1,27 +1,13 @@
 const API_URL = window.location.origin + '/api';
 
 document.addEventListener('DOMContentLoaded', function() {
-    // Add click handlers for demo credentials
-    const demoCreds = document.querySelectorAll('.demo-cred');
-    demoCreds.forEach((cred, index) => {
-        cred.style.cursor = 'pointer';
-        cred.addEventListener('click', function() {
-            const value = this.querySelector('.demo-value').textContent;
-            if (index === 0) { // Username
-                document.getElementById('username').value = value;
-                document.getElementById('username').focus();
-            } else { // Password  
-                document.getElementById('password').value = value;
-                document.getElementById('password').focus();
-            }
-            
-            // Add visual feedback
-            this.style.transform = 'scale(0.98)';
-            setTimeout(() => {
-                this.style.transform = 'scale(1)';
-            }, 150);
-        });
-    });
+    // Result of following an email verification link
+    const verified = new URLSearchParams(window.location.search).get('verified');
+    if (verified === '1') {
+        showAlert('Email verified! You can now log in.', 'success');
+    } else if (verified === '0') {
+        showAlert('That verification link is invalid or has expired.', 'danger');
+    }
 
     // Add input focus effects
     const inputs = document.querySelectorAll('.form-control-modern');
@@ -44,14 +30,16 @@ document.addEventListener('DOMContentLoaded', function() {
     });
 });
 
+// Challenge from the password step while a second factor is pending
+let challengeToken = null;
+
 document.getElementById('loginForm').addEventListener('submit', async (e) => {
     e.preventDefault();
     
     const username = document.getElementById('username').value.trim();
     const password = document.getElementById('password').value;
     const alertBox = document.getElementById('alertBox');
-    const alertText = document.getElementById('alertText');
-    const submitBtn = document.querySelector('.btn-login');
+    const submitBtn = e.target.querySelector('.btn-login');
     
     // Hide any existing alerts
     alertBox.classList.add('d-none');
@@ -67,54 +55,19 @@ document.getElementById('loginForm').addEventListener('submit', async (e) => {
     submitBtn.disabled = true;
     
     try {
-        const response = await fetch(`${API_URL}/auth/login`, {
-            method: 'POST',
-            headers: {
-                'Content-Type': 'application/json',
-            },
-            body: JSON.stringify({ username, password })
-        });
-        
-        const data = await response.json();
+        const data = await postAuth('/auth/login', { username, password });
         
-        if (!response.ok || data.error) {
-            throw new Error(data.error || `HTTP error! status: ${response.status}`);
+        // Staff with two-factor finish with a code from their app
+        if (data.two_factor_required || data.two_factor_setup_required) {
+            challengeToken = data.challenge_token;
+            await showTwoFactorStep(data.two_factor_setup_required);
+            return;
         }
         
-        // Store token and user info
-        localStorage.setItem('token', data.token);
-        localStorage.setItem('user', JSON.stringify(data.user));
-        
-        // Show success message briefly
-        showAlert('Login successful! Redirecting...', 'success');
-        
-        // Add a small delay for better UX
-        setTimeout(() => {
-            window.location.href = 'dashboard.html';
-        }, 1000);
+        finishLogin(data);
         
     } catch (error) {
-        console.error('Login error:', error);
-        
-        let errorMessage = 'Login failed. Please try again.';
-        
-        if (error.message.includes('credentials')) {
-            errorMessage = 'Invalid username or password. Please check your credentials.';
-        } else if (error.message.includes('network') || error.message.includes('fetch')) {
-            errorMessage = 'Network error. Please check your connection and try again.';
-        } else if (error.message) {
-            errorMessage = error.message;
-        }
-        
-        showAlert(errorMessage, 'danger');
-        
-        // Add shake animation to form
-        const loginCard = document.querySelector('.login-card');
-        loginCard.style.animation = 'shake 0.5s ease-in-out';
-        setTimeout(() => {
-            loginCard.style.animation = '';
-        }, 500);
-        
+        showLoginError(error);
     } finally {
         // Remove loading state
         submitBtn.classList.remove('loading');
@@ -122,6 +75,142 @@ document.getElementById('loginForm').addEventListener('submit', async (e) => {
     }
 });
 
+document.getElementById('twoFactorForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+    
+    const code = document.getElementById('twoFactorCode').value.trim();
+    const submitBtn = e.target.querySelector('.btn-login');
+    
+    document.getElementById('alertBox').classList.add('d-none');
+    
+    if (!code) {
+        showAlert('Please enter your authentication code', 'danger');
+        return;
+    }
+    
+    submitBtn.classList.add('loading');
+    submitBtn.disabled = true;
+    
+    try {
+        const data = await postAuth('/auth/2fa', { challenge_token: challengeToken, code });
+        finishLogin(data);
+    } catch (error) {
+        // The challenge is short-lived; start over from the password
+        if (error.message.includes('challenge')) {
+            resetLogin();
+        }
+        showLoginError(error);
+    } finally {
+        submitBtn.classList.remove('loading');
+        submitBtn.disabled = false;
+    }
+});
+
+document.getElementById('recoveryContinue').addEventListener('click', () => {
+    window.location.href = 'dashboard.html';
+});
+
+// POST to an auth endpoint. Errors arrive either as JSON with an error
+// field or as plain text.
+async function postAuth(path, body) {
+    const response = await fetch(`${API_URL}${path}`, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify(body)
+    });
+    
+    const text = await response.text();
+    let data;
+    try {
+        data = JSON.parse(text);
+    } catch (err) {
+        data = { error: text.trim() };
+    }
+    
+    if (!response.ok || data.error) {
+        throw new Error(data.error || `HTTP error! status: ${response.status}`);
+    }
+    return data;
+}
+
+// Swap the password form for the code form. Accounts that policy requires
+// to enroll are first shown a new secret for their authenticator app.
+async function showTwoFactorStep(setup) {
+    if (setup) {
+        const data = await postAuth('/auth/2fa/setup', { challenge_token: challengeToken });
+        document.getElementById('totpSecret').textContent = data.secret;
+        document.getElementById('totpLink').href = data.otpauth_uri;
+    }
+    
+    document.getElementById('twoFactorSetup').classList.toggle('d-none', !setup);
+    document.getElementById('twoFactorPrompt').textContent = setup
+        ? 'Then enter the 6-digit code the app shows to finish setting up.'
+        : 'Enter the 6-digit code from your authenticator app, or one of your recovery codes.';
+    
+    document.getElementById('loginForm').classList.add('d-none');
+    document.getElementById('twoFactorForm').classList.remove('d-none');
+    document.getElementById('twoFactorCode').value = '';
+    document.getElementById('twoFactorCode').focus();
+}
+
+// Back to the password step
+function resetLogin() {
+    challengeToken = null;
+    document.getElementById('loginForm').reset();
+    document.getElementById('loginForm').classList.remove('d-none');
+    document.getElementById('twoFactorForm').classList.add('d-none');
+    document.getElementById('recoveryCodesBox').classList.add('d-none');
+}
+
+// Store the session and go to the dashboard. Recovery codes issued when
+// enrolling are shown first, since they cannot be displayed again.
+function finishLogin(data) {
+    localStorage.setItem('token', data.token);
+    localStorage.setItem('refresh_token', data.refresh_token);
+    localStorage.setItem('user', JSON.stringify(data.user));
+    challengeToken = null;
+    
+    if (data.recovery_codes && data.recovery_codes.length) {
+        document.getElementById('recoveryCodes').textContent = data.recovery_codes.join('\n');
+        document.getElementById('twoFactorForm').classList.add('d-none');
+        document.getElementById('recoveryCodesBox').classList.remove('d-none');
+        return;
+    }
+    
+    // Show success message briefly
+    showAlert('Login successful! Redirecting...', 'success');
+    
+    // Add a small delay for better UX
+    setTimeout(() => {
+        window.location.href = 'dashboard.html';
+    }, 1000);
+}
+
+function showLoginError(error) {
+    console.error('Login error:', error);
+    
+    let errorMessage = 'Login failed. Please try again.';
+    
+    if (error.message.includes('credentials')) {
+        errorMessage = 'Invalid username or password. Please check your credentials.';
+    } else if (error.message.includes('network') || error.message.includes('fetch')) {
+        errorMessage = 'Network error. Please check your connection and try again.';
+    } else if (error.message) {
+        errorMessage = error.message;
+    }
+    
+    showAlert(errorMessage, 'danger');
+    
+    // Add shake animation to form
+    const loginCard = document.querySelector('.login-card');
+    loginCard.style.animation = 'shake 0.5s ease-in-out';
+    setTimeout(() => {
+        loginCard.style.animation = '';
+    }, 500);
+}
+
 function showAlert(message, type = 'danger') {
     const alertBox = document.getElementById('alertBox');
     const alertText = document.getElementById('alertText');
@@ -143,14 +232,9 @@ function showAlert(message, type = 'danger') {
 
 // Add keyboard shortcuts
 document.addEventListener('keydown', function(e) {
-    // Enter key on demo credentials
-    if (e.target.closest('.demo-cred') && e.key === 'Enter') {
-        e.target.closest('.demo-cred').click();
-    }
-    
-    // Escape key to clear form
+    // Escape key to clear form and leave a pending two-factor step
     if (e.key === 'Escape') {
-        document.getElementById('loginForm').reset();
+        resetLogin();
         document.getElementById('alertBox').classList.add('d-none');
         document.querySelectorAll('.form-group').forEach(group => {
             group.classList.remove('focused', 'has-value');
@@ -167,15 +251,6 @@ style.textContent = `
         20%, 40%, 60%, 80% { transform: translateX(5px); }
     }
     
-    .demo-cred {
-        transition: transform 0.15s ease;
-    }
-    
-    .demo-cred:hover {
-        transform: scale(1.02);
-        background: #f8f9fa !important;
-    }
-    
     .form-group.focused .input-icon {
         color: #667eea !important;
         transform: translateY(-50%) scale(1.1);
@@ -185,6 +260,14 @@ style.textContent = `
         color: #4a5568;
     }
     
+    .totp-secret, .recovery-codes {
+        background: #f7fafc;
+        border-radius: 8px;
+        padding: 12px;
+        font-family: 'Monaco', 'Consolas', monospace;
+        word-break: break-all;
+    }
+    
     .alert-success {
         background: linear-gradient(135deg, #c6f6d5 0%, #9ae6b4 100%) !important;
         color: #2f855a !important;
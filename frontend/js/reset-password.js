@@ -0,0 +1,113 @@
+const API_URL = window.location.origin + '/api';
+
+// Token from the emailed link; without one the page asks for a link
+const resetToken = new URLSearchParams(window.location.search).get('token');
+
+document.addEventListener('DOMContentLoaded', function() {
+    if (resetToken) {
+        document.getElementById('resetSubtitle').textContent = 'Choose a new password for your account';
+        document.getElementById('resetForm').classList.remove('d-none');
+        document.getElementById('password').focus();
+    } else {
+        document.getElementById('forgotForm').classList.remove('d-none');
+        document.getElementById('account').focus();
+    }
+});
+
+document.getElementById('forgotForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+
+    const account = document.getElementById('account').value.trim();
+    const submitBtn = e.target.querySelector('.btn-login');
+
+    if (!account) {
+        showAlert('Please enter your username or email address', 'danger');
+        return;
+    }
+
+    submitBtn.classList.add('loading');
+    submitBtn.disabled = true;
+
+    try {
+        const body = account.includes('@') ? { email: account } : { username: account };
+        const data = await postAuth('/auth/forgot', body);
+        showAlert(data.message, 'success');
+        e.target.reset();
+    } catch (error) {
+        showAlert(error.message, 'danger');
+    } finally {
+        submitBtn.classList.remove('loading');
+        submitBtn.disabled = false;
+    }
+});
+
+document.getElementById('resetForm').addEventListener('submit', async (e) => {
+    e.preventDefault();
+
+    const password = document.getElementById('password').value;
+    const confirmPassword = document.getElementById('confirmPassword').value;
+    const submitBtn = e.target.querySelector('.btn-login');
+
+    if (password !== confirmPassword) {
+        showAlert('Passwords do not match', 'danger');
+        return;
+    }
+
+    submitBtn.classList.add('loading');
+    submitBtn.disabled = true;
+
+    try {
+        const data = await postAuth('/auth/reset', { token: resetToken, password });
+
+        // Every session was signed out, including any stored here
+        localStorage.removeItem('token');
+        localStorage.removeItem('refresh_token');
+        localStorage.removeItem('user');
+
+        showAlert(data.message, 'success');
+        e.target.classList.add('d-none');
+        setTimeout(() => {
+            window.location.href = 'login.html';
+        }, 2000);
+    } catch (error) {
+        showAlert(error.message, 'danger');
+    } finally {
+        submitBtn.classList.remove('loading');
+        submitBtn.disabled = false;
+    }
+});
+
+// POST to an auth endpoint. Errors arrive either as JSON with an error
+// field or as plain text.
+async function postAuth(path, body) {
+    const response = await fetch(`${API_URL}${path}`, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json',
+        },
+        body: JSON.stringify(body)
+    });
+
+    const text = await response.text();
+    let data;
+    try {
+        data = JSON.parse(text);
+    } catch (err) {
+        data = { error: text.trim() };
+    }
+
+    if (!response.ok || data.error) {
+        throw new Error(data.error || `HTTP error! status: ${response.status}`);
+    }
+    return data;
+}
+
+function showAlert(message, type = 'danger') {
+    const alertBox = document.getElementById('alertBox');
+    const alertText = document.getElementById('alertText');
+
+    alertText.textContent = message;
+    alertBox.className = `alert alert-${type} alert-modern`;
+    alertBox.classList.remove('d-none');
+    alertBox.scrollIntoView({ behavior: 'smooth', block: 'nearest' });
+}
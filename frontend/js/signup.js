@@ -194,9 +194,12 @@ async function handleSignup(e) {
 
 // Show success modal with VPN credentials
 function showSuccessModal(data) {
-    // Store user data
-    localStorage.setItem('token', data.token);
-    localStorage.setItem('user', JSON.stringify(data.user));
+    // Store user data when the account may log in before verifying
+    if (data.token) {
+        localStorage.setItem('token', data.token);
+        localStorage.setItem('refresh_token', data.refresh_token);
+        localStorage.setItem('user', JSON.stringify(data.user));
+    }
     
     // Create success modal
     const modalHtml = `
@@ -243,6 +246,11 @@ function showSuccessModal(data) {
                                 <strong>Important:</strong> Save your VPN username! You'll need it to connect to our VPN servers.
                             </div>
                         </div>
+                        ${data.verification_required ? `
+                        <div class="alert alert-warning d-flex align-items-center">
+                            <i class="bi bi-envelope-fill me-2"></i>
+                            <div>We sent a verification link to your email. Please confirm your address${data.token ? '' : ' before logging in'}.</div>
+                        </div>` : ''}
                     </div>
                     <div class="modal-footer justify-content-center" style="border: none; background: #f8f9fa;">
                         <button type="button" class="btn btn-success btn-lg px-4" onclick="goToDashboard()">
@@ -281,9 +289,9 @@ function copyToClipboard(elementId) {
     });
 }
 
-// Go to dashboard
+// Go to dashboard, or to login when not yet logged in
 function goToDashboard() {
-    window.location.href = 'dashboard.html';
+    window.location.href = localStorage.getItem('token') ? 'dashboard.html' : 'login.html';
 }
 
 // Show alert function